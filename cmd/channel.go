@@ -0,0 +1,225 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/liri-infra/image-manager/internal/client"
+	"github.com/liri-infra/image-manager/internal/logger"
+)
+
+// addRetentionFlags adds the flags of the retention policy to cmd
+func addRetentionFlags(cmd *cobra.Command, retention *client.Retention) {
+	flags := cmd.Flags()
+	flags.StringVar(&retention.MaxAge, "max-age", "", "remove images older than this (e.g. \"72h\" or \"3d\")")
+	flags.IntVar(&retention.KeepLast, "keep-last", 0, "keep only the newest images")
+	flags.StringVar(&retention.MaxBytes, "max-bytes", "", "remove the oldest images when the channel is bigger than this (e.g. \"500G\")")
+	flags.BoolVar(&retention.KeepNewest, "keep-newest", false, "never remove the newest image")
+}
+
+// formatRetention returns a short description of channel's retention policy
+func formatRetention(channel *client.Channel) string {
+	if channel.Retention == nil {
+		return "keep all"
+	}
+
+	var rules []string
+	if channel.Retention.MaxAge != "" {
+		rules = append(rules, "max age "+channel.Retention.MaxAge)
+	}
+	if channel.Retention.KeepLast > 0 {
+		rules = append(rules, fmt.Sprintf("keep last %d", channel.Retention.KeepLast))
+	}
+	if channel.Retention.MaxBytes != "" {
+		rules = append(rules, "max size "+channel.Retention.MaxBytes)
+	}
+	if channel.Retention.KeepNewest {
+		rules = append(rules, "keep newest")
+	}
+	return strings.Join(rules, ", ")
+}
+
+func clientChannelListCmd(options *clientOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List the channels",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			c := options.connect()
+
+			channels, err := c.ListChannels()
+			if err != nil {
+				logger.Fatalf("Cannot list channels: %v", err)
+				return
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tPATH\tPUBLIC\tRETENTION")
+			for _, channel := range channels {
+				path := channel.Path
+				if path == "" {
+					path = "-"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%t\t%s\n", channel.Name, path, channel.Public, formatRetention(channel))
+			}
+			w.Flush()
+		},
+	}
+}
+
+func clientChannelAddCmd(options *clientOptions) *cobra.Command {
+	var (
+		channel   client.Channel
+		retention client.Retention
+	)
+
+	cmd := &cobra.Command{
+		Use:   "add <name>",
+		Short: "Add a channel",
+		Long:  "Adds a channel to the server configuration and creates its directory.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			c := options.connect()
+
+			channel.Name = args[0]
+			if retention != (client.Retention{}) {
+				channel.Retention = &retention
+			}
+
+			if _, err := c.AddChannel(&channel); err != nil {
+				logger.Fatalf("Cannot add channel \"%s\": %v", channel.Name, err)
+				return
+			}
+			logger.Infof("Added channel %s", channel.Name)
+		},
+	}
+
+	cmd.Flags().StringVar(&channel.Path, "path", "", "directory relative to the storage location (default the name)")
+	cmd.Flags().BoolVar(&channel.Public, "public", false, "files can be downloaded without a token")
+	addRetentionFlags(cmd, &retention)
+
+	return cmd
+}
+
+func clientChannelEditCmd(options *clientOptions) *cobra.Command {
+	var (
+		public      bool
+		retention   client.Retention
+		noRetention bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "edit <name>",
+		Short: "Change the settings of a channel",
+		Long:  "Changes the settings given on the command line, the others are left as they are.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			c := options.connect()
+			name := args[0]
+
+			var update client.ChannelUpdate
+			if cmd.Flags().Changed("public") {
+				update.Public = &public
+			}
+
+			// Retention rules that are not given are kept
+			retentionChanged := false
+			for _, flag := range []string{"max-age", "keep-last", "max-bytes", "keep-newest"} {
+				if cmd.Flags().Changed(flag) {
+					retentionChanged = true
+				}
+			}
+			if noRetention {
+				update.Retention = &client.Retention{}
+			} else if retentionChanged {
+				channels, err := c.ListChannels()
+				if err != nil {
+					logger.Fatalf("Cannot list channels: %v", err)
+					return
+				}
+
+				var current client.Retention
+				for _, channel := range channels {
+					if channel.Name == name && channel.Retention != nil {
+						current = *channel.Retention
+					}
+				}
+				if cmd.Flags().Changed("max-age") {
+					current.MaxAge = retention.MaxAge
+				}
+				if cmd.Flags().Changed("keep-last") {
+					current.KeepLast = retention.KeepLast
+				}
+				if cmd.Flags().Changed("max-bytes") {
+					current.MaxBytes = retention.MaxBytes
+				}
+				if cmd.Flags().Changed("keep-newest") {
+					current.KeepNewest = retention.KeepNewest
+				}
+				update.Retention = &current
+			}
+
+			if update.Public == nil && update.Retention == nil {
+				logger.Fatal("Nothing to change")
+				return
+			}
+
+			if _, err := c.EditChannel(name, &update); err != nil {
+				logger.Fatalf("Cannot edit channel \"%s\": %v", name, err)
+				return
+			}
+			logger.Infof("Edited channel %s", name)
+		},
+	}
+
+	cmd.Flags().BoolVar(&public, "public", false, "files can be downloaded without a token")
+	addRetentionFlags(cmd, &retention)
+	cmd.Flags().BoolVar(&noRetention, "no-retention", false, "remove the retention policy, images are kept forever")
+
+	return cmd
+}
+
+func clientChannelRemoveCmd(options *clientOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "remove <name>...",
+		Short: "Remove channels",
+		Long:  "Removes channels from the server configuration, their files are archived.",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			c := options.connect()
+
+			for _, name := range args {
+				if err := c.RemoveChannel(name); err != nil {
+					logger.Fatalf("Cannot remove channel \"%s\": %v", name, err)
+					return
+				}
+				logger.Infof("Removed channel %s", name)
+			}
+		},
+	}
+}
+
+func clientChannelCmd(options *clientOptions) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "channel",
+		Short: "Manage the channels of the server",
+		Long:  "Adds, changes and removes channels at runtime, the token needs the admin permission.",
+	}
+
+	cmd.AddCommand(
+		clientChannelListCmd(options),
+		clientChannelAddCmd(options),
+		clientChannelEditCmd(options),
+		clientChannelRemoveCmd(options),
+	)
+
+	return cmd
+}
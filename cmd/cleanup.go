@@ -0,0 +1,134 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/liri-infra/image-manager/internal/logger"
+	"github.com/liri-infra/image-manager/internal/server"
+)
+
+// formatSize returns a human readable representation of size
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func cleanupCmd() *cobra.Command {
+	var (
+		configPath  string
+		storagePath string
+		channels    []string
+		dryRun      bool
+		jsonOutput  bool
+		verbose     bool
+	)
+
+	var cmd = &cobra.Command{
+		Use:   "cleanup",
+		Short: "Remove old images according to the retention policies",
+		Long:  "Removes old images like the server does periodically, and prints what was removed.",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			// Toggle debug output
+			logger.SetVerbose(verbose)
+
+			// Open configuration file
+			config, err := server.OpenConfig(configPath)
+			if err != nil {
+				logger.Fatalf("Cannot open configuration file: %v", err)
+				return
+			}
+
+			// Overwrite storage path
+			if storagePath != "" {
+				config.StorageDir = storagePath
+			}
+
+			// We need a storage path
+			if config.StorageDir == "" {
+				logger.Fatal("Storage path is not configured")
+				return
+			}
+
+			// Restrict to some channels
+			imageChannels := config.Channels
+			if len(channels) > 0 {
+				imageChannels = nil
+				for _, name := range channels {
+					imageChannel := config.FindChannel(name)
+					if imageChannel == nil {
+						logger.Fatalf("Channel \"%s\" is not configured", name)
+						return
+					}
+					imageChannels = append(imageChannels, imageChannel)
+				}
+			}
+
+			storage, err := server.NewStorage(config)
+			if err != nil {
+				logger.Fatalf("Failed to open storage: %v", err)
+				return
+			}
+
+			appState := &server.AppState{
+				Config:    config,
+				Storage:   storage,
+				Checksums: server.NewChecksumCache(),
+			}
+			report := server.RemoveOldImages(appState, imageChannels, dryRun)
+
+			if jsonOutput {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				if err := encoder.Encode(report); err != nil {
+					logger.Fatal(err)
+				}
+				return
+			}
+
+			verb := "Removed"
+			if dryRun {
+				verb = "Would remove"
+			}
+			for _, channelReport := range report.Channels {
+				fmt.Printf("%s: %s %d builds, %s\n", channelReport.Channel, verb,
+					len(channelReport.Removed), formatSize(channelReport.FreedBytes))
+				for _, build := range channelReport.Removed {
+					fmt.Printf("  %s\t%s\t%s\n", build.ID, build.Created, formatSize(build.Size))
+					for _, name := range build.Files {
+						fmt.Printf("    %s\n", name)
+					}
+				}
+				if channelReport.Error != "" {
+					fmt.Printf("  error: %s\n", channelReport.Error)
+				}
+			}
+			fmt.Printf("Total: %s\n", formatSize(report.FreedBytes))
+		},
+	}
+
+	cmd.Flags().StringVarP(&configPath, "config", "c", "image-manager.yaml", "path to configuration file")
+	cmd.Flags().StringVarP(&storagePath, "path", "p", "", "override configured storage path")
+	cmd.Flags().StringSliceVar(&channels, "channel", nil, "only clean up this channel (default all)")
+	cmd.Flags().BoolVarP(&dryRun, "dry-run", "n", false, "show what would be removed without removing anything")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "print the report as JSON")
+	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "more messages during the build")
+
+	return cmd
+}
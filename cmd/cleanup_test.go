@@ -0,0 +1,88 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liri-infra/image-manager/internal/server"
+)
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		size     int64
+		expected string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1536, "1.5 KiB"},
+		{5 << 30, "5.0 GiB"},
+	}
+	for _, test := range tests {
+		if size := formatSize(test.size); size != test.expected {
+			t.Errorf("formatSize(%d) = %q, want %q", test.size, size, test.expected)
+		}
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	dir, path := writeTestConfig(t, "")
+	defer os.RemoveAll(dir)
+	text := "storage: " + dir + "\nchannels:\n  - name: nightly\n    retention:\n      max_age: 1d\n  - name: stable\n"
+	if err := ioutil.WriteFile(path, []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files uploaded before builds were introduced, grouped by name
+	old := time.Now().Add(-48 * time.Hour)
+	for name, modified := range map[string]time.Time{"old.iso": old, "old.iso.sha256sum": old, "new.iso": time.Now(), "new.iso.sha256sum": time.Now()} {
+		key := filepath.Join(dir, "nightly", name)
+		if err := os.MkdirAll(filepath.Dir(key), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(key, []byte("hello"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(key, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A dry run only reports what would be removed
+	output := captureOutput(t, func() {
+		runCommand(t, cleanupCmd(), "--config", path, "--dry-run", "--json")
+	})
+	var report server.CleanupReport
+	if err := json.Unmarshal([]byte(output), &report); err != nil {
+		t.Fatalf("%v: %s", err, output)
+	}
+	if !report.DryRun || report.FreedBytes != 10 || len(report.Channels) != 1 {
+		t.Fatalf("report %s", output)
+	}
+	if removed := report.Channels[0].Removed; len(removed) != 1 || removed[0].ID != "old.iso" || len(removed[0].Files) != 2 {
+		t.Fatalf("report %s", output)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "nightly", "old.iso")); err != nil {
+		t.Fatalf("dry run removed old.iso: %v", err)
+	}
+
+	output = captureOutput(t, func() {
+		runCommand(t, cleanupCmd(), "--config", path, "--channel", "nightly")
+	})
+	if !strings.HasPrefix(output, "nightly: Removed 1 builds, 10 B\n") || !strings.HasSuffix(output, "Total: 10 B\n") {
+		t.Fatalf("output %q", output)
+	}
+	for name, exists := range map[string]bool{"old.iso": false, "old.iso.sha256sum": false, "new.iso": true, "new.iso.sha256sum": true} {
+		if _, err := os.Stat(filepath.Join(dir, "nightly", name)); os.IsNotExist(err) == exists {
+			t.Fatalf("%s exists %v: %v", name, !exists, err)
+		}
+	}
+}
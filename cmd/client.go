@@ -0,0 +1,123 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/liri-infra/image-manager/internal/client"
+	"github.com/liri-infra/image-manager/internal/logger"
+)
+
+// clientOptions are the options shared by the client subcommands
+type clientOptions struct {
+	url     string
+	token   string
+	channel string
+	tls     client.TLSOptions
+	verbose bool
+}
+
+// validate toggles debug output and exits when the token is missing
+func (o *clientOptions) validate() {
+	// Toggle debug output
+	logger.SetVerbose(o.verbose)
+
+	// Check the token, unless a client certificate is used
+	if o.token == "" {
+		o.token = os.Getenv("IMAGE_MANAGER_TOKEN")
+	}
+	if o.token == "" && o.tls.CertFile == "" {
+		logger.Fatal("Token is mandatory")
+	}
+	if (o.tls.CertFile == "") != (o.tls.KeyFile == "") {
+		logger.Fatal("Client certificate and key go together")
+	}
+}
+
+// connect validates the options and creates a client, or exits
+func (o *clientOptions) connect() *client.Client {
+	o.validate()
+
+	c, err := client.NewClient(o.url, o.token, &o.tls)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	return c
+}
+
+func clientDeleteCmd(options *clientOptions) *cobra.Command {
+	var builds bool
+
+	cmd := &cobra.Command{
+		Use:   "delete <file>...",
+		Short: "Delete images from the repository",
+		Long:  "Deletes the build each file belongs to, or the builds themselves with --build.",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			c := options.connect()
+
+			if options.channel == "" {
+				logger.Fatal("Channel is mandatory")
+				return
+			}
+
+			for _, name := range args {
+				var err error
+				if builds {
+					err = c.DeleteBuild(options.channel, name)
+				} else {
+					err = c.Delete(options.channel, name)
+				}
+				if err != nil {
+					logger.Fatalf("Cannot delete \"%s\": %v", name, err)
+					return
+				}
+				logger.Infof("Deleted %s", name)
+			}
+		},
+	}
+
+	cmd.Flags().BoolVar(&builds, "build", false, "arguments are build identifiers")
+
+	return cmd
+}
+
+func clientPromoteCmd(options *clientOptions) *cobra.Command {
+	var target string
+
+	cmd := &cobra.Command{
+		Use:   "promote <build>...",
+		Short: "Promote builds to another channel",
+		Long:  "Copies builds to another channel on the server, without uploading them again.",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			c := options.connect()
+
+			if options.channel == "" {
+				logger.Fatal("Channel is mandatory")
+				return
+			}
+			if target == "" {
+				logger.Fatal("Target channel is mandatory")
+				return
+			}
+
+			for _, id := range args {
+				if err := c.PromoteBuild(options.channel, id, target); err != nil {
+					logger.Fatalf("Cannot promote \"%s\": %v", id, err)
+					return
+				}
+				logger.Infof("Promoted %s to %s", id, target)
+			}
+		},
+	}
+
+	cmd.Flags().StringVar(&target, "to", "", "target channel")
+
+	return cmd
+}
@@ -0,0 +1,83 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// requestRecorder is a server that replies to every request with an
+// empty object and remembers the method and URL of the requests
+type requestRecorder struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	requests []string
+}
+
+func newRequestRecorder() *requestRecorder {
+	recorder := &requestRecorder{}
+	recorder.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder.mutex.Lock()
+		recorder.requests = append(recorder.requests, r.Method+" "+r.URL.RequestURI()+" "+r.Header.Get("Authorization"))
+		recorder.mutex.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}\n"))
+	}))
+	return recorder
+}
+
+// checkRequests fails unless the recorded requests are expected
+func (r *requestRecorder) checkRequests(t *testing.T, expected ...string) {
+	t.Helper()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !reflect.DeepEqual(r.requests, expected) {
+		t.Fatalf("requests %q, want %q", r.requests, expected)
+	}
+}
+
+func TestClientDelete(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		requests []string
+	}{
+		{"files", []string{"image.iso", "other image.iso"}, []string{
+			"DELETE /api/v1/channels/nightly/images/image.iso BEARER secret",
+			"DELETE /api/v1/channels/nightly/images/other%20image.iso BEARER secret",
+		}},
+		{"builds", []string{"--build", "20200101T000000-00000001"}, []string{
+			"DELETE /api/v1/channels/nightly/builds/20200101T000000-00000001 BEARER secret",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newRequestRecorder()
+			defer server.Close()
+
+			args := append([]string{"delete", "--address", server.URL, "--token", "secret", "--channel", "nightly"}, test.args...)
+			runCommand(t, clientCmd(), args...)
+			server.checkRequests(t, test.requests...)
+		})
+	}
+}
+
+func TestClientPromote(t *testing.T) {
+	server := newRequestRecorder()
+	defer server.Close()
+
+	runCommand(t, clientCmd(), "promote", "--address", server.URL, "--token", "secret", "--channel", "nightly",
+		"--to", "stable", "20200101T000000-00000001", "20200102T000000-00000002")
+	server.checkRequests(t,
+		"POST /api/v1/channels/nightly/builds/20200101T000000-00000001/promote?to=stable BEARER secret",
+		"POST /api/v1/channels/nightly/builds/20200102T000000-00000002/promote?to=stable BEARER secret",
+	)
+}
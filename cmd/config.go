@@ -0,0 +1,57 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/liri-infra/image-manager/internal/server"
+)
+
+func configCheckCmd(configPath *string) *cobra.Command {
+	return &cobra.Command{
+		Use:   "check",
+		Short: "Check the configuration file",
+		Long:  "Validates the configuration file like the server does at startup, and prints every problem found.",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			_, err := server.OpenConfig(*configPath)
+			if err == nil {
+				fmt.Printf("%s: configuration is valid\n", *configPath)
+				return
+			}
+
+			// Print one problem per line
+			if configErr, ok := err.(*server.ConfigError); ok {
+				for _, problem := range configErr.Problems {
+					fmt.Fprintf(os.Stderr, "%s: %s\n", *configPath, problem)
+				}
+			} else {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, err)
+			}
+			os.Exit(1)
+		},
+	}
+}
+
+func configCmd() *cobra.Command {
+	var configPath string
+
+	var cmd = &cobra.Command{
+		Use:   "config",
+		Short: "Manage the configuration file",
+	}
+
+	cmd.PersistentFlags().StringVarP(&configPath, "config", "c", "image-manager.yaml", "path to configuration file")
+
+	cmd.AddCommand(
+		configCheckCmd(&configPath),
+	)
+
+	return cmd
+}
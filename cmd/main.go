@@ -5,22 +5,37 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/spf13/cobra"
 
 	"github.com/liri-infra/image-manager/internal/client"
+	"github.com/liri-infra/image-manager/internal/common"
 	"github.com/liri-infra/image-manager/internal/logger"
 	"github.com/liri-infra/image-manager/internal/server"
 )
 
+// Upload sessions that are not completed within this time are removed
+const sessionMaxAge = 2 * 24 * time.Hour
+
 func genTokenCmd() *cobra.Command {
 	var (
-		configPath string
-		verbose    bool
+		configPath  string
+		name        string
+		description string
+		expires     string
+		channels    []string
+		permissions []string
+		verbose     bool
 	)
 
 	var cmd = &cobra.Command{
@@ -37,6 +52,27 @@ func genTokenCmd() *cobra.Command {
 				return
 			}
 
+			// Validate the expiration
+			var lifetime time.Duration
+			if expires != "" {
+				var err error
+				if lifetime, err = common.ParseDuration(expires); err != nil || lifetime <= 0 {
+					logger.Fatalf("Invalid expiration \"%s\"", expires)
+					return
+				}
+			}
+
+			// Validate the scope
+			var scope []server.Permission
+			for _, name := range permissions {
+				permission, err := server.ParsePermission(name)
+				if err != nil {
+					logger.Fatal(err)
+					return
+				}
+				scope = append(scope, permission)
+			}
+
 			// Open configuration file
 			config, err := server.CreateConfig(configPath)
 			if err != nil {
@@ -44,12 +80,33 @@ func genTokenCmd() *cobra.Command {
 				return
 			}
 
+			// Only known channels can be used
+			for _, name := range channels {
+				if config.FindChannel(name) == nil {
+					logger.Fatalf("Channel \"%s\" is not configured", name)
+					return
+				}
+			}
+
 			// Generate token
-			token, err := server.GenerateToken()
+			token, secret, err := server.GenerateToken(channels, scope)
 			if err != nil {
 				logger.Fatalf("Failed to generate token: %v", err)
 				return
 			}
+			token.Name = name
+			token.Description = description
+			token.SetExpiration(lifetime)
+
+			// Do not leave secrets of older tokens around
+			count, err := config.HashPlaintextTokens()
+			if err != nil {
+				logger.Fatalf("Failed to hash tokens: %v", err)
+				return
+			}
+			if count > 0 {
+				logger.Infof("Replaced %d plaintext tokens with their hash", count)
+			}
 
 			// Save token to the configuration
 			config.Tokens = append(config.Tokens, token)
@@ -58,23 +115,85 @@ func genTokenCmd() *cobra.Command {
 				return
 			}
 
-			// Print token
-			logger.Infof("Token: %s", token.Token)
+			// Print token, this is the only time it's shown
+			logger.Infof("Token ID: %s", token.ID)
+			logger.Infof("Token: %s", secret)
+			logger.Info("Store it now, it cannot be recovered later")
 		},
 	}
 
 	cmd.Flags().StringVarP(&configPath, "config", "c", "image-manager.yaml", "path to configuration file")
+	cmd.Flags().StringVarP(&name, "name", "n", "", "name of the token")
+	cmd.Flags().StringVarP(&description, "description", "d", "", "what the token is used for")
+	cmd.Flags().StringVarP(&expires, "expires", "e", "", "token lifetime, for example 720h or 90d (default never)")
+	cmd.Flags().StringSliceVar(&channels, "channel", nil, "channel the token has access to (default all)")
+	cmd.Flags().StringSliceVar(&permissions, "permission", nil, "upload, delete, read or admin (default upload and read)")
 	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "more messages during the build")
 
 	return cmd
 }
 
+// fileModified returns when the file at path was last modified,
+// or the zero time if it cannot be found
+func fileModified(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// reloadConfig replaces the configuration of state with the one
+// returned by load, or keeps the current one if it fails
+func reloadConfig(state *server.SharedState, load func() (*server.Config, error)) {
+	config, err := load()
+	if err != nil {
+		logger.Errorf("Cannot reload configuration file, keeping the current one: %v", err)
+		return
+	}
+	if err := server.ApplyConfig(state, config); err != nil {
+		logger.Errorf("Cannot apply configuration, keeping the current one: %v", err)
+	}
+}
+
+// watchConfig calls reload when a signal is received from hangups and,
+// if interval is not zero, when the file at path changes, until ctx is done
+func watchConfig(ctx context.Context, path string, interval time.Duration, hangups <-chan os.Signal, reload func()) {
+	var changes <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		changes = ticker.C
+	}
+	modified := fileModified(path)
+
+	for {
+		select {
+		case <-hangups:
+			logger.Info("Received SIGHUP, reloading configuration")
+			modified = fileModified(path)
+			reload()
+		case <-changes:
+			if m := fileModified(path); !m.Equal(modified) {
+				logger.Info("Configuration file changed, reloading it")
+				modified = m
+				reload()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
 func serverCmd() *cobra.Command {
 	var (
-		bindAddress string
-		configPath  string
-		storagePath string
-		verbose     bool
+		bindAddress   string
+		configPath    string
+		storagePath   string
+		tlsConfig     server.TLSConfig
+		shutdown      time.Duration
+		watchInterval time.Duration
+		verbose       bool
 	)
 
 	var cmd = &cobra.Command{
@@ -84,54 +203,177 @@ func serverCmd() *cobra.Command {
 			// Toggle debug output
 			logger.SetVerbose(verbose)
 
-			// Open configuration file
-			config, err := server.OpenConfig(configPath)
+			// Open configuration file and apply the command line options,
+			// the same happens when it's reloaded
+			loadConfig := func() (*server.Config, error) {
+				config, err := server.OpenConfig(configPath)
+				if err != nil {
+					return nil, err
+				}
+
+				// Secrets should not be stored in the clear
+				for _, token := range config.Tokens {
+					if token.Hash == "" {
+						logger.Warn("Configuration file contains plaintext tokens, run gentoken to hash them")
+						break
+					}
+				}
+
+				// Overwrite storage path
+				if storagePath != "" {
+					config.StorageDir = storagePath
+				}
+
+				// Overwrite TLS configuration
+				if tlsConfig.Cert != "" || tlsConfig.Key != "" {
+					if config.TLS == nil {
+						config.TLS = &server.TLSConfig{}
+					}
+					config.TLS.Cert = tlsConfig.Cert
+					config.TLS.Key = tlsConfig.Key
+				}
+				if tlsConfig.ClientCA != "" {
+					if config.TLS == nil {
+						return nil, fmt.Errorf("client certificates require TLS")
+					}
+					config.TLS.ClientCA = tlsConfig.ClientCA
+				}
+				if config.TLS != nil && (config.TLS.Cert == "" || config.TLS.Key == "") {
+					return nil, fmt.Errorf("TLS requires both certificate and key")
+				}
+
+				// We need a storage path
+				if config.StorageDir == "" {
+					return nil, fmt.Errorf("storage path is not configured")
+				}
+
+				return config, nil
+			}
+
+			config, err := loadConfig()
 			if err != nil {
 				logger.Fatalf("Cannot open configuration file: %v", err)
 				return
 			}
 
-			// Overwrite storage path
-			if storagePath != "" {
-				config.StorageDir = storagePath
+			// Create channels directories
+			if err := server.CreateChannelDirs(config); err != nil {
+				logger.Fatalf("Failed to create channel directory: %v", err)
+				return
 			}
 
-			// We need a storage path
-			if config.StorageDir == "" {
-				logger.Fatal("Storage path is not configured")
+			// Where published files are stored
+			storage, err := server.NewStorage(config)
+			if err != nil {
+				logger.Fatalf("Failed to open storage: %v", err)
 				return
 			}
 
-			// Create channels directories
+			// Resumable upload sessions
+			sessions, err := server.NewSessionManager(filepath.Join(config.StorageDir, ".sessions"))
+			if err != nil {
+				logger.Fatalf("Failed to create upload sessions directory: %v", err)
+				return
+			}
+
+			// Notify the configured webhooks about changes
+			events := server.NewEventBus()
+			webhooks := server.NewWebhookDispatcher(config.Webhooks, filepath.Join(config.StorageDir, ".webhooks.log"))
+			events.Listen(webhooks.Handle)
+
+			appState := &server.AppState{
+				Config:    config,
+				Storage:   storage,
+				Sessions:  sessions,
+				Checksums: server.NewChecksumCache(),
+				Events:    events,
+				Webhooks:  webhooks,
+				Metrics:   server.NewMetrics(),
+			}
+			state := server.NewSharedState(appState)
+
+			// Indexes might be missing or outdated
 			for _, channel := range config.Channels {
-				path := filepath.Join(config.StorageDir, channel.Path)
-				if err := os.MkdirAll(path, 0755); err != nil {
-					logger.Fatalf("Failed to create \"%s\": %v", path, err)
-					return
+				if _, err := server.UpdateIndex(appState, channel); err != nil {
+					logger.Errorf("Failed to update index of channel \"%s\": %v", channel.Name, err)
 				}
 			}
 
-			// Remove old images
-			server.RemoveOldImages(config.StorageDir, config.Channels)
-			ticker := time.NewTicker(60 * 60 * time.Second)
+			// Stop gracefully on SIGINT and SIGTERM, or right away
+			// when the signal is received again
+			ctx, cancel := context.WithCancel(context.Background())
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+			go func() {
+				sig := <-signals
+				logger.Infof("Received %v, shutting down", sig)
+				cancel()
+
+				<-signals
+				logger.Fatal("Forced shutdown")
+			}()
+
+			// Reload the configuration on SIGHUP, and when the file
+			// changes if requested
+			hangups := make(chan os.Signal, 1)
+			signal.Notify(hangups, syscall.SIGHUP)
+			go watchConfig(ctx, configPath, watchInterval, hangups, func() {
+				reloadConfig(state, loadConfig)
+			})
+
+			// Remove old images and abandoned uploads
+			server.RemovePartialFiles(appState)
+			server.RemoveOldImages(appState, config.Channels, false)
+			sessions.RemoveStale(sessionMaxAge)
+			var cleanup sync.WaitGroup
+			cleanup.Add(1)
 			go func() {
-				for _ = range ticker.C {
-					server.RemoveOldImages(config.StorageDir, config.Channels)
+				defer cleanup.Done()
+
+				ticker := time.NewTicker(60 * 60 * time.Second)
+				defer ticker.Stop()
+
+				for {
+					select {
+					case <-ticker.C:
+						appState := state.Load()
+						server.RemoveOldImages(appState, appState.Config.Channels, false)
+						sessions.RemoveStale(sessionMaxAge)
+					case <-ctx.Done():
+						return
+					}
 				}
 			}()
-			defer ticker.Stop()
 
-			appState := &server.AppState{Config: config}
-			if err := server.StartServer(bindAddress, appState); err != nil {
+			err = server.StartServer(ctx, bindAddress, state, shutdown)
+			if err != nil && !errors.Is(err, server.ErrRequestsInProgress) {
 				logger.Fatal(err)
 				return
 			}
+
+			// Wait for a cleanup in progress
+			cleanup.Wait()
+
+			// Interrupted uploads that cannot be resumed, unless
+			// handlers are still writing them
+			if err == nil {
+				server.RemovePartialFiles(state.Load())
+			} else {
+				logger.Warnf("Not removing partial files: %v", err)
+			}
+
+			logger.Info("Server stopped")
 		},
 	}
 
 	cmd.Flags().StringVarP(&configPath, "config", "c", "image-manager.yaml", "path to configuration file")
 	cmd.Flags().StringVarP(&bindAddress, "address", "a", ":8080", "host name and port to bind")
 	cmd.Flags().StringVarP(&storagePath, "path", "p", "", "override configured storage path")
+	cmd.Flags().DurationVar(&watchInterval, "watch-config", 0, "check the configuration file for changes this often (default never)")
+	cmd.Flags().DurationVar(&shutdown, "shutdown-timeout", 5*time.Minute, "how long to wait for requests in progress when stopping")
+	cmd.Flags().StringVar(&tlsConfig.Cert, "tls-cert", "", "override configured TLS certificate")
+	cmd.Flags().StringVar(&tlsConfig.Key, "tls-key", "", "override configured TLS private key")
+	cmd.Flags().StringVar(&tlsConfig.ClientCA, "tls-client-ca", "", "override configured CA bundle for client certificates")
 	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "more messages during the build")
 
 	return cmd
@@ -139,31 +381,19 @@ func serverCmd() *cobra.Command {
 
 func clientCmd() *cobra.Command {
 	var (
-		url              string
-		token            string
-		channel          string
+		options          clientOptions
 		isoFileName      string
 		checksumFileName string
-		verbose          bool
 	)
 
 	var cmd = &cobra.Command{
 		Use:   "client",
 		Short: "Upload images and to the repository",
 		Run: func(cmd *cobra.Command, args []string) {
-			// Toggle debug output
-			logger.SetVerbose(verbose)
+			// Toggle debug output and check the token
+			options.validate()
 
-			// Check the token
-			if token == "" {
-				token = os.Getenv("IMAGE_MANAGER_TOKEN")
-			}
-			if token == "" {
-				logger.Fatal("Token is mandatory")
-				return
-			}
-
-			if channel == "" {
+			if options.channel == "" {
 				logger.Fatal("Channel is mandatory")
 				return
 			}
@@ -180,19 +410,28 @@ func clientCmd() *cobra.Command {
 
 			paths := []string{isoFileName, checksumFileName}
 
-			if err := client.StartClient(url, token, channel, paths); err != nil {
+			if err := client.StartClient(options.url, options.token, &options.tls, options.channel, paths); err != nil {
 				logger.Fatal(err)
 				return
 			}
 		},
 	}
 
-	cmd.Flags().StringVarP(&url, "address", "a", "http://localhost:8080", "host name and port of the server")
-	cmd.Flags().StringVarP(&token, "token", "t", "", "token to authenticate with the server")
-	cmd.Flags().StringVarP(&channel, "channel", "c", "", "image channel name")
+	cmd.PersistentFlags().StringVarP(&options.url, "address", "a", "http://localhost:8080", "host name and port of the server")
+	cmd.PersistentFlags().StringVarP(&options.token, "token", "t", "", "token to authenticate with the server")
+	cmd.PersistentFlags().StringVarP(&options.channel, "channel", "c", "", "image channel name")
+	cmd.PersistentFlags().StringVar(&options.tls.CAFile, "ca-cert", "", "CA bundle that verifies the server certificate")
+	cmd.PersistentFlags().StringVar(&options.tls.CertFile, "client-cert", "", "client certificate to authenticate with the server")
+	cmd.PersistentFlags().StringVar(&options.tls.KeyFile, "client-key", "", "private key of the client certificate")
 	cmd.Flags().StringVarP(&isoFileName, "iso", "", "", "ISO file to upload")
 	cmd.Flags().StringVarP(&checksumFileName, "checksum", "", "", "Checksum file to upload")
-	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "more messages during the build")
+	cmd.PersistentFlags().BoolVarP(&options.verbose, "verbose", "v", false, "more messages during the build")
+
+	cmd.AddCommand(
+		clientDeleteCmd(&options),
+		clientPromoteCmd(&options),
+		clientChannelCmd(&options),
+	)
 
 	return cmd
 }
@@ -211,6 +450,9 @@ func main() {
 
 	rootCmd.AddCommand(
 		genTokenCmd(),
+		tokenCmd(),
+		configCmd(),
+		cleanupCmd(),
 		serverCmd(),
 		clientCmd(),
 	)
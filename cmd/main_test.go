@@ -0,0 +1,173 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/liri-infra/image-manager/internal/server"
+)
+
+// writeTestConfig writes a configuration file with the nightly and
+// stable channels into a new directory, the caller removes it
+func writeTestConfig(t *testing.T, text string) (string, string) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "image-manager-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "image-manager.yaml")
+	text = "storage: " + dir + "\nchannels:\n  - name: nightly\n  - name: stable\n" + text
+	if err := ioutil.WriteFile(path, []byte(text), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return dir, path
+}
+
+// runCommand runs cmd with args
+func runCommand(t *testing.T, cmd *cobra.Command, args ...string) {
+	t.Helper()
+
+	cmd.SetArgs(args)
+	if err := cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGenToken(t *testing.T) {
+	dir, path := writeTestConfig(t, "tokens:\n  - token: legacy\n")
+	defer os.RemoveAll(dir)
+
+	runCommand(t, genTokenCmd(), "--config", path, "--name", "ci",
+		"--channel", "nightly", "--permission", "upload,delete", "--expires", "30d")
+
+	config, err := server.OpenConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Tokens) != 2 {
+		t.Fatalf("%d tokens, want 2", len(config.Tokens))
+	}
+
+	// The secret of the older token is hashed too
+	legacy, token := config.Tokens[0], config.Tokens[1]
+	if legacy.Token != "" || !legacy.Matches("legacy") {
+		t.Fatalf("legacy token %+v", legacy)
+	}
+
+	if token.Name != "ci" || token.Token != "" || token.Hash == "" || token.Expires == "" {
+		t.Fatalf("token %+v", token)
+	}
+	if !reflect.DeepEqual(token.Channels, []string{"nightly"}) {
+		t.Fatalf("channels %v", token.Channels)
+	}
+	expected := []server.Permission{server.PermissionUpload, server.PermissionDelete}
+	if !reflect.DeepEqual(token.Permissions, expected) {
+		t.Fatalf("permissions %v, want %v", token.Permissions, expected)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir, path := writeTestConfig(t, "")
+	defer os.RemoveAll(dir)
+
+	config, err := server.OpenConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := &server.AppState{Config: config, Storage: server.NewLocalStorage(dir)}
+	state := server.NewSharedState(appState)
+	load := func() (*server.Config, error) {
+		return server.OpenConfig(path)
+	}
+
+	// A new channel is available right away
+	text := "storage: " + dir + "\nchannels:\n  - name: nightly\n  - name: testing\n"
+	if err := ioutil.WriteFile(path, []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+	reloadConfig(state, load)
+	current := state.Load()
+	if current.Config.FindChannel("testing") == nil || current.Config.FindChannel("stable") != nil {
+		t.Fatalf("channels %+v", current.Config.Channels)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "testing")); err != nil {
+		t.Fatalf("directory of the new channel: %v", err)
+	}
+
+	// An invalid file is ignored
+	text = "storage: " + dir + "\nchannels:\n  - name: nightly\n  - name: nightly\n"
+	if err := ioutil.WriteFile(path, []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+	reloadConfig(state, load)
+	if state.Load() != current {
+		t.Fatal("invalid configuration was applied")
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	dir, path := writeTestConfig(t, "")
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	hangups := make(chan os.Signal, 1)
+	reloads := make(chan struct{}, 10)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		watchConfig(ctx, path, 10*time.Millisecond, hangups, func() {
+			reloads <- struct{}{}
+		})
+	}()
+	waitReload := func(expected bool) {
+		t.Helper()
+
+		select {
+		case <-reloads:
+			if !expected {
+				t.Fatal("configuration was reloaded")
+			}
+		case <-time.After(200 * time.Millisecond):
+			if expected {
+				t.Fatal("configuration was not reloaded")
+			}
+		}
+	}
+
+	// Nothing changed
+	waitReload(false)
+
+	// SIGHUP reloads even if the file did not change
+	hangups <- syscall.SIGHUP
+	waitReload(true)
+
+	// The file was modified, it's reloaded only once
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	waitReload(true)
+	waitReload(false)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("watchConfig() did not return")
+	}
+}
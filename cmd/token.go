@@ -0,0 +1,243 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/liri-infra/image-manager/internal/common"
+	"github.com/liri-infra/image-manager/internal/logger"
+	"github.com/liri-infra/image-manager/internal/server"
+)
+
+// formatAge returns a human readable representation of d
+func formatAge(d time.Duration) string {
+	days := int(d.Hours()) / 24
+	hours := int(d.Hours()) % 24
+	if days > 0 {
+		return fmt.Sprintf("%dd%dh", days, hours)
+	}
+	return d.Truncate(time.Minute).String()
+}
+
+// openTokenConfig opens the configuration file or exits.  Tokens
+// created by older versions are given an identifier, so that they
+// can be managed like the others, and their secret is hashed; the
+// file is only changed by the commands that save it.
+func openTokenConfig(configPath string) *server.Config {
+	config, err := server.OpenConfig(configPath)
+	if err != nil {
+		logger.Fatalf("Cannot open configuration file: %v", err)
+	}
+
+	if _, err := config.HashPlaintextTokens(); err != nil {
+		logger.Fatalf("Failed to hash tokens: %v", err)
+	}
+	config.AssignTokenIDs()
+
+	return config
+}
+
+// findToken returns the token with the specified identifier or exits
+func findToken(config *server.Config, id string) *server.Token {
+	token := config.FindToken(id)
+	if token == nil {
+		logger.Fatalf("Token \"%s\" not found", id)
+	}
+	return token
+}
+
+// saveTokenConfig saves the configuration file or exits
+func saveTokenConfig(config *server.Config) {
+	if err := config.Save(); err != nil {
+		logger.Fatalf("Cannot save configuration file: %v", err)
+	}
+}
+
+func tokenListCmd(configPath *string) *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List the API tokens",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			config := openTokenConfig(*configPath)
+			now := time.Now()
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tNAME\tCREATED\tAGE\tEXPIRES\tCHANNELS\tPERMISSIONS")
+			for _, token := range config.Tokens {
+				age := "-"
+				if d, err := token.Age(now); err == nil {
+					age = formatAge(d)
+				}
+
+				expires := "never"
+				if token.Expired(now) {
+					expires = "expired"
+				} else if token.Expires != "" {
+					expires = token.Expires
+				}
+
+				identity := token.Identity()
+				channels := "all"
+				if len(identity.Channels) > 0 {
+					channels = strings.Join(identity.Channels, ",")
+				}
+				var permissions []string
+				for _, permission := range identity.Permissions {
+					permissions = append(permissions, string(permission))
+				}
+
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", token.ID, token.Name, token.Created,
+					age, expires, channels, strings.Join(permissions, ","))
+			}
+			w.Flush()
+		},
+	}
+}
+
+func tokenDescribeCmd(configPath *string) *cobra.Command {
+	return &cobra.Command{
+		Use:   "describe <id>",
+		Short: "Show the details of an API token",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			config := openTokenConfig(*configPath)
+			token := findToken(config, args[0])
+			now := time.Now()
+
+			fmt.Printf("ID:          %s\n", token.ID)
+			fmt.Printf("Name:        %s\n", token.Name)
+			fmt.Printf("Description: %s\n", token.Description)
+			fmt.Printf("Created:     %s\n", token.Created)
+			if d, err := token.Age(now); err == nil {
+				fmt.Printf("Age:         %s\n", formatAge(d))
+			}
+			switch {
+			case token.Expired(now):
+				fmt.Printf("Expires:     %s (expired)\n", token.Expires)
+			case token.Expires != "":
+				fmt.Printf("Expires:     %s\n", token.Expires)
+			default:
+				fmt.Printf("Expires:     never\n")
+			}
+
+			identity := token.Identity()
+			if len(identity.Channels) == 0 {
+				fmt.Printf("Channels:    all\n")
+			} else {
+				fmt.Printf("Channels:    %s\n", strings.Join(identity.Channels, ", "))
+			}
+			var permissions []string
+			for _, permission := range identity.Permissions {
+				permissions = append(permissions, string(permission))
+			}
+			fmt.Printf("Permissions: %s\n", strings.Join(permissions, ", "))
+		},
+	}
+}
+
+func tokenRevokeCmd(configPath *string) *cobra.Command {
+	return &cobra.Command{
+		Use:   "revoke <id>",
+		Short: "Revoke an API token",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			config := openTokenConfig(*configPath)
+			if !config.RemoveToken(args[0]) {
+				logger.Fatalf("Token \"%s\" not found", args[0])
+			}
+			saveTokenConfig(config)
+			logger.Infof("Token \"%s\" revoked", args[0])
+		},
+	}
+}
+
+func tokenRenameCmd(configPath *string) *cobra.Command {
+	var description string
+
+	cmd := &cobra.Command{
+		Use:   "rename <id> <name>",
+		Short: "Change name and description of an API token",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			config := openTokenConfig(*configPath)
+			token := findToken(config, args[0])
+			token.Name = args[1]
+			if cmd.Flags().Changed("description") {
+				token.Description = description
+			}
+			saveTokenConfig(config)
+		},
+	}
+
+	cmd.Flags().StringVarP(&description, "description", "d", "", "what the token is used for")
+
+	return cmd
+}
+
+func tokenExpireCmd(configPath *string) *cobra.Command {
+	return &cobra.Command{
+		Use:   "expire <id> <duration>",
+		Short: "Set the lifetime of an API token from now",
+		Long:  "Makes the token expire after duration (for example 720h or 90d), 0 expires it immediately and \"never\" removes the expiration.",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			config := openTokenConfig(*configPath)
+			token := findToken(config, args[0])
+
+			switch args[1] {
+			case "never":
+				token.SetExpiration(0)
+			case "0":
+				token.Expires = time.Now().UTC().Format(time.RFC3339)
+			default:
+				lifetime, err := common.ParseDuration(args[1])
+				if err != nil || lifetime <= 0 {
+					logger.Fatalf("Invalid expiration \"%s\"", args[1])
+					return
+				}
+				token.SetExpiration(lifetime)
+			}
+
+			saveTokenConfig(config)
+		},
+	}
+}
+
+func tokenCmd() *cobra.Command {
+	var (
+		configPath string
+		verbose    bool
+	)
+
+	var cmd = &cobra.Command{
+		Use:   "token",
+		Short: "Manage API tokens",
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			// Toggle debug output
+			logger.SetVerbose(verbose)
+		},
+	}
+
+	cmd.PersistentFlags().StringVarP(&configPath, "config", "c", "image-manager.yaml", "path to configuration file")
+	cmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "more messages during the build")
+
+	cmd.AddCommand(
+		tokenListCmd(&configPath),
+		tokenDescribeCmd(&configPath),
+		tokenRevokeCmd(&configPath),
+		tokenRenameCmd(&configPath),
+		tokenExpireCmd(&configPath),
+	)
+
+	return cmd
+}
@@ -0,0 +1,151 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liri-infra/image-manager/internal/server"
+)
+
+// Tokens created by older versions, without identifier
+const legacyTokens = `tokens:
+  - token: plaintext
+    created: "2020-01-01T00:00:00Z"
+  - name: ci
+    hash: sha256:00:0000
+    created: "2020-01-01T00:00:00Z"
+    channels: [nightly]
+    permissions: [upload]
+`
+
+// captureOutput returns what f writes to the standard output
+func captureOutput(t *testing.T, f func()) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		io.Copy(&buf, r)
+		output <- buf.String()
+	}()
+
+	f()
+	w.Close()
+	return <-output
+}
+
+// readTestFile returns the content of path
+func readTestFile(t *testing.T, path string) string {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestTokenListDescribe(t *testing.T) {
+	dir, path := writeTestConfig(t, legacyTokens)
+	defer os.RemoveAll(dir)
+	before := readTestFile(t, path)
+
+	list := captureOutput(t, func() {
+		runCommand(t, tokenCmd(), "list", "--config", path)
+	})
+	lines := strings.Split(strings.TrimSpace(list), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "ID") {
+		t.Fatalf("unexpected list:\n%s", list)
+	}
+	fields := strings.Fields(lines[2])
+	id := fields[0]
+	if fields[1] != "ci" || !strings.Contains(lines[2], "nightly") || !strings.HasSuffix(lines[2], "upload") {
+		t.Fatalf("unexpected token: %s", lines[2])
+	}
+
+	describe := captureOutput(t, func() {
+		runCommand(t, tokenCmd(), "describe", "--config", path, id)
+	})
+	if !strings.Contains(describe, "ID:          "+id+"\n") || !strings.Contains(describe, "Name:        ci\n") ||
+		!strings.Contains(describe, "Expires:     never\n") {
+		t.Fatalf("unexpected description:\n%s", describe)
+	}
+
+	// Reading tokens does not change the file
+	if after := readTestFile(t, path); after != before {
+		t.Fatalf("configuration file was changed:\n%s", after)
+	}
+
+	// The identifiers that were listed can be used
+	again := captureOutput(t, func() {
+		runCommand(t, tokenCmd(), "list", "--config", path)
+	})
+	if again != list {
+		t.Fatalf("identifiers changed:\n%s\n%s", list, again)
+	}
+	runCommand(t, tokenCmd(), "revoke", "--config", path, id)
+
+	config, err := server.OpenConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Tokens) != 1 || config.FindToken(id) != nil {
+		t.Fatalf("token %s was not revoked", id)
+	}
+	if legacy := config.Tokens[0]; legacy.ID == "" || legacy.Token != "" || !legacy.Matches("plaintext") {
+		t.Fatalf("legacy token was not converted: %+v", legacy)
+	}
+}
+
+func TestTokenRenameExpire(t *testing.T) {
+	dir, path := writeTestConfig(t, legacyTokens)
+	defer os.RemoveAll(dir)
+
+	config, err := server.OpenConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.AssignTokenIDs()
+	id := config.Tokens[1].ID
+
+	runCommand(t, tokenCmd(), "rename", "--config", path, "--description", "builds", id, "builder")
+	runCommand(t, tokenCmd(), "expire", "--config", path, id, "0")
+
+	config, err = server.OpenConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := config.FindToken(id)
+	if token == nil || token.Name != "builder" || token.Description != "builds" {
+		t.Fatalf("token %+v", token)
+	}
+	if !token.Expired(time.Now()) {
+		t.Fatalf("token expires %q", token.Expires)
+	}
+
+	runCommand(t, tokenCmd(), "expire", "--config", path, id, "never")
+	config, err = server.OpenConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token := config.FindToken(id); token.Expires != "" {
+		t.Fatalf("token expires %q", token.Expires)
+	}
+}
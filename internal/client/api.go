@@ -6,6 +6,8 @@ package client
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -16,6 +18,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -31,8 +34,46 @@ type Client struct {
 	token      string
 }
 
-// NewClient creates a new client connecting to the specified endpoint.
-func NewClient(endpoint, token string) (*Client, error) {
+// TLSOptions tells how to connect to a server over HTTPS.
+type TLSOptions struct {
+	// CA bundle that verifies the server certificate, defaults
+	// to the system ones
+	CAFile string
+	// Client certificate and key, to authenticate without a token
+	CertFile string
+	KeyFile  string
+}
+
+// config returns the TLS configuration for the options
+func (o *TLSOptions) config() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if o.CAFile != "" {
+		buf, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("no certificates found in \"%s\"", o.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if o.CertFile != "" || o.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+// NewClient creates a new client connecting to the specified endpoint,
+// tlsOptions can be nil.
+func NewClient(endpoint, token string, tlsOptions *TLSOptions) (*Client, error) {
 	_, err := url.Parse(endpoint)
 	if err != nil {
 		return nil, err
@@ -41,11 +82,26 @@ func NewClient(endpoint, token string) (*Client, error) {
 	transport := &http.Transport{
 		DisableCompression: false,
 	}
+	if tlsOptions != nil {
+		if transport.TLSClientConfig, err = tlsOptions.config(); err != nil {
+			return nil, err
+		}
+	}
 	httpClient := &http.Client{Transport: transport, Timeout: 60 * time.Minute}
 
 	return &Client{endpoint, "image-manager", httpClient, token}, nil
 }
 
+// HTTPError is returned when the server replies with an error.
+type HTTPError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *HTTPError) Error() string {
+	return e.Message
+}
+
 func (c *Client) newRequest(method, path string, body interface{}) (*http.Request, error) {
 	u, err := url.Parse(fmt.Sprintf("%s%s", c.endpoint, path))
 	if err != nil {
@@ -70,10 +126,18 @@ func (c *Client) newRequest(method, path string, body interface{}) (*http.Reques
 	}
 	request.Header.Set("Accept", "application/json")
 	request.Header.Set("User-Agent", c.userAgent)
-	request.Header.Set("Authorization", fmt.Sprintf("BEARER %s", c.token))
+	c.authorize(request)
 	return request, nil
 }
 
+// authorize adds the token to request, clients authenticated
+// with a certificate do not have one
+func (c *Client) authorize(request *http.Request) {
+	if c.token != "" {
+		request.Header.Set("Authorization", fmt.Sprintf("BEARER %s", c.token))
+	}
+}
+
 func (c *Client) do(request *http.Request, v interface{}) (*http.Response, error) {
 	response, err := c.httpClient.Do(request)
 	if err != nil {
@@ -90,7 +154,7 @@ func (c *Client) do(request *http.Request, v interface{}) (*http.Response, error
 	bodyString := strings.TrimSuffix(string(body), "\n")
 
 	if response.StatusCode != http.StatusOK {
-		return response, errors.New(bodyString)
+		return response, &HTTPError{StatusCode: response.StatusCode, Message: bodyString}
 	}
 
 	if v != nil {
@@ -151,7 +215,7 @@ func (c *Client) UploadSingle(channel, path string) error {
 	request.Header.Set("Content-Type", writer.FormDataContentType())
 	request.Header.Set("Accept", "application/json")
 	request.Header.Set("User-Agent", c.userAgent)
-	request.Header.Set("Authorization", fmt.Sprintf("BEARER %s", c.token))
+	c.authorize(request)
 
 	response, err := c.httpClient.Do(request)
 	if err != nil {
@@ -165,84 +229,439 @@ func (c *Client) UploadSingle(channel, path string) error {
 	return nil
 }
 
-// Upload uploads multiple files listed in paths at once to channel.
-func (c *Client) Upload(channel string, paths []string) error {
-	r, w := io.Pipe()
-	writer := multipart.NewWriter(w)
-
-	errChan := make(chan error)
-
-	f := func() {
-		defer func() {
-			writer.Close()
-			w.Close()
-			errChan <- nil
-		}()
-
-		for _, path := range paths {
-			// File entry
-			part, err := writer.CreateFormFile("file", filepath.Base(path))
-			if err != nil {
-				errChan <- err
-				return
-			}
+// UploadSession represents a resumable upload on the server.
+type UploadSession struct {
+	ID       string `json:"id"`
+	Channel  string `json:"channel"`
+	Build    string `json:"build"`
+	FileName string `json:"file_name"`
+	Size     int64  `json:"size"`
+	Offset   int64  `json:"offset"`
+	Created  string `json:"created"`
+}
 
-			// Calculate checksum
-			checksum, err := common.CalculateChecksum(path)
-			if err != nil {
-				errChan <- err
-				return
-			}
+// Size of each chunk sent to the server
+const chunkSize = 64 * 1024 * 1024
+
+// Maximum number of consecutive failures before giving up
+const maxRetries = 10
+
+// isPermanent returns whether the request failed in a way that
+// cannot be fixed by trying again.  A conflict is not permanent when
+// it's about the offset of a chunk, in which case we resynchronize.
+func isPermanent(err error, conflictIsPermanent bool) bool {
+	// The server certificate won't become valid by trying again
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	if errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalid) {
+		return true
+	}
 
-			// Open source file
-			file, err := os.Open(path)
-			if err != nil {
-				errChan <- err
-				return
-			}
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) {
+		return false
+	}
+	if httpErr.StatusCode == http.StatusConflict {
+		return conflictIsPermanent
+	}
+	return httpErr.StatusCode < 500
+}
+
+// backoff returns how long to wait after a number of consecutive failures
+func backoff(failures int) time.Duration {
+	delay := time.Duration(1<<uint(failures)) * time.Second
+	if delay > time.Minute {
+		delay = time.Minute
+	}
+	return delay
+}
+
+// CreateSession creates an upload session for path on channel, or
+// returns the pending one if a previous upload was interrupted or
+// finalized with the same checksum.
+// The file is added to build, or to a new build if empty.
+func (c *Client) CreateSession(channel, build, path, checksum string) (*UploadSession, error) {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	body := map[string]interface{}{
+		"file_name": filepath.Base(path),
+		"size":      fileInfo.Size(),
+		"build":     build,
+		"checksum":  checksum,
+	}
+	request, err := c.newRequest("POST", fmt.Sprintf("/api/v1/upload/%s/sessions", channel), body)
+	if err != nil {
+		return nil, err
+	}
 
-			// Upload
-			if _, err = io.Copy(part, file); err != nil {
-				file.Close()
-				errChan <- err
-				return
+	var session UploadSession
+	if _, err := c.do(request, &session); err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// GetSession returns the upload session with the committed offset.
+func (c *Client) GetSession(id string) (*UploadSession, error) {
+	request, err := c.newRequest("GET", fmt.Sprintf("/api/v1/sessions/%s", id), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var session UploadSession
+	if _, err := c.do(request, &session); err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// writeChunk sends up to chunkSize bytes of file, starting at the
+// committed offset of session.
+func (c *Client) writeChunk(session *UploadSession, file *os.File) (*http.Response, error) {
+	length := session.Size - session.Offset
+	if length > chunkSize {
+		length = chunkSize
+	}
+
+	u, err := url.Parse(fmt.Sprintf("%s/api/v1/sessions/%s", c.endpoint, session.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequest("PUT", u.String(), io.NewSectionReader(file, session.Offset, length))
+	if err != nil {
+		return nil, err
+	}
+	request.ContentLength = length
+
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set("User-Agent", c.userAgent)
+	c.authorize(request)
+	request.Header.Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+
+	return c.do(request, session)
+}
+
+// FinalizeSession asks the server to verify the checksum and
+// publish the file.
+func (c *Client) FinalizeSession(id, checksum string) error {
+	body := map[string]string{"checksum": checksum}
+	request, err := c.newRequest("POST", fmt.Sprintf("/api/v1/sessions/%s/finalize", id), body)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.do(request, nil)
+	return err
+}
+
+// uploadFile uploads path to channel in chunks, resuming from the
+// committed offset after a failure, and returns the build it was
+// added to.
+func (c *Client) uploadFile(channel, build, path string) (string, error) {
+	// Calculate checksum
+	checksum, err := common.CalculateChecksum(path)
+	if err != nil {
+		return "", err
+	}
+
+	// Open source file
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var session *UploadSession
+	failures := 0
+
+	for {
+		writing := false
+
+		if session == nil {
+			session, err = c.CreateSession(channel, build, path, checksum)
+		} else if session.Offset < session.Size {
+			logger.Debugf("Uploading \"%s\" from offset %d of %d", session.FileName, session.Offset, session.Size)
+			writing = true
+			_, err = c.writeChunk(session, file)
+		} else {
+			logger.Debugf("Finalizing \"%s\"", session.FileName)
+			if err = c.FinalizeSession(session.ID, checksum); err == nil {
+				return session.Build, nil
 			}
+		}
 
-			file.Close()
+		if err == nil {
+			failures = 0
+			continue
+		}
 
-			// Let the server verify the checksum
-			if err := writer.WriteField("checksum", fmt.Sprintf("%s:%s", filepath.Base(path), checksum)); err != nil {
-				errChan <- err
-				return
+		if isPermanent(err, !writing) {
+			return "", err
+		}
+
+		failures++
+		if failures > maxRetries {
+			return "", fmt.Errorf("giving up on \"%s\": %v", path, err)
+		}
+
+		delay := backoff(failures)
+		logger.Warnf("Upload of \"%s\" failed (%v), retrying in %s", path, err, delay)
+		time.Sleep(delay)
+
+		// Ask the server where to resume from
+		if session != nil {
+			if s, err := c.GetSession(session.ID); err == nil {
+				session = s
+			} else {
+				session = nil
 			}
 		}
 	}
+}
 
-	u, err := url.Parse(fmt.Sprintf("%s/api/v1/upload/%s", c.endpoint, channel))
+// Image is a file stored on the server.
+type Image struct {
+	Name     string `json:"name"`
+	Build    string `json:"build"`
+	Size     int64  `json:"size"`
+	Modified string `json:"mtime"`
+	SHA256   string `json:"sha256"`
+}
+
+// Provenance tells where a promoted build comes from.
+type Provenance struct {
+	Channel  string `json:"channel"`
+	Build    string `json:"build"`
+	Created  string `json:"created"`
+	Uploader string `json:"uploader"`
+}
+
+// Build groups the files uploaded together.
+type Build struct {
+	ID           string      `json:"id"`
+	Created      string      `json:"created"`
+	Uploader     string      `json:"uploader"`
+	Size         int64       `json:"size"`
+	Files        []*Image    `json:"files"`
+	PromotedFrom *Provenance `json:"promoted_from"`
+}
+
+// ListBuilds returns the builds stored in channel, from the newest.
+func (c *Client) ListBuilds(channel string) ([]*Build, error) {
+	request, err := c.newRequest("GET", fmt.Sprintf("/api/v1/channels/%s/builds", url.PathEscape(channel)), nil)
 	if err != nil {
+		return nil, err
+	}
+
+	var builds []*Build
+	if _, err := c.do(request, &builds); err != nil {
+		return nil, err
+	}
+
+	return builds, nil
+}
+
+// PublishBuild publishes all the files uploaded for build on channel.
+func (c *Client) PublishBuild(channel, build string) error {
+	path := fmt.Sprintf("/api/v1/upload/%s/builds/%s/publish", url.PathEscape(channel), url.PathEscape(build))
+	request, err := c.newRequest("POST", path, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.do(request, nil)
+	return err
+}
+
+// publishBuild publishes build, retrying after a failure.
+func (c *Client) publishBuild(channel, build string) error {
+	failures := 0
+
+	for {
+		err := c.PublishBuild(channel, build)
+		if err == nil {
+			return nil
+		}
+
+		// A previous attempt might have succeeded without us knowing
+		var httpErr *HTTPError
+		if failures > 0 && errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusNotFound {
+			if builds, err := c.ListBuilds(channel); err == nil {
+				for _, b := range builds {
+					if b.ID == build {
+						return nil
+					}
+				}
+			}
+		}
+
+		if isPermanent(err, true) {
+			return err
+		}
+
+		failures++
+		if failures > maxRetries {
+			return fmt.Errorf("giving up on build %s: %v", build, err)
+		}
+
+		delay := backoff(failures)
+		logger.Warnf("Publishing build %s failed (%v), retrying in %s", build, err, delay)
+		time.Sleep(delay)
+	}
+}
+
+// Upload uploads multiple files listed in paths to channel, as
+// a single build, resuming interrupted transfers.  The files are
+// published only when all of them are uploaded and verified.
+func (c *Client) Upload(channel string, paths []string) error {
+	build := ""
+	for _, path := range paths {
+		logger.Actionf("Uploading %s", path)
+		var err error
+		if build, err = c.uploadFile(channel, build, path); err != nil {
+			return err
+		}
+	}
+
+	logger.Actionf("Publishing build %s", build)
+	if err := c.publishBuild(channel, build); err != nil {
 		return err
 	}
 
-	request, err := http.NewRequest("PUT", u.String(), r)
+	logger.Infof("Published build %s", build)
+	return nil
+}
+
+// DeleteBuild removes the build id from channel.
+func (c *Client) DeleteBuild(channel, id string) error {
+	path := fmt.Sprintf("/api/v1/channels/%s/builds/%s", url.PathEscape(channel), url.PathEscape(id))
+	request, err := c.newRequest("DELETE", path, nil)
 	if err != nil {
 		return err
 	}
 
-	request.Header.Set("Content-Type", writer.FormDataContentType())
-	request.Header.Set("Accept", "application/json")
-	request.Header.Set("User-Agent", c.userAgent)
-	request.Header.Set("Authorization", fmt.Sprintf("BEARER %s", c.token))
+	_, err = c.do(request, nil)
+	return err
+}
+
+// Delete removes the file called name from channel, along with
+// the other files of its build.
+func (c *Client) Delete(channel, name string) error {
+	path := fmt.Sprintf("/api/v1/channels/%s/images/%s", url.PathEscape(channel), url.PathEscape(name))
+	request, err := c.newRequest("DELETE", path, nil)
+	if err != nil {
+		return err
+	}
 
-	go f()
+	_, err = c.do(request, nil)
+	return err
+}
 
-	if _, err := c.httpClient.Do(request); err != nil {
+// PromoteBuild copies the build id from channel to the target channel.
+func (c *Client) PromoteBuild(channel, id, target string) error {
+	path := fmt.Sprintf("/api/v1/channels/%s/builds/%s/promote?to=%s",
+		url.PathEscape(channel), url.PathEscape(id), url.QueryEscape(target))
+	request, err := c.newRequest("POST", path, nil)
+	if err != nil {
 		return err
 	}
 
-	err = <-errChan
+	_, err = c.do(request, nil)
+	return err
+}
+
+// Retention tells which images of a channel are removed.
+type Retention struct {
+	MaxAge     string `json:"max_age,omitempty"`
+	KeepLast   int    `json:"keep_last,omitempty"`
+	MaxBytes   string `json:"max_bytes,omitempty"`
+	KeepNewest bool   `json:"keep_newest,omitempty"`
+}
+
+// Channel is a channel configured on the server.
+type Channel struct {
+	Name      string     `json:"name"`
+	Cleanup   bool       `json:"cleanup"`
+	Retention *Retention `json:"retention,omitempty"`
+	Public    bool       `json:"public"`
+	// Only set for administrators
+	Path string `json:"path,omitempty"`
+}
+
+// ChannelUpdate lists the settings of a channel to change, those
+// left nil are not changed.  An empty retention policy removes it.
+type ChannelUpdate struct {
+	Public    *bool      `json:"public,omitempty"`
+	Retention *Retention `json:"retention,omitempty"`
+}
+
+// ListChannels returns the channels the client can read.
+func (c *Client) ListChannels() ([]*Channel, error) {
+	request, err := c.newRequest("GET", "/api/v1/channels", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var channels []*Channel
+	if _, err := c.do(request, &channels); err != nil {
+		return nil, err
+	}
+
+	return channels, nil
+}
+
+// AddChannel adds channel to the server, its path defaults to the name.
+func (c *Client) AddChannel(channel *Channel) (*Channel, error) {
+	body := struct {
+		Name      string     `json:"name"`
+		Path      string     `json:"path,omitempty"`
+		Public    bool       `json:"public"`
+		Retention *Retention `json:"retention,omitempty"`
+	}{channel.Name, channel.Path, channel.Public, channel.Retention}
+	request, err := c.newRequest("POST", "/api/v1/channels", body)
+	if err != nil {
+		return nil, err
+	}
+
+	var added Channel
+	if _, err := c.do(request, &added); err != nil {
+		return nil, err
+	}
+
+	return &added, nil
+}
+
+// EditChannel changes the settings of the channel called name.
+func (c *Client) EditChannel(name string, update *ChannelUpdate) (*Channel, error) {
+	request, err := c.newRequest("PATCH", fmt.Sprintf("/api/v1/channels/%s", url.PathEscape(name)), update)
+	if err != nil {
+		return nil, err
+	}
+
+	var edited Channel
+	if _, err := c.do(request, &edited); err != nil {
+		return nil, err
+	}
+
+	return &edited, nil
+}
+
+// RemoveChannel removes the channel called name, the server archives
+// its files.
+func (c *Client) RemoveChannel(name string) error {
+	request, err := c.newRequest("DELETE", fmt.Sprintf("/api/v1/channels/%s", url.PathEscape(name)), nil)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	_, err = c.do(request, nil)
+	return err
 }
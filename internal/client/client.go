@@ -7,18 +7,16 @@ package client
 import "github.com/liri-infra/image-manager/internal/logger"
 
 // StartClient starts the client.
-func StartClient(url, token string, channel string, paths []string) error {
+func StartClient(url, token string, tlsOptions *TLSOptions, channel string, paths []string) error {
 	// Client
-	client, err := NewClient(url, token)
+	client, err := NewClient(url, token, tlsOptions)
 	if err != nil {
 		return err
 	}
 
 	// Upload
-	for _, path := range paths {
-		if err := client.UploadSingle(channel, path); err != nil {
-			return err
-		}
+	if err := client.Upload(channel, paths); err != nil {
+		return err
 	}
 
 	logger.Info("Done!")
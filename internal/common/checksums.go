@@ -0,0 +1,78 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package common
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// isSHA256 returns whether value is a hex encoded SHA-256 digest
+func isSHA256(value string) bool {
+	if len(value) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(value)
+	return err == nil
+}
+
+// ParseChecksumFile reads SHA-256 checksums in the GNU coreutils format
+// ("<CHECKSUM>  <FILE>", or with a '*' before binary files) or in the BSD
+// format ("SHA256 (<FILE>) = <CHECKSUM>"), and returns a map from the base
+// name of each file to its lower case checksum.  Comments, empty lines and
+// checksums of other algorithms are ignored.
+func ParseChecksumFile(r io.Reader) (map[string]string, error) {
+	checksums := map[string]string{}
+
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var name, checksum string
+		if strings.HasPrefix(line, "SHA256 (") {
+			// BSD format
+			i := strings.LastIndex(line, ") = ")
+			if i < 0 {
+				return nil, fmt.Errorf("line %d: bad BSD checksum format", lineNumber)
+			}
+			name = line[len("SHA256 ("):i]
+			checksum = line[i+len(") = "):]
+		} else if i := strings.Index(line, " "); i > 0 && !strings.Contains(line[:i], "(") {
+			// GNU format
+			checksum = line[:i]
+			name = strings.TrimPrefix(strings.TrimLeft(line[i:], " "), "*")
+		} else {
+			// Other algorithms or formats
+			continue
+		}
+
+		checksum = strings.ToLower(checksum)
+		if !isSHA256(checksum) || name == "" {
+			continue
+		}
+		checksums[path.Base(name)] = checksum
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return checksums, nil
+}
+
+// IsChecksumFile returns whether name looks like a file with SHA-256 checksums
+func IsChecksumFile(name string) bool {
+	base := path.Base(name)
+	return strings.HasSuffix(base, ".sha256sum") || strings.HasSuffix(base, ".sha256") ||
+		base == "SHA256SUMS" || base == "CHECKSUM" || strings.HasSuffix(base, "-CHECKSUM")
+}
@@ -0,0 +1,116 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package common
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	checksumA = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	checksumB = "486ea46224d1bb4fb680f34f7c9ad96a8f24ec88be73ea8e5a6c65260e9cb8a7"
+)
+
+func TestParseChecksumFile(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		checksums map[string]string
+	}{
+		{
+			"GNU format",
+			checksumA + "  image.iso\n" + checksumB + " *image.img\n",
+			map[string]string{"image.iso": checksumA, "image.img": checksumB},
+		},
+		{
+			"BSD format",
+			"SHA256 (image.iso) = " + checksumA + "\n",
+			map[string]string{"image.iso": checksumA},
+		},
+		{
+			"upper case checksum",
+			strings.ToUpper(checksumA) + "  image.iso\n",
+			map[string]string{"image.iso": checksumA},
+		},
+		{
+			"directories are stripped",
+			checksumA + "  out/image.iso\nSHA256 (out/image.img) = " + checksumB + "\n",
+			map[string]string{"image.iso": checksumA, "image.img": checksumB},
+		},
+		{
+			"name with spaces",
+			checksumA + "  my image.iso\n",
+			map[string]string{"my image.iso": checksumA},
+		},
+		{
+			"comments and empty lines",
+			"# checksums\n\n  \n" + checksumA + "  image.iso\n",
+			map[string]string{"image.iso": checksumA},
+		},
+		{
+			"other algorithms",
+			"MD5 (image.iso) = 5d41402abc4b2a76b9719d911017c592\n" +
+				"5d41402abc4b2a76b9719d911017c592  image.img\n" +
+				"SHA256 (image.iso) = " + checksumA + "\n",
+			map[string]string{"image.iso": checksumA},
+		},
+		{
+			"missing name",
+			checksumA + "\n" + checksumB + "  \n",
+			map[string]string{},
+		},
+		{
+			"empty file",
+			"",
+			map[string]string{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checksums, err := ParseChecksumFile(strings.NewReader(test.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(checksums, test.checksums) {
+				t.Fatalf("ParseChecksumFile() = %v, want %v", checksums, test.checksums)
+			}
+		})
+	}
+}
+
+func TestParseChecksumFileBadBSD(t *testing.T) {
+	content := checksumA + "  image.iso\nSHA256 (image.img) " + checksumB + "\n"
+	_, err := ParseChecksumFile(strings.NewReader(content))
+	if err == nil {
+		t.Fatal("bad BSD line was accepted")
+	}
+	if !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("error %q does not report the line", err)
+	}
+}
+
+func TestIsChecksumFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		checksum bool
+	}{
+		{"SHA256SUMS", true},
+		{"nightly/SHA256SUMS", true},
+		{"image.iso.sha256sum", true},
+		{"image.iso.sha256", true},
+		{"CHECKSUM", true},
+		{"Fedora-x86_64-CHECKSUM", true},
+		{"image.iso", false},
+		{"SHA256SUMS.asc", false},
+		{"sha256sums", false},
+	}
+	for _, test := range tests {
+		if checksum := IsChecksumFile(test.name); checksum != test.checksum {
+			t.Errorf("IsChecksumFile(%q) = %v, want %v", test.name, checksum, test.checksum)
+		}
+	}
+}
@@ -8,7 +8,11 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // CalculateChecksum calculates the SHA-256 checksum of the file and
@@ -20,10 +24,57 @@ func CalculateChecksum(path string) (string, error) {
 		return "", err
 	}
 
+	return CalculateReaderChecksum(f)
+}
+
+// CalculateReaderChecksum calculates the SHA-256 checksum of what
+// is read from r and returns the hex value
+func CalculateReaderChecksum(r io.Reader) (string, error) {
 	h := sha256.New()
-	if _, err := io.Copy(h, f); err != nil {
+	if _, err := io.Copy(h, r); err != nil {
 		return "", err
 	}
 
 	return fmt.Sprintf("%x", h.Sum(nil)), nil
 }
+
+// ParseDuration parses a duration like time.ParseDuration does, but
+// also accepts days ("d") and weeks ("w") as units, for example "90d"
+func ParseDuration(value string) (time.Duration, error) {
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+	for suffix, unit := range units {
+		if strings.HasSuffix(value, suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(value, suffix), 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration \"%s\"", value)
+			}
+			return time.Duration(n * float64(unit)), nil
+		}
+	}
+
+	return time.ParseDuration(value)
+}
+
+// ParseSize parses a size in bytes with an optional binary unit
+// suffix among K, M, G and T, for example "500G"
+func ParseSize(value string) (int64, error) {
+	units := map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+
+	multiplier := int64(1)
+	number := strings.TrimSuffix(strings.ToUpper(value), "B")
+	if len(number) > 0 {
+		if unit, ok := units[number[len(number)-1:]]; ok {
+			multiplier = unit
+			number = number[:len(number)-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size \"%s\"", value)
+	}
+	if n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("size \"%s\" is too large", value)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,49 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package common
+
+import (
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value string
+		size  int64
+		err   string
+	}{
+		{"0", 0, ""},
+		{"1024", 1024, ""},
+		{"512B", 512, ""},
+		{"2K", 2 << 10, ""},
+		{"10mb", 10 << 20, ""},
+		{"500G", 500 << 30, ""},
+		{"3T", 3 << 40, ""},
+		{"8388607T", 8388607 << 40, ""},
+		{"9223372036854775807", 9223372036854775807, ""},
+		{"", 0, `invalid size ""`},
+		{"G", 0, `invalid size "G"`},
+		{"-1K", 0, `invalid size "-1K"`},
+		{"1.5G", 0, `invalid size "1.5G"`},
+		{"10P", 0, `invalid size "10P"`},
+		{"9223372036854775808", 0, `invalid size "9223372036854775808"`},
+		{"8388608T", 0, `size "8388608T" is too large`},
+		{"9223372036854775807K", 0, `size "9223372036854775807K" is too large`},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			size, err := ParseSize(test.value)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("ParseSize() = %d, %v, want %q", size, err, test.err)
+				}
+				return
+			}
+			if err != nil || size != test.size {
+				t.Fatalf("ParseSize() = %d, %v, want %d", size, err, test.size)
+			}
+		})
+	}
+}
@@ -33,16 +33,23 @@ func SetVerbose(value bool) {
 	verbose = value
 }
 
+// isVerbose returns whether debug messages are enabled
+func isVerbose() bool {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return verbose
+}
+
 // Debug print an information message
 func Debug(v ...interface{}) {
-	if verbose {
+	if isVerbose() {
 		log.Printf("%s%s%s", colorGray, fmt.Sprint(v...), colorOff)
 	}
 }
 
 // Debugf print a formatted information message
 func Debugf(format string, v ...interface{}) {
-	if verbose {
+	if isVerbose() {
 		log.Printf("%s%s%s", colorGray, fmt.Sprintf(format, v...), colorOff)
 	}
 }
@@ -0,0 +1,156 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/liri-infra/image-manager/internal/common"
+)
+
+// Aliases are stored in this file, inside the channel directory
+const aliasesFile = ".latest.json"
+
+// Alias points to the newest file of a type, such as "iso" or "checksum".
+type Alias struct {
+	Build string `json:"build"`
+	File  string `json:"file"`
+}
+
+// fileType returns the type of the file name, used to look up aliases
+func fileType(name string) string {
+	if common.IsChecksumFile(name) {
+		return "checksum"
+	}
+
+	ext := strings.ToLower(path.Ext(name))
+	if ext == ".asc" || ext == ".sig" {
+		return "signature"
+	}
+	return strings.TrimPrefix(ext, ".")
+}
+
+func aliasesKey(prefix string) string {
+	return path.Join(prefix, aliasesFile)
+}
+
+// newestAliases returns the aliases to the newest file of each type,
+// builds must be sorted from the newest to the oldest.
+func newestAliases(builds []*storedBuild) map[string]*Alias {
+	aliases := map[string]*Alias{}
+	for _, stored := range builds {
+		for _, image := range stored.files {
+			fileType := fileType(image.name)
+			if _, ok := aliases[fileType]; !ok && fileType != "" {
+				aliases[fileType] = &Alias{Build: stored.build.ID, File: image.name}
+			}
+		}
+	}
+	return aliases
+}
+
+// readAliases returns the aliases of the channel with the specified key
+// prefix.  Channels populated before aliases were introduced get aliases
+// to the newest files.
+func readAliases(storage Storage, prefix string) (map[string]*Alias, error) {
+	buf, err := readObject(storage, aliasesKey(prefix))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		builds, err := loadBuilds(storage, prefix)
+		if err != nil {
+			return nil, err
+		}
+		return newestAliases(builds), nil
+	}
+
+	aliases := map[string]*Alias{}
+	if err := json.Unmarshal(buf, &aliases); err != nil {
+		return nil, err
+	}
+	return aliases, nil
+}
+
+// writeAliases atomically replaces the aliases of a channel.
+func writeAliases(storage Storage, prefix string, aliases map[string]*Alias) error {
+	buf, err := json.MarshalIndent(aliases, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeObject(storage, aliasesKey(prefix), buf)
+}
+
+// updateAliases points the aliases to the files of a build that
+// was just published, the caller must hold buildsMutex.
+func updateAliases(storage Storage, prefix string, build *Build) error {
+	aliases, err := readAliases(storage, prefix)
+	if err != nil {
+		return err
+	}
+
+	updated := map[string]bool{}
+	for _, name := range build.Files {
+		fileType := fileType(name)
+		if fileType != "" && !updated[fileType] {
+			aliases[fileType] = &Alias{Build: build.ID, File: name}
+			updated[fileType] = true
+		}
+	}
+
+	return writeAliases(storage, prefix, aliases)
+}
+
+// repointAliases points the aliases to the removed build elsewhere,
+// the caller must hold buildsMutex.
+func repointAliases(storage Storage, prefix string, removed *Build) error {
+	aliases, err := readAliases(storage, prefix)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for _, alias := range aliases {
+		if alias.Build == removed.ID {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	builds, err := loadBuilds(storage, prefix)
+	if err != nil {
+		return err
+	}
+	newest := newestAliases(builds)
+
+	for fileType, alias := range aliases {
+		if alias.Build != removed.ID {
+			continue
+		}
+		if replacement, ok := newest[fileType]; ok {
+			aliases[fileType] = replacement
+		} else {
+			delete(aliases, fileType)
+		}
+	}
+
+	return writeAliases(storage, prefix, aliases)
+}
+
+// aliasedBuilds returns the identifiers of the builds that aliases point to.
+func aliasedBuilds(aliases map[string]*Alias) map[string]bool {
+	result := map[string]bool{}
+	for _, alias := range aliases {
+		result[alias.Build] = true
+	}
+	return result
+}
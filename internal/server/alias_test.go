@@ -0,0 +1,151 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// readTestAliases returns the aliases of nightly as "type build/file"
+func readTestAliases(t *testing.T, storage Storage) map[string]string {
+	t.Helper()
+
+	aliases, err := readAliases(storage, "nightly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := map[string]string{}
+	for fileType, alias := range aliases {
+		result[fileType] = alias.Build + "/" + alias.File
+	}
+	return result
+}
+
+func TestFileType(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"image.iso", "iso"},
+		{"image.ISO", "iso"},
+		{"image.iso.sha256sum", "checksum"},
+		{"Fedora-CHECKSUM", "checksum"},
+		{"image.iso.asc", "signature"},
+		{"image.iso.sig", "signature"},
+		{"README", ""},
+	}
+	for _, test := range tests {
+		if fileType := fileType(test.name); fileType != test.expected {
+			t.Errorf("fileType(%q) = %q, want %q", test.name, fileType, test.expected)
+		}
+	}
+}
+
+func TestAliases(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	appState := newTestAppState(t, dir)
+
+	// The newer build has no checksum file
+	publishTestBuild(t, appState.Storage, "nightly", "b1", map[string]string{"one.iso": "hello", "one.iso.sha256sum": "world"}, nil)
+	publishTestBuild(t, appState.Storage, "nightly", "b2", map[string]string{"two.iso": "hello"}, nil)
+	expected := map[string]string{"iso": "b2/two.iso", "checksum": "b1/one.iso.sha256sum"}
+	if aliases := readTestAliases(t, appState.Storage); !reflect.DeepEqual(aliases, expected) {
+		t.Fatalf("aliases %v, want %v", aliases, expected)
+	}
+
+	r := newTestRequest(appState, http.MethodGet, "/api/v1/channels/nightly/latest", nil, map[string]string{"channel": "nightly"})
+	w := httptest.NewRecorder()
+	ListAliasesHandler(w, r)
+	var aliases map[string]*Alias
+	if err := json.Unmarshal(w.Body.Bytes(), &aliases); err != nil {
+		t.Fatal(err)
+	}
+	if len(aliases) != 2 || aliases["iso"].Build != "b2" || aliases["iso"].File != "two.iso" {
+		t.Fatalf("aliases %s", w.Body.String())
+	}
+
+	// Cleanup leaves the builds the aliases point to
+	appState.Config.Channels[0].Retention = &RetentionPolicy{KeepLast: 1}
+	if report := RemoveOldImages(appState, appState.Config.Channels, false); report.FreedBytes != 0 {
+		t.Fatalf("cleanup removed %+v", report.Channels[0].Removed[0])
+	}
+
+	// Deleting a build points its aliases to the newest file left
+	r = newTestRequest(appState, http.MethodDelete, "/api/v1/channels/nightly/builds/b2", nil, map[string]string{"channel": "nightly", "id": "b2"})
+	w = httptest.NewRecorder()
+	DeleteBuildHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	expected = map[string]string{"iso": "b1/one.iso", "checksum": "b1/one.iso.sha256sum"}
+	if aliases := readTestAliases(t, appState.Storage); !reflect.DeepEqual(aliases, expected) {
+		t.Fatalf("aliases %v, want %v", aliases, expected)
+	}
+
+	// The last build takes the aliases along
+	r = newTestRequest(appState, http.MethodDelete, "/api/v1/channels/nightly/builds/b1", nil, map[string]string{"channel": "nightly", "id": "b1"})
+	DeleteBuildHandler(httptest.NewRecorder(), r)
+	if aliases := readTestAliases(t, appState.Storage); len(aliases) != 0 {
+		t.Fatalf("aliases %v", aliases)
+	}
+}
+
+func TestAliasesWithoutFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewLocalStorage(dir)
+
+	// Files stored before aliases were introduced
+	now := time.Now()
+	putTestFile(t, dir, storage, "nightly/old.iso", "hello", now.Add(-time.Hour))
+	putTestFile(t, dir, storage, "nightly/old.iso.sha256sum", "hello", now.Add(-time.Hour))
+	putTestFile(t, dir, storage, "nightly/new.iso", "hello", now)
+
+	expected := map[string]string{"iso": "new.iso/new.iso", "checksum": "old.iso/old.iso.sha256sum"}
+	if aliases := readTestAliases(t, storage); !reflect.DeepEqual(aliases, expected) {
+		t.Fatalf("aliases %v, want %v", aliases, expected)
+	}
+}
+
+func TestLatestHandlers(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	appState := newTestAppState(t, dir)
+	publishTestBuild(t, appState.Storage, "nightly", "b1", map[string]string{"one image.iso": "hello"}, nil)
+
+	tests := []struct {
+		name     string
+		target   string
+		handler  http.HandlerFunc
+		fileType string
+		status   int
+		location string
+	}{
+		{"api", "/api/v1/channels/nightly/latest/iso", LatestImageHandler, "iso", http.StatusFound, "/api/v1/channels/nightly/images/one%20image.iso"},
+		{"files", "/files/nightly/latest/iso", LatestFileHandler, "iso", http.StatusFound, "/files/nightly/one%20image.iso"},
+		{"unknown type", "/files/nightly/latest/checksum", LatestFileHandler, "checksum", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestRequest(appState, http.MethodGet, test.target, nil, map[string]string{"channel": "nightly", "type": test.fileType})
+			w := httptest.NewRecorder()
+			test.handler(w, r)
+
+			if w.Code != test.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, test.status, w.Body.String())
+			}
+			if location := w.Header().Get("Location"); location != test.location {
+				t.Fatalf("location %q, want %q", location, test.location)
+			}
+		})
+	}
+}
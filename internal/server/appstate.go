@@ -4,9 +4,46 @@
 
 package server
 
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/liri-infra/image-manager/internal/logger"
+)
+
 // AppState represents the application state.
 type AppState struct {
-	Config *Config
+	Config    *Config
+	Storage   Storage
+	Sessions  *SessionManager
+	Checksums *ChecksumCache
+	// Events is nil when nobody listens
+	Events   *EventBus
+	Webhooks *WebhookDispatcher
+	Metrics  *Metrics
+}
+
+// SharedState holds the current app state, which is replaced
+// as a whole when the configuration is reloaded.
+type SharedState struct {
+	value atomic.Value
+}
+
+// NewSharedState creates a shared state starting from appState.
+func NewSharedState(appState *AppState) *SharedState {
+	state := &SharedState{}
+	state.value.Store(appState)
+	return state
+}
+
+// Load returns the current app state, which must not be modified.
+func (s *SharedState) Load() *AppState {
+	return s.value.Load().(*AppState)
+}
+
+// Store replaces the current app state.
+func (s *SharedState) Store(appState *AppState) {
+	s.value.Store(appState)
 }
 
 // ContextKey is a type that represent the key of a context.
@@ -15,4 +52,21 @@ type ContextKey int
 const (
 	// KeyAppState is the context key for the app state.
 	KeyAppState ContextKey = iota
+	// KeyIdentity is the context key for the authenticated client.
+	KeyIdentity
+	// KeySharedState is the context key for the shared state, that
+	// handlers changing the configuration replace.
+	KeySharedState
 )
+
+// appStateFromRequest returns the app state from the request context,
+// or replies with an error and returns nil if it cannot be found.
+func appStateFromRequest(w http.ResponseWriter, r *http.Request) *AppState {
+	appState, ok := r.Context().Value(KeyAppState).(*AppState)
+	if !ok {
+		logger.Error("Unable to retrieve app state from context")
+		http.Error(w, "no app state found", http.StatusUnprocessableEntity)
+		return nil
+	}
+	return appState
+}
@@ -0,0 +1,469 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/liri-infra/image-manager/internal/logger"
+)
+
+// Build manifests are stored in this directory, inside the channel directory
+const buildsDir = ".builds"
+
+// Files are received in this directory, inside the storage directory,
+// before they are published
+const stagingDir = ".staging"
+
+// Files are stored in this directory, inside the channel directory,
+// until their build is published
+const publishingDir = ".publishing"
+
+// Suffixes of files that belong to the build of another file,
+// used to group files uploaded before builds were introduced
+var companionSuffixes = []string{
+	".sha256sum", ".sha256", ".sha512sum", ".sha512", ".md5sum", ".md5",
+	".asc", ".sig",
+}
+
+// Serializes changes to the build manifests
+var buildsMutex sync.Mutex
+
+// ErrFileExists is returned when publishing a file that is already stored
+var ErrFileExists = errors.New("file already exists")
+
+// ErrReservedFileName is returned when publishing a file with the name
+// of a file written by the server
+var ErrReservedFileName = errors.New("reserved file name")
+
+// Build groups the files uploaded together, such as an ISO image and
+// its checksum file, that are listed and removed as a whole.
+type Build struct {
+	ID       string   `json:"id"`
+	Created  string   `json:"created"`
+	Uploader string   `json:"uploader,omitempty"`
+	Files    []string `json:"files"`
+	// SHA-256 checksums by file name
+	Checksums map[string]string `json:"checksums,omitempty"`
+	// Set when the build was promoted from another channel
+	PromotedFrom *Provenance `json:"promoted_from,omitempty"`
+}
+
+// Provenance tells where a promoted build comes from.
+type Provenance struct {
+	Channel  string `json:"channel"`
+	Build    string `json:"build"`
+	Created  string `json:"created"`
+	Uploader string `json:"uploader,omitempty"`
+}
+
+// storedBuild is a build found in a channel directory
+type storedBuild struct {
+	build   *Build
+	created time.Time
+	files   []*storedImage
+	size    int64
+}
+
+// NewBuildID returns a new build identifier, which sorts by creation time.
+func NewBuildID() (string, error) {
+	key := make([]byte, 4)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s-%s", time.Now().UTC().Format("20060102T150405"), hex.EncodeToString(key)), nil
+}
+
+// isValidBuildID returns whether id can be used in a file name
+func isValidBuildID(id string) bool {
+	return isValidFileName(id) && !strings.HasSuffix(id, ".json")
+}
+
+// buildStem returns the name of the file that name belongs to
+func buildStem(name string) string {
+	for _, suffix := range companionSuffixes {
+		if strings.HasSuffix(name, suffix) && len(name) > len(suffix) {
+			return strings.TrimSuffix(name, suffix)
+		}
+	}
+	return name
+}
+
+func manifestKey(prefix, id string) string {
+	return path.Join(prefix, buildsDir, id+".json")
+}
+
+// readBuild reads the manifest of the build id, returns nil if it doesn't exist.
+func readBuild(storage Storage, prefix, id string) (*Build, error) {
+	buf, err := readObject(storage, manifestKey(prefix, id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var build Build
+	if err := json.Unmarshal(buf, &build); err != nil {
+		return nil, err
+	}
+	return &build, nil
+}
+
+// writeBuild saves the manifest of build.
+func writeBuild(storage Storage, prefix string, build *Build) error {
+	buf, err := json.MarshalIndent(build, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeObject(storage, manifestKey(prefix, build.ID), buf)
+}
+
+// publishingBuilds returns the identifiers of the builds that are being
+// published in the channel with the specified key prefix.
+func publishingBuilds(storage Storage, prefix string) (map[string]bool, error) {
+	dir := path.Join(prefix, publishingDir) + "/"
+	objects, err := storage.List(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := map[string]bool{}
+	for _, object := range objects {
+		relative := strings.TrimPrefix(object.Key, dir)
+		if i := strings.Index(relative, "/"); i > 0 {
+			ids[relative[:i]] = true
+		}
+	}
+	return ids, nil
+}
+
+// isComplete returns whether all the files of build are stored
+func isComplete(storage Storage, prefix string, build *Build) (bool, error) {
+	for _, name := range build.Files {
+		if _, err := storage.Stat(path.Join(prefix, name)); os.IsNotExist(err) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// checkPublish returns an error when files cannot be published as the
+// build id, because they or the build already exist or they belong to
+// a build being published, the caller must hold buildsMutex.
+func checkPublish(storage Storage, prefix, id string, files []string) error {
+	for _, name := range files {
+		if _, err := storage.Stat(path.Join(prefix, name)); err == nil {
+			return fmt.Errorf("%w: %s", ErrFileExists, name)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if existing, err := readBuild(storage, prefix, id); err != nil || existing != nil {
+		return fmt.Errorf("%w: build %s", ErrFileExists, id)
+	}
+
+	// Files of the builds being published are not in place yet
+	publishing, err := publishingBuilds(storage, prefix)
+	if err != nil {
+		return err
+	}
+	for other := range publishing {
+		build, err := readBuild(storage, prefix, other)
+		if err != nil {
+			return err
+		}
+		if build == nil {
+			continue
+		}
+		for _, claimed := range build.Files {
+			for _, name := range files {
+				if name == claimed {
+					return fmt.Errorf("%w: %s", ErrFileExists, name)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// removePublishingDir removes dir, where files are stored until
+// their build is published.
+func removePublishingDir(storage Storage, dir string) error {
+	objects, err := storage.List(dir + "/")
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if err := storage.Delete(object.Key); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// Only empty directories are left, up to the hidden one
+	if local, ok := storage.(*LocalStorage); ok {
+		os.RemoveAll(local.path(dir))
+		for parent := path.Dir(dir); strings.Contains(parent, publishingDir); parent = path.Dir(parent) {
+			os.Remove(local.path(parent))
+		}
+	}
+	return nil
+}
+
+// removeIncompleteBuild removes the build id along with its files,
+// unless all of them are stored.
+func removeIncompleteBuild(storage Storage, prefix, id string) error {
+	buildsMutex.Lock()
+	defer buildsMutex.Unlock()
+
+	build, err := readBuild(storage, prefix, id)
+	if err != nil || build == nil {
+		return err
+	}
+	if complete, err := isComplete(storage, prefix, build); err != nil || complete {
+		return err
+	}
+
+	for _, name := range build.Files {
+		if err := storage.Delete(path.Join(prefix, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := storage.Delete(manifestKey(prefix, id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// abortPublish removes the build id, unless all of its files were
+// published, and the objects in dir, where its files were stored.
+func abortPublish(storage Storage, prefix, id, dir string) error {
+	if err := removeIncompleteBuild(storage, prefix, id); err != nil {
+		return err
+	}
+
+	return removePublishingDir(storage, dir)
+}
+
+// publishBuild stores files, a map from file name to source, in the channel
+// with the specified key prefix and records them as build.  The put function
+// stores each source as a key, such as Storage.PutFile for local paths.
+// Either all of them are published or none.
+//
+// Files are stored in a hidden directory first, then the manifest is
+// written and they are moved into place: the build is not listed until
+// all of them are there.
+func publishBuild(storage Storage, prefix string, build *Build, files map[string]string, put func(key, source string) error) error {
+	// Do not allow to overwrite existing files or builds, nor
+	// the files written by the server
+	build.Files = []string{}
+	for name := range files {
+		if isGeneratedFile(name) {
+			return fmt.Errorf("%w: %s", ErrReservedFileName, name)
+		}
+		build.Files = append(build.Files, name)
+	}
+	sort.Strings(build.Files)
+
+	// Fail before storing anything, it is checked again later
+	buildsMutex.Lock()
+	err := checkPublish(storage, prefix, build.ID, build.Files)
+	buildsMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Each attempt has its own directory, in case the same
+	// build is published twice at the same time
+	attempt := make([]byte, 4)
+	if _, err := rand.Read(attempt); err != nil {
+		return err
+	}
+	dir := path.Join(prefix, publishingDir, build.ID, hex.EncodeToString(attempt))
+
+	for _, name := range build.Files {
+		if err := put(path.Join(dir, name), files[name]); err != nil {
+			removePublishingDir(storage, dir)
+			return err
+		}
+	}
+
+	// Other builds might have taken the same names meanwhile
+	buildsMutex.Lock()
+	err = checkPublish(storage, prefix, build.ID, build.Files)
+	if err == nil {
+		err = writeBuild(storage, prefix, build)
+	}
+	buildsMutex.Unlock()
+	if err != nil {
+		removePublishingDir(storage, dir)
+		return err
+	}
+
+	for _, name := range build.Files {
+		if err := storage.Copy(path.Join(prefix, name), path.Join(dir, name)); err != nil {
+			if abortErr := abortPublish(storage, prefix, build.ID, dir); abortErr != nil {
+				logger.Errorf("Failed to remove build %s: %v", build.ID, abortErr)
+			}
+			return err
+		}
+	}
+	if err := removePublishingDir(storage, dir); err != nil {
+		logger.Errorf("Failed to remove files of build %s: %v", build.ID, err)
+	}
+
+	// The build is published anyway
+	buildsMutex.Lock()
+	defer buildsMutex.Unlock()
+	if err := updateAliases(storage, prefix, build); err != nil {
+		logger.Errorf("Failed to update aliases to build %s: %v", build.ID, err)
+	}
+
+	return nil
+}
+
+// loadBuilds returns the builds stored in the channel with the specified
+// key prefix, from the newest to the oldest.  Files that are not listed
+// in any manifest are grouped by name, builds whose files were all
+// removed have no files and builds being published are skipped.
+func loadBuilds(storage Storage, prefix string) ([]*storedBuild, error) {
+	images, err := listStoredImages(storage, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// Files by name relative to the channel
+	byName := map[string]*storedImage{}
+	for _, image := range images {
+		byName[image.name] = image
+	}
+
+	var builds []*storedBuild
+
+	// Builds being published are not listed until all their files are in place
+	publishing, err := publishingBuilds(storage, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// Builds with a manifest
+	manifests, err := storage.List(path.Join(prefix, buildsDir) + "/")
+	if err != nil {
+		return nil, err
+	}
+	for _, manifest := range manifests {
+		name := path.Base(manifest.Key)
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		build, err := readBuild(storage, prefix, strings.TrimSuffix(name, ".json"))
+		if err != nil || build == nil {
+			continue
+		}
+
+		stored := &storedBuild{build: build}
+		stored.created, err = time.Parse(time.RFC3339, build.Created)
+		if err != nil {
+			stored.created = manifest.Modified
+		}
+		for _, name := range build.Files {
+			if image, ok := byName[name]; ok {
+				stored.files = append(stored.files, image)
+				stored.size += image.info.Size
+				delete(byName, name)
+			}
+		}
+		if publishing[build.ID] && len(stored.files) < len(build.Files) {
+			continue
+		}
+		builds = append(builds, stored)
+	}
+
+	// Group the remaining files
+	stems := map[string]*storedBuild{}
+	for _, image := range images {
+		if _, ok := byName[image.name]; !ok {
+			continue
+		}
+
+		stem := buildStem(image.name)
+		stored, ok := stems[stem]
+		if !ok {
+			stored = &storedBuild{build: &Build{ID: stem}}
+			stems[stem] = stored
+			builds = append(builds, stored)
+		}
+
+		stored.build.Files = append(stored.build.Files, image.name)
+		stored.files = append(stored.files, image)
+		stored.size += image.info.Size
+		if image.info.Modified.After(stored.created) {
+			stored.created = image.info.Modified
+			stored.build.Created = stored.created.UTC().Format(time.RFC3339)
+		}
+	}
+
+	sort.SliceStable(builds, func(i, j int) bool {
+		return builds[i].created.After(builds[j].created)
+	})
+
+	return builds, nil
+}
+
+// findBuild returns the build with the specified identifier, or
+// the build that contains fileName when id is empty, or nil.
+func findBuild(builds []*storedBuild, id, fileName string) *storedBuild {
+	for _, stored := range builds {
+		if id != "" && stored.build.ID == id {
+			return stored
+		}
+		if fileName != "" {
+			for _, image := range stored.files {
+				if image.name == fileName {
+					return stored
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// removeBuild removes all the files of a build and its manifest.
+func removeBuild(storage Storage, prefix string, stored *storedBuild) error {
+	buildsMutex.Lock()
+	defer buildsMutex.Unlock()
+
+	for _, image := range stored.files {
+		if err := storage.Delete(image.info.Key); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if err := storage.Delete(manifestKey(prefix, stored.build.ID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := repointAliases(storage, prefix, stored.build); err != nil {
+		logger.Errorf("Failed to update aliases to build %s: %v", stored.build.ID, err)
+	}
+
+	return nil
+}
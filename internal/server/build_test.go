@@ -0,0 +1,229 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// putTestFile stores content as key, last modified at modified
+func putTestFile(t *testing.T, dir string, storage Storage, key, content string, modified time.Time) {
+	t.Helper()
+
+	if err := storage.Put(key, strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(dir, key), modified, modified); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// storedFileNames returns the sorted names of the files of stored
+func storedFileNames(stored *storedBuild) []string {
+	names := []string{}
+	for _, image := range stored.files {
+		names = append(names, image.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestBuildStem(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"image.iso", "image.iso"},
+		{"image.iso.sha256sum", "image.iso"},
+		{"image.iso.asc", "image.iso"},
+		{"image.iso.sha256sum.asc", "image.iso.sha256sum"},
+		{".sha256sum", ".sha256sum"},
+	}
+	for _, test := range tests {
+		if stem := buildStem(test.name); stem != test.expected {
+			t.Errorf("buildStem(%q) = %q, want %q", test.name, stem, test.expected)
+		}
+	}
+}
+
+func TestLoadBuilds(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewLocalStorage(dir)
+
+	// A build with a manifest, whose checksum file does not
+	// share its name
+	publishTestBuild(t, storage, "nightly", "20200103T000000-00000001",
+		map[string]string{"image.iso": "hello", "SUMS": "world"}, nil)
+
+	// Files uploaded before builds were introduced, an incomplete
+	// upload and a hidden file
+	now := time.Now()
+	putTestFile(t, dir, storage, "nightly/old.iso", "hello", now.Add(-2*time.Hour))
+	putTestFile(t, dir, storage, "nightly/old.iso.sha256sum", "hello", now.Add(-time.Hour))
+	putTestFile(t, dir, storage, "nightly/older.iso", "hello", now.Add(-3*time.Hour))
+	putTestFile(t, dir, storage, "nightly/upload.iso.part", "hello", now)
+	putTestFile(t, dir, storage, "nightly/.hidden", "hello", now)
+
+	// A build whose files were removed
+	if err := writeBuild(storage, "nightly", &Build{ID: "20200101T000000-00000002", Created: "2020-01-01T00:00:00Z", Files: []string{"gone.iso"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	builds, err := loadBuilds(storage, "nightly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := buildIDs(builds); !reflect.DeepEqual(ids, []string{"20200103T000000-00000001", "old.iso", "older.iso", "20200101T000000-00000002"}) {
+		t.Fatalf("builds %v", ids)
+	}
+
+	tests := []struct {
+		files []string
+		size  int64
+	}{
+		{[]string{"SUMS", "image.iso"}, 10},
+		{[]string{"old.iso", "old.iso.sha256sum"}, 10},
+		{[]string{"older.iso"}, 5},
+		{[]string{}, 0},
+	}
+	for i, test := range tests {
+		if names := storedFileNames(builds[i]); !reflect.DeepEqual(names, test.files) || builds[i].size != test.size {
+			t.Errorf("build %s has %v (%d bytes), want %v (%d bytes)", builds[i].build.ID, names, builds[i].size, test.files, test.size)
+		}
+	}
+
+	// Grouped files are as old as the newest of them
+	if created := builds[1].created; created.Sub(now.Add(-time.Hour)).Round(time.Second) != 0 {
+		t.Fatalf("created %v", created)
+	}
+
+	if stored := findBuild(builds, "", "SUMS"); stored != builds[0] {
+		t.Fatalf("findBuild() found %v", stored)
+	}
+	if stored := findBuild(builds, "older.iso", ""); stored != builds[2] {
+		t.Fatalf("findBuild() found %v", stored)
+	}
+	if stored := findBuild(builds, "", "missing.iso"); stored != nil {
+		t.Fatalf("findBuild() found %v", stored)
+	}
+}
+
+// pausingStorage waits for resume before copying to the key pause
+type pausingStorage struct {
+	Storage
+	pause  string
+	paused chan struct{}
+	resume chan struct{}
+}
+
+func (s *pausingStorage) Copy(key, src string) error {
+	if key == s.pause {
+		s.paused <- struct{}{}
+		<-s.resume
+	}
+	return s.Storage.Copy(key, src)
+}
+
+func TestPublishBuildListing(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	appState := newTestAppState(t, dir)
+	storage := &pausingStorage{
+		Storage: appState.Storage,
+		pause:   "nightly/image.iso.sha256sum",
+		paused:  make(chan struct{}),
+		resume:  make(chan struct{}),
+	}
+
+	// The second file takes a while to store
+	files := map[string]string{"image.iso": "hello", "image.iso.sha256sum": "world"}
+	stored := make(chan struct{})
+	put := func(key, source string) error {
+		if source == "image.iso.sha256sum" {
+			stored <- struct{}{}
+			<-storage.resume
+		}
+		return storage.Put(key, strings.NewReader(files[source]), int64(len(files[source])))
+	}
+	build := &Build{ID: "20200101T000000-00000001", Created: time.Now().UTC().Format(time.RFC3339)}
+	published := make(chan error, 1)
+	go func() {
+		published <- publishBuild(storage, "nightly", build, map[string]string{"image.iso": "image.iso", "image.iso.sha256sum": "image.iso.sha256sum"}, put)
+	}()
+
+	// Other builds are published meanwhile
+	<-stored
+	publishTestBuild(t, appState.Storage, "nightly", "20200101T000000-00000002", map[string]string{"other.iso": "hello"}, nil)
+	if images := listTestImages(t, appState); len(images) != 1 || images[0]["name"] != "other.iso" {
+		t.Fatalf("images while storing %v", images)
+	}
+	storage.resume <- struct{}{}
+
+	// One file is in place, the other one is not
+	<-storage.paused
+	if _, err := appState.Storage.Stat("nightly/image.iso"); err != nil {
+		t.Fatal(err)
+	}
+	if images := listTestImages(t, appState); len(images) != 1 || images[0]["name"] != "other.iso" {
+		t.Fatalf("images while moving %v", images)
+	}
+	err := publishBuild(appState.Storage, "nightly", &Build{ID: "20200101T000000-00000003"}, map[string]string{"image.iso.sha256sum": "image.iso.sha256sum"}, put)
+	if !errors.Is(err, ErrFileExists) {
+		t.Fatalf("publishing a file of the build being published: %v", err)
+	}
+	storage.resume <- struct{}{}
+
+	if err := <-published; err != nil {
+		t.Fatal(err)
+	}
+	if images := listTestImages(t, appState); len(images) != 3 {
+		t.Fatalf("images %v", images)
+	}
+	if objects, err := appState.Storage.List("nightly/" + publishingDir + "/"); err != nil || len(objects) != 0 {
+		t.Fatalf("files were left behind: %v", err)
+	}
+}
+
+func TestRemovePartialFilesPublishing(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	appState := newTestAppState(t, dir)
+
+	// The server stopped while moving the files of a build into place,
+	// the files of a published build are left behind as well
+	interrupted := &Build{ID: "20200101T000000-00000001", Files: []string{"image.iso", "image.iso.sha256sum"}}
+	if err := writeBuild(appState.Storage, "nightly", interrupted); err != nil {
+		t.Fatal(err)
+	}
+	putTestFile(t, dir, appState.Storage, "nightly/image.iso", "hello", time.Now())
+	putTestFile(t, dir, appState.Storage, "nightly/.publishing/20200101T000000-00000001/0000/image.iso", "hello", time.Now())
+	putTestFile(t, dir, appState.Storage, "nightly/.publishing/20200101T000000-00000001/0000/image.iso.sha256sum", "world", time.Now())
+	publishTestBuild(t, appState.Storage, "nightly", "20200101T000000-00000002", map[string]string{"other.iso": "hello"}, nil)
+	putTestFile(t, dir, appState.Storage, "nightly/.publishing/20200101T000000-00000002/0000/other.iso", "hello", time.Now())
+
+	RemovePartialFiles(appState)
+
+	for key, exists := range map[string]bool{
+		"nightly/image.iso": false,
+		manifestKey("nightly", "20200101T000000-00000001"): false,
+		"nightly/other.iso": true,
+		manifestKey("nightly", "20200101T000000-00000002"): true,
+	} {
+		if _, err := appState.Storage.Stat(key); os.IsNotExist(err) == exists {
+			t.Errorf("%s exists %v: %v", key, !exists, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "nightly", publishingDir)); !os.IsNotExist(err) {
+		t.Fatalf("publishing directory was left behind: %v", err)
+	}
+}
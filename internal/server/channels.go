@@ -0,0 +1,341 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/go-chi/chi"
+
+	"github.com/liri-infra/image-manager/internal/logger"
+)
+
+// Removed channels are moved here, inside the storage location
+const archiveDir = ".archive"
+
+var (
+	errChannelExists   = errors.New("channel already exists")
+	errChannelNotFound = errors.New("channel not found")
+)
+
+// cloneChannels returns a copy of the configuration whose channels
+// can be changed without affecting c.
+func (c *Config) cloneChannels() *Config {
+	config := *c
+	config.Channels = make([]*ImageChannel, 0, len(c.Channels))
+	for _, channel := range c.Channels {
+		copied := *channel
+		if channel.Retention != nil {
+			retention := *channel.Retention
+			copied.Retention = &retention
+		}
+		config.Channels = append(config.Channels, &copied)
+	}
+	return &config
+}
+
+// RemoveChannel removes the channel called name and returns it,
+// or nil if it was not found
+func (c *Config) RemoveChannel(name string) *ImageChannel {
+	for i, channel := range c.Channels {
+		if channel.Name == name {
+			c.Channels = append(c.Channels[:i], c.Channels[i+1:]...)
+			return channel
+		}
+	}
+	return nil
+}
+
+// changeChannels applies change both to the configuration file, which
+// is saved, and to the running configuration, which is applied.  The
+// configuration file is read again so that options given on the command
+// line do not end up there.  If done is not nil, it is called with the
+// new state before other changes can happen, and when it fails the
+// previous configuration is saved and applied again.
+func changeChannels(state *SharedState, change func(config *Config) error, done func(appState *AppState) error) error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	current := state.Load()
+	saved, err := OpenConfig(current.Config.path)
+	if err != nil {
+		return fmt.Errorf("cannot open configuration file: %v", err)
+	}
+	var previous *Config
+	if done != nil {
+		if previous, err = OpenConfig(current.Config.path); err != nil {
+			return fmt.Errorf("cannot open configuration file: %v", err)
+		}
+	}
+	if err := change(saved); err != nil {
+		return err
+	}
+	if err := saved.validate(nil); err != nil {
+		return err
+	}
+
+	running := current.Config.cloneChannels()
+	if err := change(running); err != nil {
+		return err
+	}
+	if err := running.validate(nil); err != nil {
+		return err
+	}
+
+	if err := saved.Save(); err != nil {
+		return fmt.Errorf("cannot save configuration file: %v", err)
+	}
+	if err := applyConfig(state, running); err != nil {
+		return err
+	}
+	if done == nil {
+		return nil
+	}
+
+	if err := done(state.Load()); err != nil {
+		if saveErr := previous.Save(); saveErr != nil {
+			logger.Errorf("Cannot restore configuration file: %v", saveErr)
+		}
+		if applyErr := applyConfig(state, current.Config); applyErr != nil {
+			logger.Errorf("Cannot restore configuration: %v", applyErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// archiveChannel moves the files of a removed channel to the archive,
+// where they are not served and not cleaned up, and returns the new
+// location.
+func archiveChannel(appState *AppState, imageChannel *ImageChannel) (string, error) {
+	name := fmt.Sprintf("%s-%s", imageChannel.Name, time.Now().UTC().Format("20060102T150405Z"))
+	prefix := channelPrefix(imageChannel)
+
+	// Move the directory at once, without copying the files
+	if _, ok := appState.Storage.(*LocalStorage); ok {
+		archivePath := filepath.Join(appState.Config.StorageDir, archiveDir, name)
+		if err := os.MkdirAll(filepath.Dir(archivePath), 0755); err != nil {
+			return "", err
+		}
+		err := os.Rename(filepath.Join(appState.Config.StorageDir, filepath.FromSlash(prefix)), archivePath)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		return archivePath, nil
+	}
+
+	// Copy everything before deleting anything, so that the channel
+	// is left as it is when a copy fails
+	objects, err := appState.Storage.List(prefix + "/")
+	if err != nil {
+		return "", err
+	}
+	archivePrefix := path.Join(archiveDir, name)
+	var copied []string
+	for _, object := range objects {
+		key := path.Join(archivePrefix, object.Key[len(prefix)+1:])
+		if err := appState.Storage.Copy(key, object.Key); err != nil {
+			for _, key := range copied {
+				appState.Storage.Delete(key)
+			}
+			return "", err
+		}
+		copied = append(copied, key)
+	}
+	for _, object := range objects {
+		if err := appState.Storage.Delete(object.Key); err != nil {
+			logger.Warnf("Failed to delete \"%s\" after archiving it: %v", object.Key, err)
+		}
+	}
+
+	// Only the empty directory created at startup is left
+	os.Remove(filepath.Join(appState.Config.StorageDir, filepath.FromSlash(prefix)))
+
+	return archivePrefix, nil
+}
+
+// sharedStateFromRequest returns the shared state from the request
+// context, or replies with an error and returns nil if it cannot be found.
+func sharedStateFromRequest(w http.ResponseWriter, r *http.Request) *SharedState {
+	state, ok := r.Context().Value(KeySharedState).(*SharedState)
+	if !ok {
+		logger.Error("Unable to retrieve shared state from context")
+		http.Error(w, "no shared state found", http.StatusUnprocessableEntity)
+		return nil
+	}
+	return state
+}
+
+// handleChannelError replies with the error of a channel change
+func handleChannelError(w http.ResponseWriter, err error) {
+	var configErr *ConfigError
+	switch {
+	case errors.Is(err, errChannelExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, errChannelNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.As(err, &configErr):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// replyChannel replies with the description of the channel called name
+func replyChannel(w http.ResponseWriter, r *http.Request, state *SharedState, name string) {
+	imageChannel := state.Load().Config.FindChannel(name)
+	if imageChannel == nil {
+		http.Error(w, errChannelNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	EncodeJSONReply(w, r, newChannelInfo(imageChannel, IdentityFromContext(r.Context())))
+}
+
+// AddChannelHandler adds a channel and creates its directory.
+func AddChannelHandler(w http.ResponseWriter, r *http.Request) {
+	state := sharedStateFromRequest(w, r)
+	if state == nil {
+		return
+	}
+
+	if !authorize(w, r, PermissionAdmin, "") {
+		return
+	}
+
+	var request struct {
+		Name      string           `json:"name"`
+		Path      string           `json:"path"`
+		Public    bool             `json:"public"`
+		Retention *RetentionPolicy `json:"retention"`
+	}
+	if err := DecodeJSONBody(w, r, &request); err != nil {
+		HandleDecodeError(w, err)
+		return
+	}
+
+	err := changeChannels(state, func(config *Config) error {
+		if config.FindChannel(request.Name) != nil {
+			return errChannelExists
+		}
+		imageChannel := &ImageChannel{
+			Name:   request.Name,
+			Path:   request.Path,
+			Public: request.Public,
+		}
+		if request.Retention != nil {
+			retention := *request.Retention
+			imageChannel.Retention = &retention
+		}
+		config.Channels = append(config.Channels, imageChannel)
+		return nil
+	}, nil)
+	if err != nil {
+		logger.Errorf("Cannot add channel \"%s\": %v", request.Name, err)
+		handleChannelError(w, err)
+		return
+	}
+
+	logger.Infof("Channel \"%s\" added by \"%s\"", request.Name, identityName(r))
+	replyChannel(w, r, state, request.Name)
+}
+
+// EditChannelHandler changes the settings of a channel, except for
+// its directory.
+func EditChannelHandler(w http.ResponseWriter, r *http.Request) {
+	state := sharedStateFromRequest(w, r)
+	if state == nil {
+		return
+	}
+
+	if !authorize(w, r, PermissionAdmin, "") {
+		return
+	}
+
+	// Settings that are not present are left as they are, an empty
+	// retention policy removes the current one
+	channelName := chi.URLParam(r, "channel")
+	var request struct {
+		Public    *bool            `json:"public"`
+		Retention *RetentionPolicy `json:"retention"`
+	}
+	if err := DecodeJSONBody(w, r, &request); err != nil {
+		HandleDecodeError(w, err)
+		return
+	}
+
+	err := changeChannels(state, func(config *Config) error {
+		imageChannel := config.FindChannel(channelName)
+		if imageChannel == nil {
+			return errChannelNotFound
+		}
+		if request.Public != nil {
+			imageChannel.Public = *request.Public
+		}
+		if request.Retention != nil {
+			// The policy replaces the legacy setting
+			imageChannel.Cleanup = false
+			imageChannel.Retention = nil
+			if *request.Retention != (RetentionPolicy{}) {
+				retention := *request.Retention
+				imageChannel.Retention = &retention
+			}
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		logger.Errorf("Cannot edit channel \"%s\": %v", channelName, err)
+		handleChannelError(w, err)
+		return
+	}
+
+	logger.Infof("Channel \"%s\" edited by \"%s\"", channelName, identityName(r))
+	replyChannel(w, r, state, channelName)
+}
+
+// RemoveChannelHandler removes a channel and moves its files
+// to the archive.
+func RemoveChannelHandler(w http.ResponseWriter, r *http.Request) {
+	state := sharedStateFromRequest(w, r)
+	if state == nil {
+		return
+	}
+
+	if !authorize(w, r, PermissionAdmin, "") {
+		return
+	}
+
+	// Files are archived once nothing is served from the channel
+	// anymore, the channel is restored if that fails
+	channelName := chi.URLParam(r, "channel")
+	var removed *ImageChannel
+	var location string
+	err := changeChannels(state, func(config *Config) error {
+		removed = config.RemoveChannel(channelName)
+		if removed == nil {
+			return errChannelNotFound
+		}
+		return nil
+	}, func(appState *AppState) error {
+		var err error
+		if location, err = archiveChannel(appState, removed); err != nil {
+			return fmt.Errorf("failed to archive files: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Errorf("Cannot remove channel \"%s\": %v", channelName, err)
+		handleChannelError(w, err)
+		return
+	}
+
+	logger.Infof("Channel \"%s\" removed by \"%s\", files archived to \"%s\"", channelName, identityName(r), location)
+	EncodeJSONReply(w, r, newChannelInfo(removed, IdentityFromContext(r.Context())))
+}
@@ -0,0 +1,343 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testChannelsConfig = `storage: %s
+channels:
+  - name: nightly
+  - name: stable
+`
+
+// newTestChannelsState returns the state of a server whose
+// configuration file is in dir
+func newTestChannelsState(t *testing.T, dir string) *SharedState {
+	path := filepath.Join(dir, "config.yaml")
+	text := strings.Replace(testChannelsConfig, "%s", dir, 1)
+	if err := ioutil.WriteFile(path, []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := OpenConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateChannelDirs(config); err != nil {
+		t.Fatal(err)
+	}
+
+	appState := newTestAppState(t, dir)
+	appState.Config = config
+	return NewSharedState(appState)
+}
+
+// savedChannels returns the names of the channels in the
+// configuration file of state
+func savedChannels(t *testing.T, state *SharedState) []string {
+	config, err := OpenConfig(state.Load().Config.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, channel := range config.Channels {
+		names = append(names, channel.Name)
+	}
+	return names
+}
+
+func TestChangeChannels(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	state := newTestChannelsState(t, dir)
+
+	// Options given on the command line stay out of the file
+	state.Load().Config.Metrics = &MetricsConfig{Public: true}
+
+	err := changeChannels(state, func(config *Config) error {
+		config.Channels = append(config.Channels, &ImageChannel{Name: "testing", Path: "branches/testing"})
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatalf("changeChannels() = %v", err)
+	}
+
+	running := state.Load().Config
+	if running.FindChannel("testing") == nil || running.Metrics == nil {
+		t.Fatalf("running configuration %+v", running)
+	}
+	if names := strings.Join(savedChannels(t, state), " "); names != "nightly stable testing" {
+		t.Fatalf("saved channels %s", names)
+	}
+	saved, err := OpenConfig(running.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Metrics != nil {
+		t.Fatal("running options were saved")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "branches", "testing")); err != nil {
+		t.Fatalf("channel directory: %v", err)
+	}
+}
+
+func TestChangeChannelsFails(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(config *Config) error
+		check  func(err error) bool
+	}{
+		{
+			"change fails",
+			func(config *Config) error {
+				config.Channels = config.Channels[:1]
+				return errChannelNotFound
+			},
+			func(err error) bool { return errors.Is(err, errChannelNotFound) },
+		},
+		{
+			"invalid configuration",
+			func(config *Config) error {
+				config.Channels = append(config.Channels, &ImageChannel{Name: "testing", Path: "nightly"})
+				return nil
+			},
+			func(err error) bool {
+				var configErr *ConfigError
+				return errors.As(err, &configErr)
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+
+			state := newTestChannelsState(t, dir)
+			current := state.Load()
+
+			if err := changeChannels(state, test.change, nil); !test.check(err) {
+				t.Fatalf("changeChannels() = %v", err)
+			}
+
+			// Neither the file nor the running configuration changed
+			if state.Load() != current || len(current.Config.Channels) != 2 {
+				t.Fatal("running configuration was changed")
+			}
+			if names := strings.Join(savedChannels(t, state), " "); names != "nightly stable" {
+				t.Fatalf("saved channels %s", names)
+			}
+		})
+	}
+}
+
+func TestChangeChannelsDoneFails(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	state := newTestChannelsState(t, dir)
+	current := state.Load()
+
+	var removed *AppState
+	err := changeChannels(state, func(config *Config) error {
+		config.RemoveChannel("stable")
+		return nil
+	}, func(appState *AppState) error {
+		removed = appState
+		return errors.New("archive failed")
+	})
+	if err == nil || err.Error() != "archive failed" {
+		t.Fatalf("changeChannels() = %v", err)
+	}
+
+	// The change was applied before done was called
+	if removed == nil || removed.Config.FindChannel("stable") != nil {
+		t.Fatal("done was not called with the new configuration")
+	}
+
+	// Then it was reverted
+	if running := state.Load().Config; running != current.Config {
+		t.Fatalf("running configuration %+v", running)
+	}
+	if names := strings.Join(savedChannels(t, state), " "); names != "nightly stable" {
+		t.Fatalf("saved channels %s", names)
+	}
+}
+
+// copyingStorage is a storage that cannot move directories
+type copyingStorage struct {
+	*LocalStorage
+}
+
+// failingArchiveStorage is a storage that cannot move directories,
+// and fails to copy the key fail
+type failingArchiveStorage struct {
+	*LocalStorage
+	fail string
+}
+
+func (s failingArchiveStorage) Copy(key, src string) error {
+	if src == s.fail {
+		return errors.New("copy failed")
+	}
+	return s.LocalStorage.Copy(key, src)
+}
+
+func TestArchiveChannel(t *testing.T) {
+	tests := []struct {
+		name    string
+		storage func(dir string) Storage
+	}{
+		{"local storage", func(dir string) Storage { return NewLocalStorage(dir) }},
+		{"other storage", func(dir string) Storage { return copyingStorage{NewLocalStorage(dir)} }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+
+			appState := newTestAppState(t, dir)
+			appState.Storage = test.storage(dir)
+			if err := CreateChannelDirs(appState.Config); err != nil {
+				t.Fatal(err)
+			}
+			if err := appState.Storage.Put("nightly/image.iso", strings.NewReader("hello"), 5); err != nil {
+				t.Fatal(err)
+			}
+
+			imageChannel := appState.Config.FindChannel("nightly")
+			location, err := archiveChannel(appState, imageChannel)
+			if err != nil {
+				t.Fatalf("archiveChannel() = %v", err)
+			}
+
+			name := filepath.Base(location)
+			if !strings.HasPrefix(name, "nightly-") {
+				t.Fatalf("archived to %s", location)
+			}
+			archived := path.Join(archiveDir, name, "image.iso")
+			if data := readTestObject(t, appState.Storage, archived); data != "hello" {
+				t.Fatalf("archived file contains %q", data)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "nightly")); !os.IsNotExist(err) {
+				t.Fatalf("channel directory was left: %v", err)
+			}
+		})
+	}
+}
+
+func TestArchiveChannelEmpty(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// The directory was never created
+	appState := newTestAppState(t, dir)
+	if _, err := archiveChannel(appState, appState.Config.FindChannel("stable")); err != nil {
+		t.Fatalf("archiveChannel() = %v", err)
+	}
+}
+
+func TestArchiveChannelCopyFails(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	appState := newTestAppState(t, dir)
+	appState.Storage = failingArchiveStorage{NewLocalStorage(dir), "nightly/b.iso"}
+	for _, key := range []string{"nightly/a.iso", "nightly/b.iso"} {
+		if err := appState.Storage.Put(key, strings.NewReader("hello"), 5); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := archiveChannel(appState, appState.Config.FindChannel("nightly")); err == nil {
+		t.Fatal("archiveChannel() succeeded")
+	}
+
+	// The channel is left as it was, without copies in the archive
+	for _, key := range []string{"nightly/a.iso", "nightly/b.iso"} {
+		if data := readTestObject(t, appState.Storage, key); data != "hello" {
+			t.Fatalf("%s contains %q", key, data)
+		}
+	}
+	objects, err := appState.Storage.List(archiveDir + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 0 {
+		t.Fatalf("%d objects left in the archive", len(objects))
+	}
+}
+
+func TestRemoveChannelHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		fail    string
+		status  int
+		removed bool
+	}{
+		{"archived", "", http.StatusOK, true},
+		{"archive fails", "nightly/image.iso", http.StatusInternalServerError, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+
+			state := newTestChannelsState(t, dir)
+			appState := state.Load()
+			appState.Storage = failingArchiveStorage{NewLocalStorage(dir), test.fail}
+			if err := appState.Storage.Put("nightly/image.iso", strings.NewReader("hello"), 5); err != nil {
+				t.Fatal(err)
+			}
+
+			r := newTestRequest(appState, http.MethodDelete, "/api/v1/channels/nightly", nil, map[string]string{"channel": "nightly"})
+			r = r.WithContext(context.WithValue(r.Context(), KeySharedState, state))
+			w := httptest.NewRecorder()
+			RemoveChannelHandler(w, r)
+			if w.Code != test.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, test.status, w.Body.String())
+			}
+
+			running := state.Load().Config
+			saved := strings.Join(savedChannels(t, state), " ")
+			objects, err := appState.Storage.List(archiveDir + "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !test.removed {
+				// Still served, with its files
+				if running.FindChannel("nightly") == nil || saved != "nightly stable" || len(objects) != 0 {
+					t.Fatalf("running %+v, saved %s, %d archived objects", running.Channels, saved, len(objects))
+				}
+				if data := readTestObject(t, appState.Storage, "nightly/image.iso"); data != "hello" {
+					t.Fatalf("image.iso contains %q", data)
+				}
+				return
+			}
+
+			if running.FindChannel("nightly") != nil || saved != "stable" {
+				t.Fatalf("running %+v, saved %s", running.Channels, saved)
+			}
+			if len(objects) != 1 || path.Base(objects[0].Key) != "image.iso" {
+				t.Fatalf("archived objects %+v", objects)
+			}
+			if data := readTestObject(t, appState.Storage, objects[0].Key); data != "hello" {
+				t.Fatalf("archived file contains %q", data)
+			}
+		})
+	}
+}
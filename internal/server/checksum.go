@@ -0,0 +1,222 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/liri-infra/image-manager/internal/common"
+	"github.com/liri-infra/image-manager/internal/logger"
+)
+
+type checksumEntry struct {
+	size     int64
+	modified time.Time
+	checksum string
+}
+
+// checksumJob is a stored object whose checksum has to be calculated
+type checksumJob struct {
+	storage Storage
+	info    ObjectInfo
+}
+
+// ChecksumCache remembers the SHA-256 checksum of stored files, so
+// that multi-gigabyte images are not read every time they are listed.
+// An entry is valid as long as size and modification time do not change.
+// Checksums that are not known are calculated in the background by a
+// single worker, one file at a time.
+type ChecksumCache struct {
+	mutex      sync.Mutex
+	entries    map[string]checksumEntry
+	pending    map[string]bool
+	queue      []checksumJob
+	working    bool
+	calculated []string
+	listener   func(keys []string)
+}
+
+// NewChecksumCache creates an empty cache.
+func NewChecksumCache() *ChecksumCache {
+	return &ChecksumCache{
+		entries: map[string]checksumEntry{},
+		pending: map[string]bool{},
+	}
+}
+
+// SetListener sets a function that is called with the keys whose
+// checksum was calculated in the background, once there is nothing
+// else to calculate.
+func (c *ChecksumCache) SetListener(listener func(keys []string)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.listener = listener
+}
+
+// Lookup returns the checksum of the stored object, if it's known.
+func (c *ChecksumCache) Lookup(info *ObjectInfo) (string, bool) {
+	c.mutex.Lock()
+	entry, ok := c.entries[info.Key]
+	c.mutex.Unlock()
+
+	if ok && entry.size == info.Size && entry.modified.Equal(info.Modified) {
+		return entry.checksum, true
+	}
+	return "", false
+}
+
+// Cached returns the checksum of the stored object if it's known,
+// otherwise it queues the object to be calculated in the background
+// and returns an empty string.
+func (c *ChecksumCache) Cached(storage Storage, info *ObjectInfo) string {
+	if checksum, ok := c.Lookup(info); ok {
+		return checksum
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Each file is queued once, no matter how many times it's listed
+	if !c.pending[info.Key] {
+		c.pending[info.Key] = true
+		c.queue = append(c.queue, checksumJob{storage: storage, info: *info})
+		if !c.working {
+			c.working = true
+			go c.work()
+		}
+	}
+	return ""
+}
+
+// work calculates the checksums of the queued objects until there
+// are no more, then notifies the listener
+func (c *ChecksumCache) work() {
+	for {
+		c.mutex.Lock()
+		if len(c.queue) == 0 {
+			c.working = false
+			keys := c.calculated
+			c.calculated = nil
+			listener := c.listener
+			c.mutex.Unlock()
+
+			// Notify once for a batch of files
+			if listener != nil && len(keys) > 0 {
+				listener(keys)
+			}
+			return
+		}
+		job := c.queue[0]
+		c.queue = c.queue[1:]
+		c.mutex.Unlock()
+
+		checksum, err := c.Checksum(job.storage, &job.info)
+
+		c.mutex.Lock()
+		delete(c.pending, job.info.Key)
+		if err != nil {
+			logger.Errorf("Failed to calculate checksum of \"%s\": %v", job.info.Key, err)
+		} else {
+			logger.Debugf("Calculated checksum of \"%s\": %s", job.info.Key, checksum)
+			c.calculated = append(c.calculated, job.info.Key)
+		}
+		c.mutex.Unlock()
+	}
+}
+
+// Checksum returns the checksum of the stored object, calculating it
+// if needed, which means reading the whole object.
+func (c *ChecksumCache) Checksum(storage Storage, info *ObjectInfo) (string, error) {
+	if checksum, ok := c.Lookup(info); ok {
+		return checksum, nil
+	}
+
+	object, err := storage.Open(info.Key)
+	if err != nil {
+		return "", err
+	}
+	defer object.Close()
+
+	checksum, err := common.CalculateReaderChecksum(object)
+	if err != nil {
+		return "", err
+	}
+	c.Set(info, checksum)
+
+	return checksum, nil
+}
+
+// Set stores the checksum of an object, which was calculated elsewhere.
+func (c *ChecksumCache) Set(info *ObjectInfo, checksum string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries[info.Key] = checksumEntry{info.Size, info.Modified, checksum}
+}
+
+// Forget removes key from the cache.
+func (c *ChecksumCache) Forget(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.entries, key)
+}
+
+// ErrChecksumMismatch is returned when a checksum file doesn't match the
+// files it was uploaded with
+var ErrChecksumMismatch = errors.New("checksum file does not match")
+
+// verifyChecksumFiles checks the checksum files among files, a map from
+// file name to path, against the checksums of the other files uploaded
+// with them, a map from file name to SHA-256 checksum.  Each checksum
+// file must cover at least one of those files, if there are any.
+func verifyChecksumFiles(files map[string]string, checksums map[string]string) error {
+	// Files that checksum files are supposed to cover
+	covered := 0
+	for name := range files {
+		if !common.IsChecksumFile(name) {
+			covered++
+		}
+	}
+
+	for name, path := range files {
+		if !common.IsChecksumFile(name) {
+			continue
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		expected, err := common.ParseChecksumFile(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrChecksumMismatch, name, err)
+		}
+
+		verified := 0
+		for fileName, checksum := range expected {
+			actual, ok := checksums[fileName]
+			if !ok || fileName == name {
+				continue
+			}
+			if actual != checksum {
+				return fmt.Errorf("%w: %s lists %s for %s, but it is %s", ErrChecksumMismatch, name, checksum, fileName, actual)
+			}
+			verified++
+		}
+
+		if verified == 0 && covered > 0 {
+			return fmt.Errorf("%w: %s does not list any of the uploaded files", ErrChecksumMismatch, name)
+		}
+	}
+
+	return nil
+}
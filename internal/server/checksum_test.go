@@ -0,0 +1,257 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// SHA-256 of "hello" and "world"
+const (
+	helloChecksum = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	worldChecksum = "486ea46224d1bb4fb680f34f7c9ad96a8f24ec88be73ea8e5a6c65260e9cb8a7"
+)
+
+func TestChecksumCacheBackground(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewLocalStorage(dir)
+	if err := storage.Put("nightly/image.iso", strings.NewReader("hello"), 5); err != nil {
+		t.Fatal(err)
+	}
+	info, err := storage.Stat("nightly/image.iso")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewChecksumCache()
+	notified := make(chan []string, 1)
+	cache.SetListener(func(keys []string) {
+		notified <- keys
+	})
+
+	// Nothing is read in the caller
+	if checksum := cache.Cached(storage, info); checksum != "" {
+		t.Fatalf("Cached() = %q before the calculation", checksum)
+	}
+
+	select {
+	case keys := <-notified:
+		if len(keys) != 1 || keys[0] != "nightly/image.iso" {
+			t.Fatalf("listener called with %v", keys)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("checksum was not calculated")
+	}
+
+	if checksum := cache.Cached(storage, info); checksum != helloChecksum {
+		t.Fatalf("Cached() = %q, want %q", checksum, helloChecksum)
+	}
+
+	// A changed file is calculated again
+	changed := *info
+	changed.Size++
+	if _, ok := cache.Lookup(&changed); ok {
+		t.Fatal("stale entry was returned")
+	}
+}
+
+func TestChecksumCacheMissingFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewLocalStorage(dir)
+
+	cache := NewChecksumCache()
+	called := make(chan struct{}, 1)
+	cache.SetListener(func(keys []string) {
+		called <- struct{}{}
+	})
+
+	info := &ObjectInfo{Key: "nightly/missing.iso", Size: 1, Modified: time.Now()}
+	if checksum := cache.Cached(storage, info); checksum != "" {
+		t.Fatalf("Cached() = %q", checksum)
+	}
+
+	// Wait for the calculation to fail, then it can be requested again
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cache.mutex.Lock()
+		pending := cache.pending[info.Key]
+		cache.mutex.Unlock()
+		if !pending {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("calculation did not end")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case <-called:
+		t.Fatal("listener called for a failed calculation")
+	default:
+	}
+}
+
+func TestVerifyChecksumFiles(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	checksums := map[string]string{"image.iso": helloChecksum, "image.img": worldChecksum}
+
+	tests := []struct {
+		name    string
+		content string
+		valid   bool
+	}{
+		{"all files", helloChecksum + "  image.iso\n" + worldChecksum + "  image.img\n", true},
+		{"some files", "SHA256 (image.iso) = " + helloChecksum + "\n", true},
+		{"other files are ignored", helloChecksum + "  image.iso\n" + worldChecksum + "  other.iso\n", true},
+		{"wrong checksum", worldChecksum + "  image.iso\n", false},
+		{"no uploaded file", helloChecksum + "  other.iso\n", false},
+		{"empty", "", false},
+		{"bad format", "SHA256 (image.iso) " + helloChecksum + "\n", false},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, fmt.Sprintf("sums%d", i))
+			if err := ioutil.WriteFile(path, []byte(test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			files := map[string]string{
+				"image.iso":  filepath.Join(dir, "image.iso"),
+				"image.img":  filepath.Join(dir, "image.img"),
+				"SHA256SUMS": path,
+			}
+			err := verifyChecksumFiles(files, checksums)
+			if test.valid && err != nil {
+				t.Fatalf("verifyChecksumFiles() = %v", err)
+			}
+			if !test.valid && !errors.Is(err, ErrChecksumMismatch) {
+				t.Fatalf("verifyChecksumFiles() = %v, want %v", err, ErrChecksumMismatch)
+			}
+		})
+	}
+}
+
+func TestVerifyChecksumFilesAlone(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// A checksum file uploaded alone has nothing to be checked against
+	path := filepath.Join(dir, "SHA256SUMS")
+	if err := ioutil.WriteFile(path, []byte(helloChecksum+"  image.iso\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyChecksumFiles(map[string]string{"SHA256SUMS": path}, map[string]string{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countingStorage counts how many objects are open at the same time
+type countingStorage struct {
+	Storage
+	mutex sync.Mutex
+	open  int
+	max   int
+	opens map[string]int
+}
+
+type countedObject struct {
+	Object
+	storage *countingStorage
+}
+
+func (s *countingStorage) Open(key string) (Object, error) {
+	object, err := s.Storage.Open(key)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.open++
+	if s.open > s.max {
+		s.max = s.open
+	}
+	s.opens[key]++
+	return &countedObject{Object: object, storage: s}, nil
+}
+
+func (o *countedObject) Close() error {
+	o.storage.mutex.Lock()
+	o.storage.open--
+	o.storage.mutex.Unlock()
+	return o.Object.Close()
+}
+
+func TestChecksumCacheQueue(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	storage := &countingStorage{Storage: NewLocalStorage(dir), opens: map[string]int{}}
+
+	var infos []*ObjectInfo
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("nightly/image%d.iso", i)
+		if err := storage.Put(key, strings.NewReader("hello"), 5); err != nil {
+			t.Fatal(err)
+		}
+		info, err := storage.Stat(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		infos = append(infos, info)
+	}
+
+	cache := NewChecksumCache()
+	notified := make(chan []string, 1)
+	cache.SetListener(func(keys []string) {
+		notified <- keys
+	})
+
+	// Listing the same files again does not queue them twice
+	for i := 0; i < 3; i++ {
+		for _, info := range infos {
+			cache.Cached(storage, info)
+		}
+	}
+
+	keys := map[string]bool{}
+	for len(keys) < len(infos) {
+		select {
+		case batch := <-notified:
+			for _, key := range batch {
+				keys[key] = true
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("checksums of %v were calculated", keys)
+		}
+	}
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	if storage.max != 1 {
+		t.Fatalf("%d files were read at the same time", storage.max)
+	}
+	for key, count := range storage.opens {
+		if count != 1 {
+			t.Fatalf("%s was read %d times", key, count)
+		}
+	}
+	for _, info := range infos {
+		if checksum, ok := cache.Lookup(info); !ok || checksum != helloChecksum {
+			t.Fatalf("checksum of %s is %q", info.Key, checksum)
+		}
+	}
+}
@@ -5,47 +5,203 @@
 package server
 
 import (
-	"os"
-	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/liri-infra/image-manager/internal/logger"
 )
 
-var interval = 7 * 24 * time.Hour
+// storedImage is a file found in a channel
+type storedImage struct {
+	name string
+	info *ObjectInfo
+}
+
+// listStoredImages returns the files published in the channel with
+// the specified key prefix, from the newest to the oldest.
+func listStoredImages(storage Storage, prefix string) ([]*storedImage, error) {
+	var images []*storedImage
+
+	objects, err := storage.List(prefix + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, object := range objects {
+		// Skip hidden directories and incomplete uploads
+		if isHiddenKey(prefix+"/", object.Key) {
+			continue
+		}
+
+		// Skip what the server writes
+		name := strings.TrimPrefix(object.Key, prefix+"/")
+		if isGeneratedFile(name) {
+			continue
+		}
+
+		images = append(images, &storedImage{name, object})
+	}
+
+	sort.SliceStable(images, func(i, j int) bool {
+		return images[i].info.Modified.After(images[j].info.Modified)
+	})
+
+	return images, nil
+}
+
+// expiredBuilds returns the builds that policy wants to remove,
+// builds must be sorted from the newest to the oldest.
+func expiredBuilds(policy *RetentionPolicy, builds []*storedBuild, now time.Time) []*storedBuild {
+	var expired []*storedBuild
+	var totalBytes int64
+	overBudget := false
+
+	index := 0
+	for _, stored := range builds {
+		// Manifests left behind by builds that were removed
+		if len(stored.files) == 0 {
+			expired = append(expired, stored)
+			continue
+		}
+
+		// The newest build is always kept, if requested
+		if index == 0 && policy.KeepNewest {
+			totalBytes += stored.size
+			index++
+			continue
+		}
+
+		remove := false
+		if policy.maxAge > 0 && now.Sub(stored.created) > policy.maxAge {
+			remove = true
+		}
+		if policy.KeepLast > 0 && index >= policy.KeepLast {
+			remove = true
+		}
+		if policy.maxBytes > 0 && (overBudget || totalBytes+stored.size > policy.maxBytes) {
+			// Older builds go away too, even if they would fit
+			overBudget = true
+			remove = true
+		}
+
+		if remove {
+			expired = append(expired, stored)
+		} else {
+			totalBytes += stored.size
+		}
+		index++
+	}
+
+	return expired
+}
+
+// RemovedBuild is a build removed by a cleanup.
+type RemovedBuild struct {
+	ID      string   `json:"id"`
+	Created string   `json:"created"`
+	Size    int64    `json:"size"`
+	Files   []string `json:"files"`
+}
+
+// ChannelCleanup tells what a cleanup removed from a channel.
+type ChannelCleanup struct {
+	Channel    string          `json:"channel"`
+	Removed    []*RemovedBuild `json:"removed"`
+	FreedBytes int64           `json:"freed_bytes"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// CleanupReport tells what a cleanup removed, or would
+// remove in case of a dry run.
+type CleanupReport struct {
+	DryRun     bool              `json:"dry_run"`
+	Channels   []*ChannelCleanup `json:"channels"`
+	FreedBytes int64             `json:"freed_bytes"`
+}
+
+// RemoveOldImages removes builds of the specified imageChannels, according
+// to their retention policy, and updates the channel indexes.  With dryRun
+// nothing is removed, but the report tells what would be.
+func RemoveOldImages(appState *AppState, imageChannels []*ImageChannel, dryRun bool) *CleanupReport {
+	storage := appState.Storage
+
+	report := &CleanupReport{DryRun: dryRun, Channels: []*ChannelCleanup{}}
 
-// RemoveOldImages removes images stored inside archivePath for the specified imageChannels.
-func RemoveOldImages(archivePath string, imageChannels []*ImageChannel) {
 	for _, imageChannel := range imageChannels {
 		// Skip those channels that we don't want to clean up
-		if !imageChannel.Cleanup {
+		policy := imageChannel.RetentionPolicy()
+		if policy == nil {
 			continue
 		}
 
-		channelPath := filepath.Join(archivePath, imageChannel.Path)
+		prefix := channelPrefix(imageChannel)
 		now := time.Now()
 
-		err := filepath.Walk(channelPath,
-			func(walkPath string, info os.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
+		channelReport := &ChannelCleanup{Channel: imageChannel.Name, Removed: []*RemovedBuild{}}
+		report.Channels = append(report.Channels, channelReport)
 
-				if !info.IsDir() {
-					if diff := now.Sub(info.ModTime()); diff > interval {
-						logger.Infof("Deleting %s which is %s old", walkPath, diff)
-						err := os.Remove(walkPath)
-						if err != nil {
-							return err
-						}
-					}
-				}
-
-				return nil
-			})
+		builds, err := loadBuilds(storage, prefix)
+		if err != nil {
+			logger.Errorf("Archive cleanup for channel \"%s\" has failed: %v", imageChannel.Name, err)
+			channelReport.Error = err.Error()
+			continue
+		}
 
+		// Never remove what the latest aliases point to
+		aliases, err := readAliases(storage, prefix)
 		if err != nil {
 			logger.Errorf("Archive cleanup for channel \"%s\" has failed: %v", imageChannel.Name, err)
+			channelReport.Error = err.Error()
+			continue
+		}
+		aliased := aliasedBuilds(aliases)
+
+		for _, stored := range expiredBuilds(policy, builds, now) {
+			if len(stored.files) > 0 && aliased[stored.build.ID] {
+				continue
+			}
+
+			if !dryRun {
+				if len(stored.files) > 0 {
+					logger.Infof("Deleting build %s of channel \"%s\" which is %s old",
+						stored.build.ID, imageChannel.Name, now.Sub(stored.created))
+				}
+				if err := removeBuild(storage, prefix, stored); err != nil {
+					logger.Errorf("Archive cleanup for channel \"%s\" has failed: %v", imageChannel.Name, err)
+					channelReport.Error = err.Error()
+					break
+				}
+			}
+
+			// Nothing to report for a stale manifest
+			if len(stored.files) == 0 {
+				continue
+			}
+
+			removed := &RemovedBuild{
+				ID:      stored.build.ID,
+				Created: stored.created.UTC().Format(time.RFC3339),
+				Size:    stored.size,
+				Files:   []string{},
+			}
+			for _, image := range stored.files {
+				removed.Files = append(removed.Files, image.name)
+			}
+			channelReport.Removed = append(channelReport.Removed, removed)
+			channelReport.FreedBytes += stored.size
 		}
+
+		if len(channelReport.Removed) > 0 && !dryRun {
+			if _, err := UpdateIndex(appState, imageChannel); err != nil {
+				logger.Errorf("Failed to update index of channel \"%s\": %v", imageChannel.Name, err)
+			}
+			appState.Events.Publish(&Event{Type: EventCleanup, Channel: imageChannel.Name, Removed: channelReport.Removed})
+			appState.Metrics.CleanupRemoved(imageChannel.Name, len(channelReport.Removed), channelReport.FreedBytes)
+		}
+
+		report.FreedBytes += channelReport.FreedBytes
 	}
+
+	return report
 }
@@ -0,0 +1,162 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testBuilds returns builds from the newest to the oldest, one per
+// day, each as big as the corresponding size
+func testBuilds(now time.Time, sizes ...int64) []*storedBuild {
+	var builds []*storedBuild
+	for i, size := range sizes {
+		builds = append(builds, &storedBuild{
+			build:   &Build{ID: fmt.Sprintf("b%d", i)},
+			created: now.Add(-time.Duration(i) * 24 * time.Hour),
+			files:   []*storedImage{{name: fmt.Sprintf("image%d.iso", i)}},
+			size:    size,
+		})
+	}
+	return builds
+}
+
+func buildIDs(builds []*storedBuild) []string {
+	ids := []string{}
+	for _, stored := range builds {
+		ids = append(ids, stored.build.ID)
+	}
+	return ids
+}
+
+func TestExpiredBuilds(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		policy  RetentionPolicy
+		sizes   []int64
+		expired []string
+	}{
+		{"no rules", RetentionPolicy{}, []int64{1, 1, 1}, []string{}},
+		{"max age", RetentionPolicy{MaxAge: "36h"}, []int64{1, 1, 1, 1}, []string{"b2", "b3"}},
+		{"max age exactly", RetentionPolicy{MaxAge: "2d"}, []int64{1, 1, 1, 1}, []string{"b3"}},
+		{"keep last", RetentionPolicy{KeepLast: 2}, []int64{1, 1, 1, 1}, []string{"b2", "b3"}},
+		{"keep last more than builds", RetentionPolicy{KeepLast: 10}, []int64{1, 1}, []string{}},
+		{"max bytes", RetentionPolicy{MaxBytes: "10"}, []int64{4, 4, 4, 1}, []string{"b2", "b3"}},
+		{"max bytes fits exactly", RetentionPolicy{MaxBytes: "8"}, []int64{4, 4, 4}, []string{"b2"}},
+		{"newest over budget", RetentionPolicy{MaxBytes: "3"}, []int64{4, 1}, []string{"b0", "b1"}},
+		{"keep newest over budget", RetentionPolicy{MaxBytes: "3", KeepNewest: true}, []int64{4, 1}, []string{"b1"}},
+		{"keep newest too old", RetentionPolicy{MaxAge: "1h", KeepNewest: true}, []int64{1, 1, 1}, []string{"b1", "b2"}},
+		{"keep newest with keep last", RetentionPolicy{KeepLast: 1, KeepNewest: true}, []int64{1, 1, 1}, []string{"b1", "b2"}},
+		{"any rule removes", RetentionPolicy{MaxAge: "5d", KeepLast: 3, MaxBytes: "5"}, []int64{2, 2, 2, 2}, []string{"b2", "b3"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy := test.policy
+			if err := policy.parse(); err != nil {
+				t.Fatal(err)
+			}
+
+			expired := expiredBuilds(&policy, testBuilds(now, test.sizes...), now)
+			if ids := buildIDs(expired); !reflect.DeepEqual(ids, test.expired) {
+				t.Fatalf("expired %v, want %v", ids, test.expired)
+			}
+		})
+	}
+}
+
+func TestExpiredBuildsEmptyManifests(t *testing.T) {
+	now := time.Now()
+	builds := testBuilds(now, 1, 1)
+
+	// A manifest whose files are gone is always removed, and does
+	// not count as a build
+	builds[0].files = nil
+	policy := RetentionPolicy{KeepLast: 1}
+	if err := policy.parse(); err != nil {
+		t.Fatal(err)
+	}
+
+	expired := expiredBuilds(&policy, builds, now)
+	if ids := buildIDs(expired); !reflect.DeepEqual(ids, []string{"b0"}) {
+		t.Fatalf("expired %v, want [b0]", ids)
+	}
+}
+
+func TestRetentionPolicyParse(t *testing.T) {
+	tests := []struct {
+		policy RetentionPolicy
+		valid  bool
+	}{
+		{RetentionPolicy{MaxAge: "3d", KeepLast: 2, MaxBytes: "500G"}, true},
+		{RetentionPolicy{MaxAge: "soon"}, false},
+		{RetentionPolicy{MaxAge: "0h"}, false},
+		{RetentionPolicy{KeepLast: -1}, false},
+		{RetentionPolicy{MaxBytes: "lots"}, false},
+		{RetentionPolicy{MaxBytes: "10000000T"}, false},
+	}
+	for _, test := range tests {
+		policy := test.policy
+		if err := policy.parse(); (err == nil) != test.valid {
+			t.Errorf("parse(%+v) = %v, want valid %v", test.policy, err, test.valid)
+		}
+	}
+}
+
+func TestRemoveOldImages(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	appState := newTestAppState(t, dir)
+	nightly := appState.Config.Channels[0]
+	nightly.Retention = &RetentionPolicy{KeepLast: 1}
+
+	// An older build with its checksum file, and a newer one
+	old := &Build{ID: "20200101T000000-00000001", Created: "2020-01-01T00:00:00Z"}
+	files := map[string]string{"old.iso": "hello", "old.iso.sha256sum": "world"}
+	put := func(key, source string) error {
+		return appState.Storage.Put(key, strings.NewReader(files[source]), int64(len(files[source])))
+	}
+	if err := publishBuild(appState.Storage, "nightly", old, map[string]string{"old.iso": "old.iso", "old.iso.sha256sum": "old.iso.sha256sum"}, put); err != nil {
+		t.Fatal(err)
+	}
+	publishTestBuild(t, appState.Storage, "nightly", "20200102T000000-00000002", map[string]string{"new.iso": "hello", "new.iso.sha256sum": "world"}, nil)
+
+	for _, dryRun := range []bool{true, false} {
+		report := RemoveOldImages(appState, appState.Config.Channels, dryRun)
+		if report.DryRun != dryRun || report.FreedBytes != 10 || len(report.Channels) != 1 {
+			t.Fatalf("report %+v", report)
+		}
+		channelReport := report.Channels[0]
+		if channelReport.Channel != "nightly" || channelReport.FreedBytes != 10 || channelReport.Error != "" || len(channelReport.Removed) != 1 {
+			t.Fatalf("channel report %+v", channelReport)
+		}
+		removed := channelReport.Removed[0]
+		sort.Strings(removed.Files)
+		if removed.ID != old.ID || removed.Created != old.Created || !reflect.DeepEqual(removed.Files, []string{"old.iso", "old.iso.sha256sum"}) {
+			t.Fatalf("removed %+v", removed)
+		}
+
+		// A dry run leaves the files in place
+		_, err := appState.Storage.Stat("nightly/old.iso")
+		if dryRun && err != nil {
+			t.Fatalf("dry run removed old.iso: %v", err)
+		}
+		if !dryRun && !os.IsNotExist(err) {
+			t.Fatalf("old.iso was not removed: %v", err)
+		}
+	}
+
+	images := listTestImages(t, appState)
+	if len(images) != 2 || images[0]["build"] != "20200102T000000-00000002" || images[1]["build"] != "20200102T000000-00000002" {
+		t.Fatalf("images %v", images)
+	}
+}
@@ -5,25 +5,158 @@
 package server
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"time"
 
 	"gopkg.in/yaml.v2"
+
+	"github.com/liri-infra/image-manager/internal/common"
 )
 
+// Images older than this are removed from channels that only set cleanup
+const legacyCleanupAge = "7d"
+
+// RetentionPolicy tells which images of a channel are removed,
+// each rule that is set can remove images.
+type RetentionPolicy struct {
+	// Remove images older than this duration (e.g. "72h" or "3d")
+	MaxAge string `yaml:"max_age,omitempty" json:"max_age,omitempty"`
+	// Keep only the newest images
+	KeepLast int `yaml:"keep_last,omitempty" json:"keep_last,omitempty"`
+	// Remove the oldest images when the channel is bigger than this (e.g. "500G")
+	MaxBytes string `yaml:"max_bytes,omitempty" json:"max_bytes,omitempty"`
+	// Never remove the newest image, regardless of the other rules
+	KeepNewest bool `yaml:"keep_newest,omitempty" json:"keep_newest,omitempty"`
+
+	maxAge   time.Duration
+	maxBytes int64
+}
+
+// parse validates the policy
+func (p *RetentionPolicy) parse() error {
+	if p.MaxAge != "" {
+		maxAge, err := common.ParseDuration(p.MaxAge)
+		if err != nil {
+			return err
+		}
+		if maxAge <= 0 {
+			return fmt.Errorf("max_age must be positive")
+		}
+		p.maxAge = maxAge
+	}
+
+	if p.KeepLast < 0 {
+		return fmt.Errorf("keep_last must not be negative")
+	}
+
+	if p.MaxBytes != "" {
+		maxBytes, err := common.ParseSize(p.MaxBytes)
+		if err != nil {
+			return err
+		}
+		p.maxBytes = maxBytes
+	}
+
+	return nil
+}
+
 // ImageChannel represents a configured channel.
 type ImageChannel struct {
-	Name    string `yaml:"name"`
-	Path    string `yaml:"path"`
-	Cleanup bool   `yaml:"cleanup"`
+	Name      string           `yaml:"name"`
+	Path      string           `yaml:"path"`
+	Cleanup   bool             `yaml:"cleanup,omitempty"`
+	Retention *RetentionPolicy `yaml:"retention,omitempty"`
+	// Files can be downloaded without a token
+	Public bool `yaml:"public,omitempty"`
+}
+
+// RetentionPolicy returns the policy that applies to the channel,
+// or nil if images are never removed.
+func (c *ImageChannel) RetentionPolicy() *RetentionPolicy {
+	if c.Retention != nil {
+		return c.Retention
+	}
+
+	// Configuration files written before retention policies were introduced
+	if c.Cleanup {
+		policy := &RetentionPolicy{MaxAge: legacyCleanupAge}
+		policy.parse()
+		return policy
+	}
+
+	return nil
+}
+
+// BackendConfig selects where the published files are stored.
+type BackendConfig struct {
+	// Either "local" (the default) or "s3"
+	Type string `yaml:"type"`
+	// S3 endpoint URL, defaults to AWS
+	Endpoint string `yaml:"endpoint,omitempty"`
+	Region   string `yaml:"region,omitempty"`
+	Bucket   string `yaml:"bucket,omitempty"`
+	// Keys are stored under this prefix inside the bucket
+	Prefix    string `yaml:"prefix,omitempty"`
+	AccessKey string `yaml:"access_key,omitempty"`
+	SecretKey string `yaml:"secret_key,omitempty"`
+	// Address the bucket in the path rather than in the host name,
+	// as required by most S3-compatible servers
+	PathStyle bool `yaml:"path_style,omitempty"`
+}
+
+// SigningConfig selects the key that signs the SHA256SUMS files.
+type SigningConfig struct {
+	// Either "gpg" or "ssh"
+	Type string `yaml:"type"`
+	// OpenPGP key identifier, or path to the ssh private key
+	Key string `yaml:"key"`
+	// GnuPG home directory, defaults to the one of the user
+	Homedir string `yaml:"homedir,omitempty"`
+}
+
+// TLSConfig enables HTTPS, certificate and key are loaded again
+// when they change.
+type TLSConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// CA bundle that verifies client certificates, enables
+	// authentication with a certificate
+	ClientCA string `yaml:"client_ca,omitempty"`
+}
+
+// MetricsConfig tells who can read the metrics.
+type MetricsConfig struct {
+	// Metrics can be read without a token
+	Public bool `yaml:"public,omitempty"`
+}
+
+// ClientCertificate gives an identity to the clients that authenticate
+// with a certificate, like a token does.
+type ClientCertificate struct {
+	// Distinguished name of the certificate subject, in the RFC 2253
+	// format (e.g. "CN=builder1,O=Lab")
+	Subject     string       `yaml:"subject"`
+	Name        string       `yaml:"name,omitempty"`
+	Channels    []string     `yaml:"channels,omitempty"`
+	Permissions []Permission `yaml:"permissions,omitempty"`
 }
 
 // Config represents the configuration file.
 type Config struct {
 	path       string
-	StorageDir string          `yaml:"storage"`
-	Channels   []*ImageChannel `yaml:"channels"`
-	Tokens     []*Token        `yaml:"tokens"`
+	StorageDir string           `yaml:"storage"`
+	Backend    *BackendConfig   `yaml:"backend,omitempty"`
+	Signing    *SigningConfig   `yaml:"signing,omitempty"`
+	Webhooks   []*WebhookConfig `yaml:"webhooks,omitempty"`
+	TLS        *TLSConfig       `yaml:"tls,omitempty"`
+	Metrics    *MetricsConfig   `yaml:"metrics,omitempty"`
+	// Client certificates accepted in place of a token
+	Certificates []*ClientCertificate `yaml:"certificates,omitempty"`
+	Channels     []*ImageChannel      `yaml:"channels"`
+	Tokens       []*Token             `yaml:"tokens"`
 }
 
 // CreateConfig creates the configuration file
@@ -40,7 +173,7 @@ func CreateConfig(path string) (*Config, error) {
 	return OpenConfig(path)
 }
 
-// OpenConfig opens path
+// OpenConfig opens path and validates it
 func OpenConfig(path string) (*Config, error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -53,16 +186,14 @@ func OpenConfig(path string) (*Config, error) {
 		return nil, err
 	}
 
+	// Unknown keys are most likely typos
 	var config Config
-	if err := yaml.Unmarshal(buf, &config); err != nil {
+	if err := yaml.UnmarshalStrict(buf, &config); err != nil {
 		return nil, err
 	}
 
-	// Default channel relative path is the name
-	for _, channel := range config.Channels {
-		if channel.Path == "" {
-			channel.Path = channel.Name
-		}
+	if err := config.validate(buf); err != nil {
+		return nil, err
 	}
 
 	config.path = path
@@ -70,21 +201,51 @@ func OpenConfig(path string) (*Config, error) {
 	return &config, nil
 }
 
-// Save saves the configuration file
+// FindChannel returns the channel called name or nil if it's not configured.
+func (c *Config) FindChannel(name string) *ImageChannel {
+	for _, channel := range c.Channels {
+		if channel.Name == name {
+			return channel
+		}
+	}
+	return nil
+}
+
+// Save saves the configuration file, replacing it at once so that
+// it is never left half written
 func (c *Config) Save() error {
 	data, err := yaml.Marshal(c)
 	if err != nil {
 		return err
 	}
 
-	file, err := os.Create(c.path)
+	// Write next to the configuration file, rename only works
+	// within the same file system
+	file, err := ioutil.TempFile(filepath.Dir(c.path), "."+filepath.Base(c.path)+".")
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-	if _, err := file.Write(data); err != nil {
+	defer os.Remove(file.Name())
+
+	if err := writeConfigFile(file, data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
 		return err
 	}
 
-	return nil
+	return os.Rename(file.Name(), c.path)
+}
+
+// writeConfigFile writes data to file, which may contain tokens,
+// and makes sure it reached the disk
+func writeConfigFile(file *os.File, data []byte) error {
+	if err := file.Chmod(0600); err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	return file.Sync()
 }
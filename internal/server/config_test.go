@@ -0,0 +1,67 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigSave(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte("storage: /srv/images\nchannels:\n  - name: nightly\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := OpenConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Channels = append(config.Channels, &ImageChannel{Name: "stable", Path: "stable"})
+	if err := config.Save(); err != nil {
+		t.Fatalf("Save() = %v", err)
+	}
+
+	// The file may contain secrets
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Fatalf("mode %o, want 600", mode)
+	}
+
+	saved, err := OpenConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.StorageDir != "/srv/images" || len(saved.Channels) != 2 || saved.Channels[1].Name != "stable" {
+		t.Fatalf("saved configuration %+v", saved)
+	}
+
+	// Only the configuration file is left
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("%d files left in the directory, want 1", len(files))
+	}
+}
+
+func TestConfigSaveFails(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	config := &Config{path: filepath.Join(dir, "missing", "config.yaml")}
+	if err := config.Save(); err == nil {
+		t.Fatal("Save() succeeded in a missing directory")
+	}
+}
@@ -0,0 +1,230 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-chi/chi"
+
+	"github.com/liri-infra/image-manager/internal/logger"
+)
+
+// imageChecksum returns the checksum of the file name, stored in the
+// channel with the specified key prefix.  The checksum recorded in the
+// build manifest is preferred to reading the whole file, which happens
+// in the background: the checksum is empty until it's known.
+func imageChecksum(appState *AppState, prefix, name string, info *ObjectInfo) (string, error) {
+	if checksum, ok := appState.Checksums.Lookup(info); ok {
+		return checksum, nil
+	}
+
+	builds, err := loadBuilds(appState.Storage, prefix)
+	if err != nil {
+		return "", err
+	}
+	if stored := findBuild(builds, "", name); stored != nil {
+		if checksum := stored.build.Checksums[name]; checksum != "" {
+			appState.Checksums.Set(info, checksum)
+			return checksum, nil
+		}
+	}
+
+	return appState.Checksums.Cached(appState.Storage, info), nil
+}
+
+// serveImage sends the file name of a channel to the client, supporting
+// range and conditional requests.
+func serveImage(w http.ResponseWriter, r *http.Request, appState *AppState, imageChannel *ImageChannel, name string) {
+	prefix := channelPrefix(imageChannel)
+	key := path.Join(prefix, name)
+
+	// Only published files can be downloaded
+	if isHiddenKey(prefix+"/", key) {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	info, err := appState.Storage.Stat(key)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "file not found", http.StatusNotFound)
+		} else {
+			logger.Errorf("Failed to find \"%s\": %v", key, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	checksum, err := imageChecksum(appState, prefix, name, info)
+	if err != nil {
+		logger.Errorf("Failed to find checksum of \"%s\": %v", key, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	object, err := appState.Storage.Open(key)
+	if err != nil {
+		logger.Errorf("Failed to open \"%s\": %v", key, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer object.Close()
+
+	// ServeContent handles Range, If-Range, If-None-Match and If-Modified-Since
+	if checksum != "" {
+		w.Header().Set("ETag", fmt.Sprintf("\"%s\"", checksum))
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	http.ServeContent(w, r, path.Base(name), info.Modified, object)
+}
+
+// DownloadImageHandler sends a file stored in a channel.
+func DownloadImageHandler(w http.ResponseWriter, r *http.Request) {
+	appState := appStateFromRequest(w, r)
+	if appState == nil {
+		return
+	}
+
+	// Channel from configuration
+	channelName := chi.URLParam(r, "channel")
+	imageChannel := appState.Config.FindChannel(channelName)
+	if imageChannel == nil {
+		logger.Errorf("Cannot find \"%s\" channel", channelName)
+		http.Error(w, "channel not found", http.StatusNotFound)
+		return
+	}
+
+	if !authorizeFiles(w, r, imageChannel) {
+		return
+	}
+
+	fileName := chi.URLParam(r, "name")
+	if !isValidFileName(fileName) {
+		http.Error(w, "invalid file name", http.StatusUnprocessableEntity)
+		return
+	}
+
+	serveImage(w, r, appState, imageChannel, fileName)
+}
+
+// authorizeFiles returns whether the client can download files of
+// imageChannel, otherwise it replies with an error.  Public channels
+// do not need a token.
+func authorizeFiles(w http.ResponseWriter, r *http.Request, imageChannel *ImageChannel) bool {
+	if imageChannel.Public {
+		return true
+	}
+
+	if IdentityFromContext(r.Context()) == nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return false
+	}
+	return authorize(w, r, PermissionRead, imageChannel.Name)
+}
+
+// FilesHandler serves the files of the channels like a static file
+// server, files of channels that are not public require a token.
+func FilesHandler(w http.ResponseWriter, r *http.Request) {
+	appState := appStateFromRequest(w, r)
+	if appState == nil {
+		return
+	}
+
+	// Channel from configuration
+	channelName := chi.URLParam(r, "channel")
+	imageChannel := appState.Config.FindChannel(channelName)
+	if imageChannel == nil {
+		http.Error(w, "channel not found", http.StatusNotFound)
+		return
+	}
+
+	if !authorizeFiles(w, r, imageChannel) {
+		return
+	}
+
+	// Do not allow to escape the channel directory
+	name := chi.URLParam(r, "*")
+	for _, component := range strings.Split(name, "/") {
+		if !isValidFileName(component) {
+			http.Error(w, "file not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	serveImage(w, r, appState, imageChannel, name)
+}
+
+// redirectToLatest redirects the client to the newest file of the type
+// in the request URL, relative to the channel URL.
+func redirectToLatest(w http.ResponseWriter, r *http.Request, appState *AppState, imageChannel *ImageChannel, channelURL string) {
+	aliases, err := readAliases(appState.Storage, channelPrefix(imageChannel))
+	if err != nil {
+		logger.Errorf("Failed to read aliases of channel \"%s\": %v", imageChannel.Name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	alias, ok := aliases[chi.URLParam(r, "type")]
+	if !ok {
+		http.Error(w, "alias not found", http.StatusNotFound)
+		return
+	}
+
+	// The target changes with every build
+	w.Header().Set("Cache-Control", "no-cache")
+	http.Redirect(w, r, channelURL+(&url.URL{Path: alias.File}).EscapedPath(), http.StatusFound)
+}
+
+// LatestImageHandler redirects to the newest file of a type.
+func LatestImageHandler(w http.ResponseWriter, r *http.Request) {
+	appState := appStateFromRequest(w, r)
+	if appState == nil {
+		return
+	}
+
+	// Channel from configuration
+	channelName := chi.URLParam(r, "channel")
+	imageChannel := appState.Config.FindChannel(channelName)
+	if imageChannel == nil {
+		logger.Errorf("Cannot find \"%s\" channel", channelName)
+		http.Error(w, "channel not found", http.StatusNotFound)
+		return
+	}
+
+	if !authorizeFiles(w, r, imageChannel) {
+		return
+	}
+
+	redirectToLatest(w, r, appState, imageChannel, strings.TrimSuffix(r.URL.Path, "latest/"+chi.URLParam(r, "type"))+"images/")
+}
+
+// LatestFileHandler redirects to the newest file of a type
+// in the static file server.
+func LatestFileHandler(w http.ResponseWriter, r *http.Request) {
+	appState := appStateFromRequest(w, r)
+	if appState == nil {
+		return
+	}
+
+	// Channel from configuration
+	channelName := chi.URLParam(r, "channel")
+	imageChannel := appState.Config.FindChannel(channelName)
+	if imageChannel == nil {
+		http.Error(w, "channel not found", http.StatusNotFound)
+		return
+	}
+
+	if !authorizeFiles(w, r, imageChannel) {
+		return
+	}
+
+	redirectToLatest(w, r, appState, imageChannel, strings.TrimSuffix(r.URL.Path, "latest/"+chi.URLParam(r, "type")))
+}
@@ -0,0 +1,205 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestDownload stores "hello" as image.iso in the nightly channel,
+// its checksum is known only if known is set
+func newTestDownload(t *testing.T, dir string, known bool) (*AppState, *ImageChannel, time.Time) {
+	storage := NewLocalStorage(dir)
+	if err := storage.Put("nightly/image.iso", strings.NewReader("hello"), 5); err != nil {
+		t.Fatal(err)
+	}
+
+	modified := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(dir, "nightly", "image.iso"), modified, modified); err != nil {
+		t.Fatal(err)
+	}
+
+	appState := &AppState{Storage: storage, Checksums: NewChecksumCache()}
+	if known {
+		info, err := storage.Stat("nightly/image.iso")
+		if err != nil {
+			t.Fatal(err)
+		}
+		appState.Checksums.Set(info, helloChecksum)
+	}
+
+	return appState, &ImageChannel{Name: "nightly", Path: "nightly"}, modified
+}
+
+func TestServeImage(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	appState, imageChannel, modified := newTestDownload(t, dir, true)
+
+	etag := "\"" + helloChecksum + "\""
+	before := modified.Add(-time.Hour).Format(http.TimeFormat)
+	after := modified.Add(time.Hour).Format(http.TimeFormat)
+
+	tests := []struct {
+		name         string
+		method       string
+		header       map[string]string
+		status       int
+		body         string
+		contentRange string
+	}{
+		{"whole file", http.MethodGet, nil, http.StatusOK, "hello", ""},
+		{"head", http.MethodHead, nil, http.StatusOK, "", ""},
+		{"range", http.MethodGet, map[string]string{"Range": "bytes=1-3"}, http.StatusPartialContent, "ell", "bytes 1-3/5"},
+		{"open range", http.MethodGet, map[string]string{"Range": "bytes=2-"}, http.StatusPartialContent, "llo", "bytes 2-4/5"},
+		{"suffix range", http.MethodGet, map[string]string{"Range": "bytes=-2"}, http.StatusPartialContent, "lo", "bytes 3-4/5"},
+		{"unsatisfiable range", http.MethodGet, map[string]string{"Range": "bytes=10-"}, http.StatusRequestedRangeNotSatisfiable, "", "bytes */5"},
+		{"matching etag", http.MethodGet, map[string]string{"If-None-Match": etag}, http.StatusNotModified, "", ""},
+		{"other etag", http.MethodGet, map[string]string{"If-None-Match": "\"other\""}, http.StatusOK, "hello", ""},
+		{"any etag", http.MethodGet, map[string]string{"If-None-Match": "*"}, http.StatusNotModified, "", ""},
+		{"not modified", http.MethodGet, map[string]string{"If-Modified-Since": after}, http.StatusNotModified, "", ""},
+		{"modified", http.MethodGet, map[string]string{"If-Modified-Since": before}, http.StatusOK, "hello", ""},
+		{"etag wins over date", http.MethodGet, map[string]string{"If-None-Match": "\"other\"", "If-Modified-Since": after}, http.StatusOK, "hello", ""},
+		{"if-range matches", http.MethodGet, map[string]string{"Range": "bytes=1-3", "If-Range": etag}, http.StatusPartialContent, "ell", "bytes 1-3/5"},
+		{"if-range does not match", http.MethodGet, map[string]string{"Range": "bytes=1-3", "If-Range": "\"other\""}, http.StatusOK, "hello", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, "/channels/nightly/images/image.iso", nil)
+			for name, value := range test.header {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			serveImage(w, r, appState, imageChannel, "image.iso")
+
+			if w.Code != test.status {
+				t.Fatalf("status %d, want %d", w.Code, test.status)
+			}
+			if body := w.Body.String(); test.body != "" && body != test.body {
+				t.Fatalf("body %q, want %q", body, test.body)
+			}
+			if value := w.Header().Get("Content-Range"); value != test.contentRange {
+				t.Fatalf("Content-Range %q, want %q", value, test.contentRange)
+			}
+			if value := w.Header().Get("ETag"); value != etag {
+				t.Fatalf("ETag %q, want %q", value, etag)
+			}
+			if test.status == http.StatusOK {
+				if value := w.Header().Get("Last-Modified"); value != modified.Format(http.TimeFormat) {
+					t.Fatalf("Last-Modified %q", value)
+				}
+				if value := w.Header().Get("Accept-Ranges"); value != "bytes" {
+					t.Fatalf("Accept-Ranges %q", value)
+				}
+			}
+		})
+	}
+}
+
+func TestServeImageUnknownChecksum(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	appState, imageChannel, _ := newTestDownload(t, dir, false)
+	calculated := make(chan struct{}, 1)
+	appState.Checksums.SetListener(func(keys []string) {
+		calculated <- struct{}{}
+	})
+
+	// The download does not wait for the checksum
+	r := httptest.NewRequest(http.MethodGet, "/channels/nightly/images/image.iso", nil)
+	r.Header.Set("If-None-Match", "\""+helloChecksum+"\"")
+	w := httptest.NewRecorder()
+	serveImage(w, r, appState, imageChannel, "image.iso")
+	if w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Fatalf("status %d, body %q", w.Code, w.Body.String())
+	}
+	if value := w.Header().Get("ETag"); value != "" {
+		t.Fatalf("ETag %q before the checksum is known", value)
+	}
+
+	select {
+	case <-calculated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("checksum was not calculated")
+	}
+
+	w = httptest.NewRecorder()
+	serveImage(w, r, appState, imageChannel, "image.iso")
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("status %d once the checksum is known, want %d", w.Code, http.StatusNotModified)
+	}
+}
+
+func TestServeImageHidden(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	appState, imageChannel, _ := newTestDownload(t, dir, true)
+	for _, key := range []string{"nightly/image.iso.part", "nightly/.build.json"} {
+		if err := appState.Storage.Put(key, strings.NewReader("hello"), 5); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"image.iso.part", ".build.json", "missing.iso"} {
+		r := httptest.NewRequest(http.MethodGet, "/channels/nightly/images/"+name, nil)
+		w := httptest.NewRecorder()
+		serveImage(w, r, appState, imageChannel, name)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: status %d, want %d", name, w.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestDownloadAnonymous(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	appState := newTestAppState(t, dir)
+	appState.Config.Channels[0].Public = true
+	for _, prefix := range []string{"nightly", "stable"} {
+		publishTestBuild(t, appState.Storage, prefix, "20200101T000000-00000001", map[string]string{"image.iso": "hello"}, nil)
+	}
+	handler := router(NewSharedState(appState))
+
+	tests := []struct {
+		name     string
+		target   string
+		token    string
+		status   int
+		location string
+	}{
+		{"public image", "/api/v1/channels/nightly/images/image.iso", "", http.StatusOK, ""},
+		{"public alias", "/api/v1/channels/nightly/latest/iso", "", http.StatusFound, "/api/v1/channels/nightly/images/image.iso"},
+		{"private image", "/api/v1/channels/stable/images/image.iso", "", http.StatusUnauthorized, ""},
+		{"private alias", "/api/v1/channels/stable/latest/iso", "", http.StatusUnauthorized, ""},
+		{"invalid token", "/api/v1/channels/nightly/images/image.iso", "wrong", http.StatusUnauthorized, ""},
+		{"listing", "/api/v1/channels/nightly/images", "", http.StatusUnauthorized, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, test.target, nil)
+			if test.token != "" {
+				r.Header.Set("Authorization", "BEARER "+test.token)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, test.status, w.Body.String())
+			}
+			if test.status == http.StatusOK && w.Body.String() != "hello" {
+				t.Fatalf("body %q", w.Body.String())
+			}
+			if location := w.Header().Get("Location"); location != test.location {
+				t.Fatalf("location %q, want %q", location, test.location)
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/liri-infra/image-manager/internal/logger"
+)
+
+// Number of events kept in memory for clients that resume a stream
+const eventHistorySize = 1000
+
+// Events that a stream client did not receive yet, when there are
+// more the client is disconnected
+const eventQueueSize = 100
+
+// Stream clients receive a comment this often, so that proxies
+// do not close idle connections
+const eventKeepAlive = 30 * time.Second
+
+// EventType tells what happened
+type EventType string
+
+// Available event types
+const (
+	EventUploadStart     EventType = "upload_start"
+	EventChecksumFailure EventType = "checksum_failure"
+	EventPublish         EventType = "publish"
+	EventDelete          EventType = "delete"
+	EventPromote         EventType = "promote"
+	EventCleanup         EventType = "cleanup"
+)
+
+// isValidEventType returns whether eventType is known
+func isValidEventType(eventType EventType) bool {
+	switch eventType {
+	case EventUploadStart, EventChecksumFailure, EventPublish, EventDelete, EventPromote, EventCleanup:
+		return true
+	}
+	return false
+}
+
+// Event describes a change to a channel.
+type Event struct {
+	ID      uint64          `json:"id"`
+	Type    EventType       `json:"type"`
+	Channel string          `json:"channel"`
+	Time    string          `json:"time"`
+	Actor   string          `json:"actor,omitempty"`
+	Build   *Build          `json:"build,omitempty"`
+	Removed []*RemovedBuild `json:"removed,omitempty"`
+	// Details of upload events
+	BuildID string `json:"build_id,omitempty"`
+	File    string `json:"file,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// EventBus delivers events to the listeners.
+type EventBus struct {
+	mutex       sync.Mutex
+	lastID      uint64
+	listeners   []func(*Event)
+	history     []*Event
+	subscribers map[chan *Event]bool
+}
+
+// NewEventBus creates an event bus without listeners.
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: map[chan *Event]bool{}}
+}
+
+// Listen calls listener for each event, it must not block.
+func (b *EventBus) Listen(listener func(*Event)) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.listeners = append(b.listeners, listener)
+}
+
+// Publish assigns an identifier to event and delivers it, it does
+// nothing when there is no event bus.
+func (b *EventBus) Publish(event *Event) {
+	if b == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.lastID++
+	event.ID = b.lastID
+	event.Time = time.Now().UTC().Format(time.RFC3339)
+
+	b.history = append(b.history, event)
+	if len(b.history) > eventHistorySize {
+		b.history = b.history[len(b.history)-eventHistorySize:]
+	}
+
+	for _, listener := range b.listeners {
+		listener(event)
+	}
+
+	for events := range b.subscribers {
+		select {
+		case events <- event:
+		default:
+			// Too slow, it can resume from the last event received
+			delete(b.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// Close disconnects all the subscribers, it does nothing when
+// there is no event bus.
+func (b *EventBus) Close() {
+	if b == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for events := range b.subscribers {
+		delete(b.subscribers, events)
+		close(events)
+	}
+}
+
+// Subscribe returns the events published after lastID that are still
+// in memory, and a channel that receives the next ones until cancel
+// is called.  The channel is closed if the subscriber falls behind.
+func (b *EventBus) Subscribe(lastID uint64) ([]*Event, <-chan *Event, func()) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var backlog []*Event
+	if lastID > 0 {
+		for _, event := range b.history {
+			// Identifiers start over when the server is restarted
+			if event.ID > lastID || lastID > b.lastID {
+				backlog = append(backlog, event)
+			}
+		}
+	}
+
+	events := make(chan *Event, eventQueueSize)
+	b.subscribers[events] = true
+
+	cancel := func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+
+		if b.subscribers[events] {
+			delete(b.subscribers, events)
+			close(events)
+		}
+	}
+
+	return backlog, events, cancel
+}
+
+// writeEvent sends event to a stream client
+func writeEvent(w http.ResponseWriter, event *Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
+
+// EventsHandler streams the events of the channels the client can
+// read, as server-sent events.  Clients that reconnect with the
+// Last-Event-ID header receive the events they missed.
+func EventsHandler(w http.ResponseWriter, r *http.Request) {
+	appState := appStateFromRequest(w, r)
+	if appState == nil {
+		return
+	}
+
+	if appState.Events == nil {
+		http.Error(w, "events are not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var lastID uint64
+	if value := r.Header.Get("Last-Event-ID"); value != "" {
+		var err error
+		if lastID, err = strconv.ParseUint(value, 10, 64); err != nil {
+			http.Error(w, "invalid Last-Event-ID header", http.StatusBadRequest)
+			return
+		}
+	}
+
+	identity := IdentityFromContext(r.Context())
+	backlog, events, cancel := appState.Events.Subscribe(lastID)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	logger.Debugf("Streaming events to \"%s\" from %d", identityName(r), lastID)
+
+	send := func(event *Event) bool {
+		if identity == nil || !identity.Can(PermissionRead, event.Channel) {
+			return true
+		}
+		if err := writeEvent(w, event); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+
+	for _, event := range backlog {
+		if !send(event) {
+			return
+		}
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok || !send(event) {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := w.Write([]byte(": keep-alive\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,188 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func eventIDs(events []*Event) []uint64 {
+	ids := []uint64{}
+	for _, event := range events {
+		ids = append(ids, event.ID)
+	}
+	return ids
+}
+
+// publishEvents publishes count events to the channel
+func publishEvents(bus *EventBus, channel string, count int) {
+	for i := 0; i < count; i++ {
+		bus.Publish(&Event{Type: EventPublish, Channel: channel})
+	}
+}
+
+func TestEventBusSubscribe(t *testing.T) {
+	tests := []struct {
+		name    string
+		lastID  uint64
+		backlog []uint64
+	}{
+		{"no header", 0, []uint64{}},
+		{"missed events", 2, []uint64{3, 4, 5}},
+		{"up to date", 5, []uint64{}},
+		{"server restarted", 10, []uint64{1, 2, 3, 4, 5}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bus := NewEventBus()
+			publishEvents(bus, "nightly", 5)
+
+			backlog, events, cancel := bus.Subscribe(test.lastID)
+			defer cancel()
+			if ids := eventIDs(backlog); !reflect.DeepEqual(ids, test.backlog) {
+				t.Fatalf("backlog %v, want %v", ids, test.backlog)
+			}
+
+			// Then the new events follow
+			publishEvents(bus, "nightly", 1)
+			if event := <-events; event.ID != 6 {
+				t.Fatalf("received event %d, want 6", event.ID)
+			}
+		})
+	}
+}
+
+func TestEventBusHistory(t *testing.T) {
+	bus := NewEventBus()
+	publishEvents(bus, "nightly", eventHistorySize+5)
+
+	// Only the most recent events are kept
+	backlog, _, cancel := bus.Subscribe(1)
+	defer cancel()
+	if len(backlog) != eventHistorySize || backlog[0].ID != 6 {
+		t.Fatalf("backlog of %d events from %d", len(backlog), backlog[0].ID)
+	}
+}
+
+func TestEventBusSlowSubscriber(t *testing.T) {
+	bus := NewEventBus()
+	_, events, cancel := bus.Subscribe(0)
+	defer cancel()
+
+	publishEvents(bus, "nightly", eventQueueSize+1)
+
+	// The queued events are received, then the channel is closed
+	var last uint64
+	for event := range events {
+		last = event.ID
+	}
+	if last != eventQueueSize {
+		t.Fatalf("last event %d, want %d", last, eventQueueSize)
+	}
+
+	// It resumes from the last event received
+	backlog, _, cancelResume := bus.Subscribe(last)
+	defer cancelResume()
+	if ids := eventIDs(backlog); !reflect.DeepEqual(ids, []uint64{eventQueueSize + 1}) {
+		t.Fatalf("backlog %v", ids)
+	}
+}
+
+func TestEventBusCancel(t *testing.T) {
+	bus := NewEventBus()
+	_, events, cancel := bus.Subscribe(0)
+	cancel()
+	cancel()
+	if _, ok := <-events; ok {
+		t.Fatal("channel is open after cancel")
+	}
+
+	_, events, cancel = bus.Subscribe(0)
+	defer cancel()
+	bus.Close()
+	if _, ok := <-events; ok {
+		t.Fatal("channel is open after close")
+	}
+
+	// Nothing happens without an event bus
+	var none *EventBus
+	none.Publish(&Event{})
+	none.Close()
+}
+
+// readEventIDs reads count events from a stream, returns their identifiers
+func readEventIDs(t *testing.T, scanner *bufio.Scanner, count int) []string {
+	ids := []string{}
+	for len(ids) < count && scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "id: ") {
+			ids = append(ids, strings.TrimPrefix(line, "id: "))
+		}
+	}
+	if len(ids) < count {
+		t.Fatalf("stream ended after %v: %v", ids, scanner.Err())
+	}
+	return ids
+}
+
+func TestEventsHandlerResume(t *testing.T) {
+	bus := NewEventBus()
+	appState := &AppState{Events: bus}
+	identity := &Identity{Name: "reader", Channels: []string{"nightly"}, Permissions: []Permission{PermissionRead}}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), KeyAppState, appState)
+		ctx = context.WithValue(ctx, KeyIdentity, identity)
+		EventsHandler(w, r.WithContext(ctx))
+	}))
+	defer server.Close()
+
+	// Events 1-2 for nightly, 3 for stable, 4 for nightly
+	publishEvents(bus, "nightly", 2)
+	publishEvents(bus, "stable", 1)
+	publishEvents(bus, "nightly", 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if value := resp.Header.Get("Content-Type"); value != "text/event-stream" {
+		t.Fatalf("Content-Type %q", value)
+	}
+
+	// Missed events of the channels that can be read, then the new ones
+	scanner := bufio.NewScanner(resp.Body)
+	if ids := readEventIDs(t, scanner, 2); !reflect.DeepEqual(ids, []string{"2", "4"}) {
+		t.Fatalf("backlog %v, want [2 4]", ids)
+	}
+	publishEvents(bus, "stable", 1)
+	publishEvents(bus, "nightly", 1)
+	if ids := readEventIDs(t, scanner, 1); !reflect.DeepEqual(ids, []string{"6"}) {
+		t.Fatalf("received %v, want [6]", ids)
+	}
+}
+
+func TestEventsHandlerInvalidLastEventID(t *testing.T) {
+	appState := &AppState{Events: NewEventBus()}
+	r := newTestRequest(appState, http.MethodGet, "/api/v1/events", nil, nil)
+	r.Header.Set("Last-Event-ID", "last")
+	w := httptest.NewRecorder()
+	EventsHandler(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
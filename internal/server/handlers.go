@@ -6,13 +6,17 @@ package server
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
 
@@ -20,35 +24,46 @@ import (
 	"github.com/liri-infra/image-manager/internal/logger"
 )
 
+// isValidFileName returns whether name can be safely stored inside a channel,
+// names of hidden files and of files being written are not.
+func isValidFileName(name string) bool {
+	if name == "" || !isPublished(name) {
+		return false
+	}
+	return !strings.ContainsAny(name, "/\\")
+}
+
 // UploadHandler receives files from the client.
 func UploadHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
 	// Get from context
-	ctx := r.Context()
-	appState, ok := ctx.Value(KeyAppState).(*AppState)
-	if !ok {
-		logger.Error("Unable to retrieve app state from context")
-		http.Error(w, "no app state found", http.StatusUnprocessableEntity)
+	appState := appStateFromRequest(w, r)
+	if appState == nil {
 		return
 	}
 
+	// Record the outcome in the metrics
+	tracker := newUploadTracker(w, r, appState.Metrics)
+	w = tracker.writer
+	defer tracker.done()
+
 	// Get the channel name from the query string
 	channelName := chi.URLParam(r, "channel")
 
 	// Channel from configuration
-	var imageChannel *ImageChannel
-	for _, c := range appState.Config.Channels {
-		if c.Name == channelName {
-			imageChannel = c
-			break
-		}
-	}
+	imageChannel := appState.Config.FindChannel(channelName)
 	if imageChannel == nil {
 		logger.Errorf("Cannot find \"%s\" channel", channelName)
 		http.Error(w, "channel not found", http.StatusNotFound)
 		return
 	}
+	tracker.channel = imageChannel.Name
+
+	// Check whether the token covers this channel
+	if !authorize(w, r, PermissionUpload, imageChannel.Name) {
+		return
+	}
 
 	var mr *multipart.Reader
 	var part *multipart.Part
@@ -63,6 +78,26 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 	// Save checksums here for later comparison
 	checksums := map[string]string{}
 
+	// All the files of this request belong to the same build
+	prefix := channelPrefix(imageChannel)
+	buildID, err := NewBuildID()
+	if err != nil {
+		logger.Errorf("Failed to create build: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Files are staged until all of them are received and verified,
+	// anything left here was not published
+	stagingPath := filepath.Join(appState.Config.StorageDir, stagingDir, buildID)
+	if err := os.MkdirAll(stagingPath, 0755); err != nil {
+		logger.Errorf("Failed to create staging directory: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(stagingPath)
+	files := map[string]string{}
+
 	// Read all parts
 	for {
 		if part, err = mr.NextPart(); err != nil {
@@ -81,28 +116,42 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 			fileName := part.FileName()
 			logger.Debugf("Receiving \"%s\"...", fileName)
 
-			// Destination path
-			destPath := filepath.Join(appState.Config.StorageDir, imageChannel.Path, fileName)
-			tempPath := destPath + ".part"
+			// Do not allow to escape the channel directory
+			if !isValidFileName(fileName) {
+				logger.Errorf("Cannot upload: invalid file name \"%s\"", fileName)
+				http.Error(w, "invalid file name", http.StatusUnprocessableEntity)
+				return
+			}
+
+			// Do not allow to replace the files written by the server
+			if isGeneratedFile(fileName) {
+				logger.Errorf("Cannot upload: reserved file name \"%s\"", fileName)
+				http.Error(w, "reserved file name", http.StatusUnprocessableEntity)
+				return
+			}
 
 			// Do not allow to overwrite existing files
-			if _, err := os.Stat(destPath); os.IsExist(err) {
+			if _, err := appState.Storage.Stat(path.Join(prefix, fileName)); err == nil || files[fileName] != "" {
 				err = fmt.Errorf("file \"%s\" already exist", fileName)
 				logger.Errorf("Cannot upload: %v", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
 			}
 
-			// Create the destination file
+			appState.Events.Publish(&Event{Type: EventUploadStart, Channel: imageChannel.Name, Actor: identityName(r), BuildID: buildID, File: fileName})
+
+			// Create the staged file
+			tempPath := filepath.Join(stagingPath, fileName)
 			file, err := os.Create(tempPath)
 			if err != nil {
 				logger.Errorf("Unable to create %s: %v", fileName, err)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-			defer file.Close()
 
 			// Write file and calculate checksum for a verification later
 			if _, err = io.Copy(file, part); err != nil {
+				file.Close()
 				logger.Errorf("Failed to copy part to \"%s\": %v", fileName, err)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
@@ -115,13 +164,7 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 			checksums[fileName] = checksum
-
-			// Rename the temporary file
-			if err := os.Rename(tempPath, destPath); err != nil {
-				logger.Errorf("Failed to rename \"%s\" to \"%s\": %v", tempPath, destPath, err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+			files[fileName] = tempPath
 		} else if part.FormName() == "checksum" {
 			// Read checksum calculate by the client
 			value := &bytes.Buffer{}
@@ -144,10 +187,13 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			// If the checksum doesn't match we remove the file and report the error,
-			// so that the next time the file will be uploaded again
+			// If the checksum doesn't match we report the error and nothing
+			// is published, so that the next time the files will be uploaded again
 			if checksums[fileName] != checksum {
 				logger.Errorf("Object \"%s\" has a bad checksum (%s vs %s)", fileName, checksums[fileName], checksum)
+				appState.Events.Publish(&Event{Type: EventChecksumFailure, Channel: imageChannel.Name, Actor: identityName(r),
+					BuildID: buildID, File: fileName, Error: "bad checksum"})
+				tracker.reason = FailureChecksumMismatch
 				http.Error(w, fmt.Sprintf("bad checksum for %s", fileName), http.StatusUnprocessableEntity)
 				return
 			}
@@ -157,4 +203,656 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+
+	if len(files) == 0 {
+		logger.Error("Cannot upload: no files received")
+		http.Error(w, "no files received", http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Checksum files must match the images they were uploaded with
+	if err := verifyChecksumFiles(files, checksums); err != nil {
+		logger.Errorf("Cannot upload build %s: %v", buildID, err)
+		appState.Events.Publish(&Event{Type: EventChecksumFailure, Channel: imageChannel.Name, Actor: identityName(r),
+			BuildID: buildID, Error: err.Error()})
+		tracker.reason = FailureChecksumMismatch
+		publishError(w, err)
+		return
+	}
+
+	// Publish all the files at once
+	build := &Build{
+		ID:        buildID,
+		Created:   time.Now().UTC().Format(time.RFC3339),
+		Uploader:  identityName(r),
+		Checksums: checksums,
+	}
+	if err := publishBuild(appState.Storage, prefix, build, files, appState.Storage.PutFile); err != nil {
+		logger.Errorf("Failed to publish build %s: %v", buildID, err)
+		publishError(w, err)
+		return
+	}
+	for _, tempPath := range files {
+		if info, err := os.Stat(tempPath); err == nil {
+			tracker.size += info.Size()
+		}
+	}
+
+	updateIndex(appState, imageChannel)
+	appState.Events.Publish(&Event{Type: EventPublish, Channel: imageChannel.Name, Actor: identityName(r), Build: build})
+
+	logger.Infof("Published build %s (%s) on channel \"%s\"", buildID, strings.Join(build.Files, ", "), imageChannel.Name)
+	EncodeJSONReply(w, r, build)
+}
+
+// publishError replies to the client with an error that
+// matches the publishing error.
+func publishError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrFileExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+	} else if errors.Is(err, ErrChecksumMismatch) || errors.Is(err, ErrReservedFileName) {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	} else {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// sessionError replies to the client with an error that
+// matches the session manager error.
+func sessionError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrSessionNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrSessionBusy), errors.Is(err, ErrBadOffset), errors.Is(err, ErrDuplicateFile):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrIncomplete), errors.Is(err, ErrBadChecksum):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// authorizeSession returns whether the client can operate on session,
+// that is only allowed to whoever created it and to administrators,
+// otherwise it replies with an error.
+func authorizeSession(w http.ResponseWriter, r *http.Request, session *UploadSession) bool {
+	if !authorize(w, r, PermissionUpload, session.Channel) {
+		return false
+	}
+
+	// Do not tell others that the session exists
+	identity := IdentityFromContext(r.Context())
+	if session.Uploader != identity.Name && !identity.Can(PermissionAdmin, session.Channel) {
+		logger.Errorf("Upload session %s does not belong to \"%s\"", session.ID, identity.Name)
+		sessionError(w, ErrSessionNotFound)
+		return false
+	}
+	return true
+}
+
+// CreateSessionHandler creates a resumable upload session.
+func CreateSessionHandler(w http.ResponseWriter, r *http.Request) {
+	appState := appStateFromRequest(w, r)
+	if appState == nil {
+		return
+	}
+
+	// Channel from configuration
+	channelName := chi.URLParam(r, "channel")
+	imageChannel := appState.Config.FindChannel(channelName)
+	if imageChannel == nil {
+		logger.Errorf("Cannot find \"%s\" channel", channelName)
+		http.Error(w, "channel not found", http.StatusNotFound)
+		return
+	}
+
+	// Check whether the token covers this channel
+	if !authorize(w, r, PermissionUpload, imageChannel.Name) {
+		return
+	}
+
+	var request struct {
+		FileName string `json:"file_name"`
+		Size     int64  `json:"size"`
+		Build    string `json:"build"`
+		Checksum string `json:"checksum"`
+	}
+	if err := DecodeJSONBody(w, r, &request); err != nil {
+		HandleDecodeError(w, err)
+		return
+	}
+
+	if !isValidFileName(request.FileName) || request.Size < 0 {
+		logger.Errorf("Cannot create upload session for \"%s\": invalid request", request.FileName)
+		http.Error(w, "invalid file name or size", http.StatusUnprocessableEntity)
+		return
+	}
+	if isGeneratedFile(request.FileName) {
+		logger.Errorf("Cannot create upload session for \"%s\": reserved file name", request.FileName)
+		http.Error(w, "reserved file name", http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Files uploaded with the same build identifier belong together,
+	// the first one starts a new build
+	if request.Build != "" && !isValidBuildID(request.Build) {
+		logger.Errorf("Cannot create upload session for \"%s\": invalid build", request.FileName)
+		http.Error(w, "invalid build", http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Do not allow to overwrite existing files
+	if _, err := appState.Storage.Stat(path.Join(channelPrefix(imageChannel), request.FileName)); err == nil {
+		logger.Errorf("Cannot upload: file \"%s\" already exist", request.FileName)
+		http.Error(w, fmt.Sprintf("file \"%s\" already exist", request.FileName), http.StatusConflict)
+		return
+	}
+
+	session, err := appState.Sessions.Create(imageChannel.Name, request.Build, request.FileName, request.Size,
+		request.Checksum, identityName(r))
+	if err != nil {
+		logger.Errorf("Failed to create upload session for \"%s\": %v", request.FileName, err)
+		sessionError(w, err)
+		return
+	}
+
+	if session.Offset == 0 {
+		appState.Events.Publish(&Event{Type: EventUploadStart, Channel: imageChannel.Name, Actor: identityName(r),
+			BuildID: session.Build, File: session.FileName, Size: session.Size})
+	}
+
+	logger.Debugf("Upload session %s for \"%s\" is at offset %d", session.ID, session.FileName, session.Offset)
+	EncodeJSONReply(w, r, session)
+}
+
+// GetSessionHandler returns an upload session and its committed offset.
+func GetSessionHandler(w http.ResponseWriter, r *http.Request) {
+	appState := appStateFromRequest(w, r)
+	if appState == nil {
+		return
+	}
+
+	session, err := appState.Sessions.Get(chi.URLParam(r, "id"))
+	if err != nil {
+		sessionError(w, err)
+		return
+	}
+	if !authorizeSession(w, r, session) {
+		return
+	}
+
+	EncodeJSONReply(w, r, session)
+}
+
+// WriteSessionHandler appends the request body to an upload session,
+// the Upload-Offset header must match the committed offset.
+func WriteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	appState := appStateFromRequest(w, r)
+	if appState == nil {
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "missing or invalid Upload-Offset header", http.StatusBadRequest)
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+	session, err := appState.Sessions.Get(id)
+	if err != nil {
+		sessionError(w, err)
+		return
+	}
+	if !authorizeSession(w, r, session) {
+		return
+	}
+
+	session, err = appState.Sessions.Write(id, offset, r.Body)
+	if err != nil {
+		if session != nil {
+			logger.Errorf("Upload of \"%s\" interrupted at offset %d: %v", session.FileName, session.Offset, err)
+		}
+		sessionError(w, err)
+		return
+	}
+
+	EncodeJSONReply(w, r, session)
+}
+
+// FinalizeSessionHandler verifies a complete upload session, which
+// is then published along with its build.
+func FinalizeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	appState := appStateFromRequest(w, r)
+	if appState == nil {
+		return
+	}
+
+	var request struct {
+		Checksum string `json:"checksum"`
+	}
+	if err := DecodeJSONBody(w, r, &request); err != nil {
+		HandleDecodeError(w, err)
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+	session, err := appState.Sessions.Get(id)
+	if err != nil {
+		sessionError(w, err)
+		return
+	}
+	if !authorizeSession(w, r, session) {
+		return
+	}
+
+	if session, err = appState.Sessions.Finalize(id, request.Checksum); err != nil {
+		logger.Errorf("Failed to finalize upload session %s: %v", id, err)
+		if errors.Is(err, ErrBadChecksum) {
+			appState.Events.Publish(&Event{Type: EventChecksumFailure, Channel: session.Channel, Actor: identityName(r),
+				BuildID: session.Build, File: session.FileName, Size: session.Size, Error: err.Error()})
+			appState.Metrics.UploadFailed(session.Channel, FailureChecksumMismatch)
+		}
+		sessionError(w, err)
+		return
+	}
+
+	logger.Infof("Received \"%s\" for build %s on channel \"%s\"", session.FileName, session.Build, session.Channel)
+	EncodeJSONReply(w, r, session)
+}
+
+// PublishBuildHandler publishes all the files uploaded for a build,
+// or none of them if something goes wrong.
+func PublishBuildHandler(w http.ResponseWriter, r *http.Request) {
+	appState := appStateFromRequest(w, r)
+	if appState == nil {
+		return
+	}
+
+	// Record the outcome in the metrics
+	tracker := newUploadTracker(w, r, appState.Metrics)
+	w = tracker.writer
+	defer tracker.done()
+
+	// Channel from configuration
+	channelName := chi.URLParam(r, "channel")
+	imageChannel := appState.Config.FindChannel(channelName)
+	if imageChannel == nil {
+		logger.Errorf("Cannot find \"%s\" channel", channelName)
+		http.Error(w, "channel not found", http.StatusNotFound)
+		return
+	}
+	tracker.channel = imageChannel.Name
+
+	if !authorize(w, r, PermissionUpload, imageChannel.Name) {
+		return
+	}
+
+	prefix := channelPrefix(imageChannel)
+	build := &Build{
+		ID:        chi.URLParam(r, "id"),
+		Created:   time.Now().UTC().Format(time.RFC3339),
+		Uploader:  identityName(r),
+		Checksums: map[string]string{},
+	}
+
+	sessions, err := appState.Sessions.Publish(imageChannel.Name, build.ID,
+		func(sessions []*UploadSession, files map[string]string) error {
+			// Builds are published by whoever uploaded them
+			identity := IdentityFromContext(r.Context())
+			for _, session := range sessions {
+				if session.Uploader != identity.Name && !identity.Can(PermissionAdmin, imageChannel.Name) {
+					return ErrSessionNotFound
+				}
+			}
+
+			// Checksum files must match the images they were uploaded with
+			for _, session := range sessions {
+				build.Checksums[session.FileName] = session.Checksum
+			}
+			if err := verifyChecksumFiles(files, build.Checksums); err != nil {
+				return err
+			}
+
+			return publishBuild(appState.Storage, prefix, build, files, appState.Storage.PutFile)
+		})
+	if err != nil {
+		logger.Errorf("Failed to publish build %s: %v", build.ID, err)
+
+		// These files cannot be published, the build must be uploaded again
+		if errors.Is(err, ErrChecksumMismatch) {
+			appState.Events.Publish(&Event{Type: EventChecksumFailure, Channel: imageChannel.Name, Actor: identityName(r),
+				BuildID: build.ID, Error: err.Error()})
+			tracker.reason = FailureChecksumMismatch
+			for _, session := range sessions {
+				appState.Sessions.Abort(session.ID)
+			}
+		}
+
+		if errors.Is(err, ErrFileExists) || errors.Is(err, ErrChecksumMismatch) || errors.Is(err, ErrReservedFileName) {
+			publishError(w, err)
+		} else {
+			sessionError(w, err)
+		}
+		return
+	}
+
+	// The upload started with the first session
+	for _, session := range sessions {
+		tracker.size += session.Size
+		if created, err := time.Parse(time.RFC3339, session.Created); err == nil && created.Before(tracker.start) {
+			tracker.start = created
+		}
+	}
+
+	updateIndex(appState, imageChannel)
+	appState.Events.Publish(&Event{Type: EventPublish, Channel: imageChannel.Name, Actor: identityName(r), Build: build})
+
+	logger.Infof("Published build %s (%s) on channel \"%s\"", build.ID, strings.Join(build.Files, ", "), imageChannel.Name)
+	EncodeJSONReply(w, r, build)
+}
+
+// AbortSessionHandler discards an upload session.
+func AbortSessionHandler(w http.ResponseWriter, r *http.Request) {
+	appState := appStateFromRequest(w, r)
+	if appState == nil {
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+	session, err := appState.Sessions.Get(id)
+	if err != nil {
+		sessionError(w, err)
+		return
+	}
+	if !authorizeSession(w, r, session) {
+		return
+	}
+
+	if err := appState.Sessions.Abort(id); err != nil {
+		sessionError(w, err)
+		return
+	}
+
+	EncodeJSONReply(w, r, struct{}{})
+}
+
+// ListChannelsHandler returns the channels that the client can read.
+func ListChannelsHandler(w http.ResponseWriter, r *http.Request) {
+	appState := appStateFromRequest(w, r)
+	if appState == nil {
+		return
+	}
+
+	identity := IdentityFromContext(r.Context())
+
+	channels := []*ChannelInfo{}
+	for _, imageChannel := range appState.Config.Channels {
+		if identity != nil && identity.Can(PermissionRead, imageChannel.Name) {
+			channels = append(channels, newChannelInfo(imageChannel, identity))
+		}
+	}
+
+	EncodeJSONReply(w, r, channels)
+}
+
+// ListImagesHandler returns the files stored in a channel.
+func ListImagesHandler(w http.ResponseWriter, r *http.Request) {
+	appState := appStateFromRequest(w, r)
+	if appState == nil {
+		return
+	}
+
+	// Channel from configuration
+	channelName := chi.URLParam(r, "channel")
+	imageChannel := appState.Config.FindChannel(channelName)
+	if imageChannel == nil {
+		logger.Errorf("Cannot find \"%s\" channel", channelName)
+		http.Error(w, "channel not found", http.StatusNotFound)
+		return
+	}
+
+	if !authorize(w, r, PermissionRead, imageChannel.Name) {
+		return
+	}
+
+	images, err := ListImages(appState.Storage, imageChannel, appState.Checksums)
+	if err != nil {
+		logger.Errorf("Failed to list channel \"%s\": %v", imageChannel.Name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	EncodeJSONReply(w, r, images)
+}
+
+// deleteBuild removes the build id, or the build that contains
+// fileName, from the channel in the request URL.
+func deleteBuild(w http.ResponseWriter, r *http.Request, id, fileName string) {
+	appState := appStateFromRequest(w, r)
+	if appState == nil {
+		return
+	}
+
+	// Channel from configuration
+	channelName := chi.URLParam(r, "channel")
+	imageChannel := appState.Config.FindChannel(channelName)
+	if imageChannel == nil {
+		logger.Errorf("Cannot find \"%s\" channel", channelName)
+		http.Error(w, "channel not found", http.StatusNotFound)
+		return
+	}
+
+	if !authorize(w, r, PermissionDelete, imageChannel.Name) {
+		return
+	}
+
+	prefix := channelPrefix(imageChannel)
+	builds, err := loadBuilds(appState.Storage, prefix)
+	if err != nil {
+		logger.Errorf("Failed to list channel \"%s\": %v", imageChannel.Name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	stored := findBuild(builds, id, fileName)
+	if stored == nil || len(stored.files) == 0 {
+		http.Error(w, "build not found", http.StatusNotFound)
+		return
+	}
+
+	if err := removeBuild(appState.Storage, prefix, stored); err != nil {
+		logger.Errorf("Failed to delete build %s: %v", stored.build.ID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	removed := &RemovedBuild{
+		ID:      stored.build.ID,
+		Created: stored.created.UTC().Format(time.RFC3339),
+		Size:    stored.size,
+		Files:   []string{},
+	}
+	for _, image := range stored.files {
+		appState.Checksums.Forget(image.info.Key)
+		removed.Files = append(removed.Files, image.name)
+	}
+
+	updateIndex(appState, imageChannel)
+	appState.Events.Publish(&Event{Type: EventDelete, Channel: imageChannel.Name, Actor: identityName(r), Removed: []*RemovedBuild{removed}})
+
+	logger.Infof("Deleted build %s (%s) from channel \"%s\" on behalf of \"%s\"",
+		stored.build.ID, strings.Join(removed.Files, ", "), imageChannel.Name, identityName(r))
+	EncodeJSONReply(w, r, removed)
+}
+
+// DeleteImageHandler removes a file from a channel, along with
+// the other files of its build.
+func DeleteImageHandler(w http.ResponseWriter, r *http.Request) {
+	fileName := chi.URLParam(r, "name")
+	if !isValidFileName(fileName) {
+		logger.Errorf("Cannot delete: invalid file name \"%s\"", fileName)
+		http.Error(w, "invalid file name", http.StatusUnprocessableEntity)
+		return
+	}
+
+	deleteBuild(w, r, "", fileName)
+}
+
+// DeleteBuildHandler removes a build from a channel.
+func DeleteBuildHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		http.Error(w, "build not found", http.StatusNotFound)
+		return
+	}
+
+	deleteBuild(w, r, id, "")
+}
+
+// ListBuildsHandler returns the builds stored in a channel.
+func ListBuildsHandler(w http.ResponseWriter, r *http.Request) {
+	appState := appStateFromRequest(w, r)
+	if appState == nil {
+		return
+	}
+
+	// Channel from configuration
+	channelName := chi.URLParam(r, "channel")
+	imageChannel := appState.Config.FindChannel(channelName)
+	if imageChannel == nil {
+		logger.Errorf("Cannot find \"%s\" channel", channelName)
+		http.Error(w, "channel not found", http.StatusNotFound)
+		return
+	}
+
+	if !authorize(w, r, PermissionRead, imageChannel.Name) {
+		return
+	}
+
+	builds, err := ListBuilds(appState.Storage, imageChannel, appState.Checksums)
+	if err != nil {
+		logger.Errorf("Failed to list channel \"%s\": %v", imageChannel.Name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	EncodeJSONReply(w, r, builds)
+}
+
+// ListAliasesHandler returns the latest aliases of a channel.
+func ListAliasesHandler(w http.ResponseWriter, r *http.Request) {
+	appState := appStateFromRequest(w, r)
+	if appState == nil {
+		return
+	}
+
+	// Channel from configuration
+	channelName := chi.URLParam(r, "channel")
+	imageChannel := appState.Config.FindChannel(channelName)
+	if imageChannel == nil {
+		logger.Errorf("Cannot find \"%s\" channel", channelName)
+		http.Error(w, "channel not found", http.StatusNotFound)
+		return
+	}
+
+	if !authorize(w, r, PermissionRead, imageChannel.Name) {
+		return
+	}
+
+	aliases, err := readAliases(appState.Storage, channelPrefix(imageChannel))
+	if err != nil {
+		logger.Errorf("Failed to read aliases of channel \"%s\": %v", imageChannel.Name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	EncodeJSONReply(w, r, aliases)
+}
+
+// PromoteBuildHandler copies a build to the channel in the "to"
+// query parameter, without uploading it again.
+func PromoteBuildHandler(w http.ResponseWriter, r *http.Request) {
+	appState := appStateFromRequest(w, r)
+	if appState == nil {
+		return
+	}
+
+	// Channels from configuration
+	channelName := chi.URLParam(r, "channel")
+	imageChannel := appState.Config.FindChannel(channelName)
+	if imageChannel == nil {
+		logger.Errorf("Cannot find \"%s\" channel", channelName)
+		http.Error(w, "channel not found", http.StatusNotFound)
+		return
+	}
+	targetName := r.URL.Query().Get("to")
+	targetChannel := appState.Config.FindChannel(targetName)
+	if targetChannel == nil {
+		logger.Errorf("Cannot find \"%s\" channel", targetName)
+		http.Error(w, "target channel not found", http.StatusNotFound)
+		return
+	}
+	if targetChannel == imageChannel {
+		http.Error(w, "cannot promote to the same channel", http.StatusUnprocessableEntity)
+		return
+	}
+
+	if !authorize(w, r, PermissionRead, imageChannel.Name) || !authorize(w, r, PermissionUpload, targetChannel.Name) {
+		return
+	}
+
+	builds, err := loadBuilds(appState.Storage, channelPrefix(imageChannel))
+	if err != nil {
+		logger.Errorf("Failed to list channel \"%s\": %v", imageChannel.Name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	stored := findBuild(builds, chi.URLParam(r, "id"), "")
+	if stored == nil || len(stored.files) == 0 {
+		http.Error(w, "build not found", http.StatusNotFound)
+		return
+	}
+
+	build := &Build{
+		ID:        stored.build.ID,
+		Created:   time.Now().UTC().Format(time.RFC3339),
+		Uploader:  identityName(r),
+		Checksums: map[string]string{},
+		PromotedFrom: &Provenance{
+			Channel:  imageChannel.Name,
+			Build:    stored.build.ID,
+			Created:  stored.created.UTC().Format(time.RFC3339),
+			Uploader: stored.build.Uploader,
+		},
+	}
+
+	// Checksums are copied along with the files
+	files := map[string]string{}
+	for _, image := range stored.files {
+		checksum := stored.build.Checksums[image.name]
+		if checksum == "" {
+			checksum = appState.Checksums.Cached(appState.Storage, image.info)
+		}
+		if checksum != "" {
+			build.Checksums[image.name] = checksum
+		}
+		files[image.name] = image.info.Key
+	}
+
+	if err := publishBuild(appState.Storage, channelPrefix(targetChannel), build, files, appState.Storage.Copy); err != nil {
+		logger.Errorf("Failed to promote build %s to channel \"%s\": %v", build.ID, targetChannel.Name, err)
+		publishError(w, err)
+		return
+	}
+
+	updateIndex(appState, targetChannel)
+	appState.Events.Publish(&Event{Type: EventPromote, Channel: targetChannel.Name, Actor: identityName(r), Build: build})
+
+	logger.Infof("Promoted build %s from channel \"%s\" to \"%s\" on behalf of \"%s\"",
+		build.ID, imageChannel.Name, targetChannel.Name, identityName(r))
+	EncodeJSONReply(w, r, build)
 }
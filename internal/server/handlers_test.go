@@ -0,0 +1,426 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+)
+
+// newTestAppState returns the state of a server that stores the
+// nightly and stable channels in dir
+func newTestAppState(t *testing.T, dir string) *AppState {
+	sessions, err := NewSessionManager(filepath.Join(dir, ".sessions"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &AppState{
+		Config: &Config{
+			StorageDir: dir,
+			Channels: []*ImageChannel{
+				{Name: "nightly", Path: "nightly"},
+				{Name: "stable", Path: "stable"},
+			},
+		},
+		Storage:   NewLocalStorage(dir),
+		Sessions:  sessions,
+		Checksums: NewChecksumCache(),
+	}
+}
+
+// newTestRequest returns a request handled on behalf of an
+// administrator, with the URL parameters of the route
+func newTestRequest(appState *AppState, method, target string, body io.Reader, params map[string]string) *http.Request {
+	r := httptest.NewRequest(method, target, body)
+
+	rctx := chi.NewRouteContext()
+	for name, value := range params {
+		rctx.URLParams.Add(name, value)
+	}
+
+	identity := &Identity{Name: "admin", Permissions: []Permission{PermissionAdmin}}
+	ctx := context.WithValue(r.Context(), chi.RouteCtxKey, rctx)
+	ctx = context.WithValue(ctx, KeyAppState, appState)
+	ctx = context.WithValue(ctx, KeyIdentity, identity)
+	return r.WithContext(ctx)
+}
+
+func TestIsGeneratedFile(t *testing.T) {
+	tests := []struct {
+		name      string
+		generated bool
+	}{
+		{"index.json", true},
+		{"SHA256SUMS", true},
+		{"SHA256SUMS.asc", true},
+		{"SHA256SUMS.sig", true},
+		{"SHA256SUMS.gpg", false},
+		{"image.iso", false},
+		{"image.iso.sha256sum", false},
+		{"index.json.asc", false},
+	}
+	for _, test := range tests {
+		if generated := isGeneratedFile(test.name); generated != test.generated {
+			t.Errorf("isGeneratedFile(%q) = %v, want %v", test.name, generated, test.generated)
+		}
+	}
+}
+
+func TestCreateSessionReservedName(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	appState := newTestAppState(t, dir)
+
+	tests := []struct {
+		name   string
+		status int
+	}{
+		{"index.json", http.StatusUnprocessableEntity},
+		{"SHA256SUMS", http.StatusUnprocessableEntity},
+		{"SHA256SUMS.asc", http.StatusUnprocessableEntity},
+		{"SHA256SUMS.sig", http.StatusUnprocessableEntity},
+		{"image.iso.part", http.StatusUnprocessableEntity},
+		{"image.iso", http.StatusOK},
+	}
+	for _, test := range tests {
+		body := `{"file_name": "` + test.name + `", "size": 5}`
+		r := newTestRequest(appState, http.MethodPost, "/api/v1/channels/nightly/sessions",
+			strings.NewReader(body), map[string]string{"channel": "nightly"})
+		w := httptest.NewRecorder()
+		CreateSessionHandler(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s: status %d, want %d: %s", test.name, w.Code, test.status, w.Body.String())
+		}
+	}
+}
+
+func TestUploadReservedName(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	appState := newTestAppState(t, dir)
+
+	for _, name := range []string{"index.json", "SHA256SUMS", "SHA256SUMS.asc", "SHA256SUMS.sig", "image.iso.part"} {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		part, err := mw.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte("hello"))
+		mw.Close()
+
+		r := newTestRequest(appState, http.MethodPost, "/api/v1/upload/nightly",
+			&body, map[string]string{"channel": "nightly"})
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		UploadHandler(w, r)
+
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: status %d, want %d", name, w.Code, http.StatusUnprocessableEntity)
+		}
+		if _, err := appState.Storage.Stat("nightly/" + name); !os.IsNotExist(err) {
+			t.Errorf("%s was stored", name)
+		}
+	}
+}
+
+func TestPublishBuildReservedName(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewLocalStorage(dir)
+
+	source := filepath.Join(dir, "source")
+	if err := ioutil.WriteFile(source, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"index.json", "SHA256SUMS", "SHA256SUMS.asc", "SHA256SUMS.sig"} {
+		files := map[string]string{"image.iso": source, name: source}
+		err := publishBuild(storage, "nightly", &Build{ID: "build"}, files, storage.PutFile)
+		if !errors.Is(err, ErrReservedFileName) {
+			t.Fatalf("%s: publishBuild() = %v, want %v", name, err, ErrReservedFileName)
+		}
+		for _, key := range []string{"nightly/image.iso", "nightly/" + name, manifestKey("nightly", "build")} {
+			if _, err := storage.Stat(key); !os.IsNotExist(err) {
+				t.Errorf("%s: %s was stored", name, key)
+			}
+		}
+	}
+}
+
+// withIdentity returns r handled on behalf of identity
+func withIdentity(r *http.Request, identity *Identity) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), KeyIdentity, identity))
+}
+
+func TestSessionOwner(t *testing.T) {
+	owner := &Identity{Name: "ci", Permissions: []Permission{PermissionUpload}}
+	other := &Identity{Name: "someone", Permissions: []Permission{PermissionUpload}}
+	admin := &Identity{Name: "admin", Permissions: []Permission{PermissionAdmin}}
+
+	handlers := []struct {
+		name    string
+		method  string
+		body    string
+		handler http.HandlerFunc
+	}{
+		{"get", http.MethodGet, "", GetSessionHandler},
+		{"write", http.MethodPut, "hello", WriteSessionHandler},
+		{"finalize", http.MethodPost, "{}", FinalizeSessionHandler},
+		{"abort", http.MethodDelete, "", AbortSessionHandler},
+	}
+	tests := []struct {
+		name     string
+		identity *Identity
+		status   int
+	}{
+		{"owner", owner, http.StatusOK},
+		{"other uploader", other, http.StatusNotFound},
+		{"administrator", admin, http.StatusOK},
+	}
+	for _, handler := range handlers {
+		for _, test := range tests {
+			t.Run(handler.name+" by "+test.name, func(t *testing.T) {
+				dir := tempDir(t)
+				defer os.RemoveAll(dir)
+				appState := newTestAppState(t, dir)
+
+				session, err := appState.Sessions.Create("nightly", "", "image.iso", 5, "", owner.Name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if handler.name == "finalize" {
+					if session, err = appState.Sessions.Write(session.ID, 0, strings.NewReader("hello")); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				r := newTestRequest(appState, handler.method, "/api/v1/sessions/"+session.ID,
+					strings.NewReader(handler.body), map[string]string{"id": session.ID})
+				r.Header.Set("Upload-Offset", "0")
+				w := httptest.NewRecorder()
+				handler.handler(w, withIdentity(r, test.identity))
+
+				if w.Code != test.status {
+					t.Fatalf("status %d, want %d: %s", w.Code, test.status, w.Body.String())
+				}
+				if test.status != http.StatusOK {
+					if current, err := appState.Sessions.Get(session.ID); err != nil || current.Offset != session.Offset || current.Complete {
+						t.Fatalf("session was changed: %+v, %v", current, err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestPublishBuildOwner(t *testing.T) {
+	tests := []struct {
+		name     string
+		identity *Identity
+		status   int
+	}{
+		{"other uploader", &Identity{Name: "someone", Permissions: []Permission{PermissionUpload}}, http.StatusNotFound},
+		{"owner", &Identity{Name: "ci", Permissions: []Permission{PermissionUpload}}, http.StatusOK},
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	appState := newTestAppState(t, dir)
+
+	session, err := appState.Sessions.Create("nightly", "", "image.iso", 5, "", "ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := appState.Sessions.Write(session.ID, 0, strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := appState.Sessions.Finalize(session.ID, helloChecksum); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		r := newTestRequest(appState, http.MethodPost, "/api/v1/upload/nightly/builds/"+session.Build+"/publish",
+			nil, map[string]string{"channel": "nightly", "id": session.Build})
+		w := httptest.NewRecorder()
+		PublishBuildHandler(w, withIdentity(r, test.identity))
+
+		if w.Code != test.status {
+			t.Fatalf("%s: status %d, want %d: %s", test.name, w.Code, test.status, w.Body.String())
+		}
+	}
+	if data := readTestObject(t, appState.Storage, "nightly/image.iso"); data != "hello" {
+		t.Fatalf("published file contains %q", data)
+	}
+}
+
+func TestDeleteImageHandler(t *testing.T) {
+	reader := &Identity{Name: "ci", Permissions: []Permission{PermissionRead, PermissionUpload}}
+	deleter := &Identity{Name: "ci", Channels: []string{"nightly"}, Permissions: []Permission{PermissionDelete}}
+
+	tests := []struct {
+		name     string
+		identity *Identity
+		file     string
+		status   int
+	}{
+		{"without permission", reader, "image.iso", http.StatusForbidden},
+		{"unknown file", deleter, "missing.iso", http.StatusNotFound},
+		{"invalid name", deleter, ".hidden", http.StatusUnprocessableEntity},
+		{"whole build", deleter, "image.iso", http.StatusOK},
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	appState := newTestAppState(t, dir)
+
+	publishTestBuild(t, appState.Storage, "nightly", "20200101T000000-00000001",
+		map[string]string{"image.iso": "hello", "image.iso.sha256sum": helloChecksum + "  image.iso\n"}, nil)
+	publishTestBuild(t, appState.Storage, "nightly", "20200102T000000-00000002",
+		map[string]string{"other.iso": "world"}, nil)
+
+	for _, test := range tests {
+		r := newTestRequest(appState, http.MethodDelete, "/api/v1/channels/nightly/images/"+test.file,
+			nil, map[string]string{"channel": "nightly", "name": test.file})
+		w := httptest.NewRecorder()
+		DeleteImageHandler(w, withIdentity(r, test.identity))
+
+		if w.Code != test.status {
+			t.Fatalf("%s: status %d, want %d: %s", test.name, w.Code, test.status, w.Body.String())
+		}
+	}
+
+	// The checksum file goes along with the image, the other build stays
+	images := listTestImages(t, appState)
+	if len(images) != 1 || images[0]["name"] != "other.iso" {
+		t.Fatalf("images %v", images)
+	}
+	if _, err := appState.Storage.Stat(manifestKey("nightly", "20200101T000000-00000001")); !os.IsNotExist(err) {
+		t.Fatalf("manifest was not removed: %v", err)
+	}
+}
+
+func TestDeleteBuildHandler(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	appState := newTestAppState(t, dir)
+
+	id := "20200101T000000-00000001"
+	publishTestBuild(t, appState.Storage, "nightly", id,
+		map[string]string{"image.iso": "hello", "image.iso.sha256sum": "world"}, nil)
+
+	deleteBuild := func() *httptest.ResponseRecorder {
+		r := newTestRequest(appState, http.MethodDelete, "/api/v1/channels/nightly/builds/"+id,
+			nil, map[string]string{"channel": "nightly", "id": id})
+		w := httptest.NewRecorder()
+		DeleteBuildHandler(w, r)
+		return w
+	}
+
+	w := deleteBuild()
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	var removed RemovedBuild
+	if err := json.Unmarshal(w.Body.Bytes(), &removed); err != nil {
+		t.Fatal(err)
+	}
+	if removed.ID != id || removed.Size != 10 || len(removed.Files) != 2 {
+		t.Fatalf("removed %+v", removed)
+	}
+	if images := listTestImages(t, appState); len(images) != 0 {
+		t.Fatalf("images %v", images)
+	}
+
+	// The build is gone
+	if w := deleteBuild(); w.Code != http.StatusNotFound {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestPromoteBuildHandler(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	appState := newTestAppState(t, dir)
+
+	id := "20200101T000000-00000001"
+	published := publishTestBuild(t, appState.Storage, "nightly", id,
+		map[string]string{"image.iso": "hello", "image.iso.sha256sum": "world"},
+		map[string]string{"image.iso": helloChecksum})
+
+	promote := func(id, target string, identity *Identity) *httptest.ResponseRecorder {
+		r := newTestRequest(appState, http.MethodPost, "/api/v1/channels/nightly/builds/"+id+"/promote?to="+target,
+			nil, map[string]string{"channel": "nightly", "id": id})
+		w := httptest.NewRecorder()
+		PromoteBuildHandler(w, withIdentity(r, identity))
+		return w
+	}
+
+	admin := &Identity{Name: "admin", Permissions: []Permission{PermissionAdmin}}
+	tests := []struct {
+		name     string
+		id       string
+		target   string
+		identity *Identity
+		status   int
+	}{
+		{"same channel", id, "nightly", admin, http.StatusUnprocessableEntity},
+		{"unknown channel", id, "beta", admin, http.StatusNotFound},
+		{"unknown build", "20200101T000000-00000002", "stable", admin, http.StatusNotFound},
+		{"without upload permission", id, "stable", &Identity{Name: "ci", Channels: []string{"nightly"}, Permissions: []Permission{PermissionRead, PermissionUpload}}, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		if w := promote(test.id, test.target, test.identity); w.Code != test.status {
+			t.Fatalf("%s: status %d, want %d: %s", test.name, w.Code, test.status, w.Body.String())
+		}
+	}
+
+	w := promote(id, "stable", admin)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+
+	// Files and checksums are copied, and the build tells where it comes from
+	for name, content := range map[string]string{"image.iso": "hello", "image.iso.sha256sum": "world"} {
+		if data := readTestObject(t, appState.Storage, "stable/"+name); data != content {
+			t.Fatalf("stable/%s contains %q", name, data)
+		}
+		if data := readTestObject(t, appState.Storage, "nightly/"+name); data != content {
+			t.Fatalf("nightly/%s contains %q", name, data)
+		}
+	}
+	build, err := readBuild(appState.Storage, "stable", id)
+	if err != nil || build == nil {
+		t.Fatalf("manifest %v, %v", build, err)
+	}
+	if build.Checksums["image.iso"] != helloChecksum || build.Uploader != "admin" {
+		t.Fatalf("build %+v", build)
+	}
+	expected := &Provenance{Channel: "nightly", Build: id, Created: published.Created, Uploader: "ci"}
+	if !reflect.DeepEqual(build.PromotedFrom, expected) {
+		t.Fatalf("promoted from %+v, want %+v", build.PromotedFrom, expected)
+	}
+
+	// The build is already there
+	if w := promote(id, "stable", admin); w.Code != http.StatusConflict {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusConflict)
+	}
+}
@@ -0,0 +1,155 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+
+	"github.com/liri-infra/image-manager/internal/logger"
+)
+
+// The index is stored in this file, inside the channel directory
+const indexFile = "index.json"
+
+// Serializes index updates, so that the last one written is up to date
+var indexMutex sync.Mutex
+
+// ChannelIndex lists everything stored in a channel, for websites,
+// updaters and mirrors.
+type ChannelIndex struct {
+	Channel string       `json:"channel"`
+	Updated string       `json:"updated"`
+	Builds  []*BuildInfo `json:"builds"`
+}
+
+// isGeneratedFile returns whether name, relative to the channel
+// directory, is written by the server rather than uploaded
+func isGeneratedFile(name string) bool {
+	if name == indexFile || name == sumsFile {
+		return true
+	}
+	for _, ext := range signatureExtensions {
+		if name == sumsFile+ext {
+			return true
+		}
+	}
+	return false
+}
+
+func indexKey(prefix string) string {
+	return path.Join(prefix, indexFile)
+}
+
+// UpdateIndex writes the index and the SHA256SUMS file of imageChannel,
+// it has to be called every time builds are published or removed.
+func UpdateIndex(appState *AppState, imageChannel *ImageChannel) (*ChannelIndex, error) {
+	indexMutex.Lock()
+	defer indexMutex.Unlock()
+
+	prefix := channelPrefix(imageChannel)
+	builds, err := ListBuilds(appState.Storage, imageChannel, appState.Checksums)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeSums(appState.Storage, prefix, appState.Config.Signing, builds); err != nil {
+		return nil, err
+	}
+
+	var size int64
+	for _, build := range builds {
+		size += build.Size
+	}
+	appState.Metrics.SetStorageUsage(imageChannel.Name, size, len(builds))
+
+	index := &ChannelIndex{
+		Channel: imageChannel.Name,
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Builds:  builds,
+	}
+
+	buf, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeObject(appState.Storage, indexKey(prefix), buf); err != nil {
+		return nil, err
+	}
+
+	return index, nil
+}
+
+// updateIndex writes the index of imageChannel after a change,
+// failures are only logged because the change was already made.
+func updateIndex(appState *AppState, imageChannel *ImageChannel) {
+	if _, err := UpdateIndex(appState, imageChannel); err != nil {
+		logger.Errorf("Failed to update index of channel \"%s\": %v", imageChannel.Name, err)
+	}
+}
+
+// ChannelIndexHandler returns the index of a channel.
+func ChannelIndexHandler(w http.ResponseWriter, r *http.Request) {
+	appState := appStateFromRequest(w, r)
+	if appState == nil {
+		return
+	}
+
+	// Channel from configuration
+	channelName := chi.URLParam(r, "channel")
+	imageChannel := appState.Config.FindChannel(channelName)
+	if imageChannel == nil {
+		logger.Errorf("Cannot find \"%s\" channel", channelName)
+		http.Error(w, "channel not found", http.StatusNotFound)
+		return
+	}
+
+	if !authorize(w, r, PermissionRead, imageChannel.Name) {
+		return
+	}
+
+	buf, err := readObject(appState.Storage, indexKey(channelPrefix(imageChannel)))
+	if err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(buf)
+		return
+	}
+
+	// Not written yet
+	if !os.IsNotExist(err) {
+		logger.Errorf("Failed to read index of channel \"%s\": %v", imageChannel.Name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	index, err := UpdateIndex(appState, imageChannel)
+	if err != nil {
+		logger.Errorf("Failed to update index of channel \"%s\": %v", imageChannel.Name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	EncodeJSONReply(w, r, index)
+}
+
+// refreshIndexes updates the index of the channels that contain
+// any of keys, whose checksum became known.
+func refreshIndexes(appState *AppState, keys []string) {
+	for _, imageChannel := range appState.Config.Channels {
+		prefix := channelPrefix(imageChannel) + "/"
+		for _, key := range keys {
+			if strings.HasPrefix(key, prefix) {
+				updateIndex(appState, imageChannel)
+				break
+			}
+		}
+	}
+}
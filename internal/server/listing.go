@@ -0,0 +1,144 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// ChannelInfo describes a channel to API clients.
+type ChannelInfo struct {
+	Name      string           `json:"name"`
+	Cleanup   bool             `json:"cleanup"`
+	Retention *RetentionPolicy `json:"retention,omitempty"`
+	Public    bool             `json:"public"`
+	// Only administrators see where files are stored
+	Path string `json:"path,omitempty"`
+}
+
+// newChannelInfo describes imageChannel to identity.
+func newChannelInfo(imageChannel *ImageChannel, identity *Identity) *ChannelInfo {
+	policy := imageChannel.RetentionPolicy()
+	info := &ChannelInfo{
+		Name:      imageChannel.Name,
+		Cleanup:   policy != nil,
+		Retention: policy,
+		Public:    imageChannel.Public,
+	}
+	if identity != nil && identity.Can(PermissionAdmin, "") {
+		info.Path = imageChannel.Path
+	}
+	return info
+}
+
+// ImageInfo describes a stored file to API clients.
+type ImageInfo struct {
+	Name     string `json:"name"`
+	Build    string `json:"build"`
+	Size     int64  `json:"size"`
+	Modified string `json:"mtime"`
+	SHA256   string `json:"sha256,omitempty"`
+	// Set while the checksum is calculated in the background
+	ChecksumPending bool `json:"checksum_pending,omitempty"`
+}
+
+// BuildInfo describes a build to API clients.
+type BuildInfo struct {
+	ID       string       `json:"id"`
+	Created  string       `json:"created"`
+	Uploader string       `json:"uploader,omitempty"`
+	Size     int64        `json:"size"`
+	Files    []*ImageInfo `json:"files"`
+	// Set when the build was promoted from another channel
+	PromotedFrom *Provenance `json:"promoted_from,omitempty"`
+}
+
+// isPublished returns whether a file found in a channel directory
+// is visible, as opposed to hidden or incomplete.
+func isPublished(name string) bool {
+	return !strings.HasPrefix(name, ".") && !strings.HasSuffix(name, ".part")
+}
+
+// newBuildInfo describes stored to API clients.
+func newBuildInfo(storage Storage, stored *storedBuild, checksums *ChecksumCache) (*BuildInfo, error) {
+	info := &BuildInfo{
+		ID:           stored.build.ID,
+		Created:      stored.created.UTC().Format(time.RFC3339),
+		Uploader:     stored.build.Uploader,
+		Size:         stored.size,
+		Files:        []*ImageInfo{},
+		PromotedFrom: stored.build.PromotedFrom,
+	}
+
+	for _, image := range stored.files {
+		// Manifests written before checksums were recorded lack them,
+		// they are calculated in the background
+		checksum := stored.build.Checksums[image.name]
+		if checksum == "" {
+			checksum = checksums.Cached(storage, image.info)
+		}
+
+		info.Files = append(info.Files, &ImageInfo{
+			Name:            image.name,
+			Build:           stored.build.ID,
+			Size:            image.info.Size,
+			Modified:        image.info.Modified.UTC().Format(time.RFC3339),
+			SHA256:          checksum,
+			ChecksumPending: checksum == "",
+		})
+	}
+
+	sort.Slice(info.Files, func(i, j int) bool {
+		return info.Files[i].Name < info.Files[j].Name
+	})
+
+	return info, nil
+}
+
+// ListBuilds returns the builds stored in the channel,
+// from the newest to the oldest.
+func ListBuilds(storage Storage, imageChannel *ImageChannel, checksums *ChecksumCache) ([]*BuildInfo, error) {
+	builds, err := loadBuilds(storage, channelPrefix(imageChannel))
+	if err != nil {
+		return nil, err
+	}
+
+	result := []*BuildInfo{}
+	for _, stored := range builds {
+		if len(stored.files) == 0 {
+			continue
+		}
+
+		info, err := newBuildInfo(storage, stored, checksums)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, info)
+	}
+
+	return result, nil
+}
+
+// ListImages returns the files stored in the channel,
+// sorted by name.
+func ListImages(storage Storage, imageChannel *ImageChannel, checksums *ChecksumCache) ([]*ImageInfo, error) {
+	builds, err := ListBuilds(storage, imageChannel, checksums)
+	if err != nil {
+		return nil, err
+	}
+
+	images := []*ImageInfo{}
+	for _, build := range builds {
+		images = append(images, build.Files...)
+	}
+
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Name < images[j].Name
+	})
+
+	return images, nil
+}
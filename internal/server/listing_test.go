@@ -0,0 +1,184 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// publishTestBuild publishes a build with files, a map from file name
+// to content, on the channel with the specified key prefix
+func publishTestBuild(t *testing.T, storage Storage, prefix, id string, files map[string]string, checksums map[string]string) *Build {
+	t.Helper()
+
+	build := &Build{ID: id, Created: time.Now().UTC().Format(time.RFC3339), Uploader: "ci", Checksums: checksums}
+	sources := map[string]string{}
+	for name := range files {
+		sources[name] = name
+	}
+	put := func(key, source string) error {
+		return storage.Put(key, strings.NewReader(files[source]), int64(len(files[source])))
+	}
+	if err := publishBuild(storage, prefix, build, sources, put); err != nil {
+		t.Fatal(err)
+	}
+	return build
+}
+
+// listTestImages returns the files of nightly as seen by the client
+func listTestImages(t *testing.T, appState *AppState) []map[string]interface{} {
+	t.Helper()
+
+	r := newTestRequest(appState, http.MethodGet, "/api/v1/channels/nightly/images", nil, map[string]string{"channel": "nightly"})
+	w := httptest.NewRecorder()
+	ListImagesHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+
+	var images []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &images); err != nil {
+		t.Fatal(err)
+	}
+	return images
+}
+
+func TestListImagesHandler(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	appState := newTestAppState(t, dir)
+	calculated := make(chan []string, 1)
+	appState.Checksums.SetListener(func(keys []string) {
+		calculated <- keys
+	})
+
+	// A build with its checksums, and a file stored by an older version
+	publishTestBuild(t, appState.Storage, "nightly", "20200101T000000-00000001",
+		map[string]string{"image.iso": "hello"}, map[string]string{"image.iso": helloChecksum})
+	if err := appState.Storage.Put("nightly/old.iso", strings.NewReader("world"), 5); err != nil {
+		t.Fatal(err)
+	}
+
+	images := listTestImages(t, appState)
+	if len(images) != 2 || images[0]["name"] != "image.iso" || images[1]["name"] != "old.iso" {
+		t.Fatalf("images %v", images)
+	}
+	if images[0]["sha256"] != helloChecksum || images[0]["build"] != "20200101T000000-00000001" || images[0]["size"] != 5.0 {
+		t.Fatalf("image %v", images[0])
+	}
+	if _, ok := images[0]["checksum_pending"]; ok {
+		t.Fatalf("checksum of %v is pending", images[0])
+	}
+
+	// There is no empty checksum to compare against
+	if _, ok := images[1]["sha256"]; ok || images[1]["checksum_pending"] != true {
+		t.Fatalf("image %v", images[1])
+	}
+
+	select {
+	case <-calculated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("checksum was not calculated")
+	}
+	images = listTestImages(t, appState)
+	if images[1]["sha256"] != worldChecksum || images[1]["checksum_pending"] != nil {
+		t.Fatalf("image %v", images[1])
+	}
+}
+
+func TestListChannelsHandler(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	appState := newTestAppState(t, dir)
+
+	tests := []struct {
+		name     string
+		identity *Identity
+		channels string
+		path     bool
+	}{
+		{"reader", &Identity{Name: "ci", Channels: []string{"stable"}, Permissions: []Permission{PermissionRead}}, "stable", false},
+		{"uploader", &Identity{Name: "ci", Permissions: []Permission{PermissionUpload}}, "", false},
+		{"administrator", &Identity{Name: "admin", Permissions: []Permission{PermissionAdmin}}, "nightly stable", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestRequest(appState, http.MethodGet, "/api/v1/channels", nil, nil)
+			w := httptest.NewRecorder()
+			ListChannelsHandler(w, withIdentity(r, test.identity))
+
+			var channels []*ChannelInfo
+			if err := json.Unmarshal(w.Body.Bytes(), &channels); err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, channel := range channels {
+				names = append(names, channel.Name)
+				if (channel.Path != "") != test.path {
+					t.Fatalf("path of %s is %q", channel.Name, channel.Path)
+				}
+			}
+			if strings.Join(names, " ") != test.channels {
+				t.Fatalf("channels %v, want %s", names, test.channels)
+			}
+		})
+	}
+}
+
+func TestListBuildsHandler(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	appState := newTestAppState(t, dir)
+
+	publishTestBuild(t, appState.Storage, "nightly", "20200101T000000-00000001",
+		map[string]string{"image.iso": "hello", "image.iso.sha256sum": "world"},
+		map[string]string{"image.iso": helloChecksum, "image.iso.sha256sum": worldChecksum})
+
+	tests := []struct {
+		name     string
+		identity *Identity
+		status   int
+	}{
+		{"other channel", &Identity{Name: "ci", Channels: []string{"stable"}, Permissions: []Permission{PermissionRead}}, http.StatusForbidden},
+		{"reader", &Identity{Name: "ci", Channels: []string{"nightly"}, Permissions: []Permission{PermissionRead}}, http.StatusOK},
+	}
+	for _, test := range tests {
+		r := newTestRequest(appState, http.MethodGet, "/api/v1/channels/nightly/builds", nil, map[string]string{"channel": "nightly"})
+		w := httptest.NewRecorder()
+		ListBuildsHandler(w, withIdentity(r, test.identity))
+		if w.Code != test.status {
+			t.Fatalf("%s: status %d, want %d: %s", test.name, w.Code, test.status, w.Body.String())
+		}
+	}
+
+	r := newTestRequest(appState, http.MethodGet, "/api/v1/channels/nightly/builds", nil, map[string]string{"channel": "nightly"})
+	w := httptest.NewRecorder()
+	ListBuildsHandler(w, r)
+
+	var builds []*BuildInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &builds); err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 1 || builds[0].ID != "20200101T000000-00000001" || builds[0].Uploader != "ci" || builds[0].Size != 10 {
+		t.Fatalf("builds %s", w.Body.String())
+	}
+	if files := builds[0].Files; len(files) != 2 || files[0].Name != "image.iso" || files[0].SHA256 != helloChecksum || files[1].Name != "image.iso.sha256sum" {
+		t.Fatalf("files %s", w.Body.String())
+	}
+
+	// Unknown channels are not found
+	r = newTestRequest(appState, http.MethodGet, "/api/v1/channels/beta/builds", nil, map[string]string{"channel": "beta"})
+	w = httptest.NewRecorder()
+	ListBuildsHandler(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
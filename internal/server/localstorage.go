@@ -0,0 +1,148 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LocalStorage keeps the files in a local directory.
+type LocalStorage struct {
+	root string
+}
+
+// NewLocalStorage creates a storage for the root directory.
+func NewLocalStorage(root string) *LocalStorage {
+	return &LocalStorage{root: root}
+}
+
+func (s *LocalStorage) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+// Put stores the content of r as key, replacing it atomically.
+func (s *LocalStorage) Put(key string, r io.Reader, size int64) error {
+	destPath := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return err
+	}
+
+	tempPath := destPath + ".part"
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		os.Remove(tempPath)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	return os.Rename(tempPath, destPath)
+}
+
+// PutFile stores the local file at path as key, with a hard link when
+// possible so that no data is copied.
+func (s *LocalStorage) PutFile(key, path string) error {
+	destPath := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return err
+	}
+
+	if err := os.Link(path, destPath); err == nil {
+		return nil
+	}
+
+	// Different file systems
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	return s.Put(key, file, info.Size())
+}
+
+// Copy stores a copy of the object src as key, with a hard link
+// when possible.
+func (s *LocalStorage) Copy(key, src string) error {
+	return s.PutFile(key, s.path(src))
+}
+
+// Stat returns information about key.
+func (s *LocalStorage) Stat(key string) (*ObjectInfo, error) {
+	info, err := os.Stat(s.path(key))
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, &os.PathError{Op: "stat", Path: s.path(key), Err: os.ErrNotExist}
+	}
+
+	return &ObjectInfo{Key: key, Size: info.Size(), Modified: info.ModTime()}, nil
+}
+
+// List returns all the files whose key starts with prefix, which
+// is expected to be a directory.
+func (s *LocalStorage) List(prefix string) ([]*ObjectInfo, error) {
+	var objects []*ObjectInfo
+
+	root := s.path(prefix)
+	err := filepath.Walk(root,
+		func(walkPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				// Nothing was stored yet
+				if walkPath == root && os.IsNotExist(err) {
+					return filepath.SkipDir
+				}
+				return err
+			}
+
+			if !info.IsDir() {
+				rel, err := filepath.Rel(s.root, walkPath)
+				if err != nil {
+					return err
+				}
+				key := filepath.ToSlash(rel)
+				if strings.HasPrefix(key, prefix) {
+					objects = append(objects, &ObjectInfo{Key: key, Size: info.Size(), Modified: info.ModTime()})
+				}
+			}
+
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+
+	return objects, nil
+}
+
+// Delete removes key.
+func (s *LocalStorage) Delete(key string) error {
+	return os.Remove(s.path(key))
+}
+
+// Open opens key for reading.
+func (s *LocalStorage) Open(key string) (Object, error) {
+	return os.Open(s.path(key))
+}
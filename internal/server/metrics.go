@@ -0,0 +1,274 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+)
+
+// Reasons of upload failures
+const (
+	FailureChecksumMismatch = "checksum_mismatch"
+	FailureUnauthorized     = "unauthorized"
+	FailureUnknownChannel   = "unknown_channel"
+	FailureFileExists       = "file_exists"
+	FailureInvalidRequest   = "invalid_request"
+	FailureInternal         = "internal_error"
+)
+
+// Reasons of authentication failures
+const (
+	AuthMissingToken = "missing_token"
+	AuthInvalidToken = "invalid_token"
+	AuthForbidden    = "forbidden"
+)
+
+// metricFamily is a metric with all its samples, keyed by suffix
+// of the name and labels
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	samples map[string]float64
+}
+
+// Metrics collects the metrics exposed to Prometheus.
+type Metrics struct {
+	mutex    sync.Mutex
+	families map[string]*metricFamily
+}
+
+// NewMetrics creates the metrics, all starting from zero.
+func NewMetrics() *Metrics {
+	m := &Metrics{families: map[string]*metricFamily{}}
+
+	m.define("image_manager_uploads_total", "counter", "Builds uploaded.")
+	m.define("image_manager_upload_bytes_total", "counter", "Bytes of the builds uploaded.")
+	m.define("image_manager_upload_duration_seconds", "summary", "Time taken by uploads, from the first byte to publishing.")
+	m.define("image_manager_upload_failures_total", "counter", "Uploads that failed, by reason.")
+	m.define("image_manager_cleanup_deleted_builds_total", "counter", "Builds removed by the retention policy.")
+	m.define("image_manager_cleanup_freed_bytes_total", "counter", "Bytes freed by the retention policy.")
+	m.define("image_manager_storage_bytes", "gauge", "Size of the files stored in the channel.")
+	m.define("image_manager_storage_builds", "gauge", "Builds stored in the channel.")
+	m.define("image_manager_auth_failures_total", "counter", "Requests rejected because of the token, by reason.")
+
+	return m
+}
+
+func (m *Metrics) define(name, kind, help string) {
+	m.families[name] = &metricFamily{name: name, help: help, kind: kind, samples: map[string]float64{}}
+}
+
+// formatLabels returns the labels as written in the exposition format,
+// from a list of name and value pairs
+func formatLabels(pairs ...string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	var labels []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, fmt.Sprintf("%s=\"%s\"", pairs[i], replacer.Replace(pairs[i+1])))
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// add increments a sample of the metric name, suffix is only
+// used by summaries
+func (m *Metrics) add(name, suffix string, value float64, labels ...string) {
+	m.families[name].samples[suffix+formatLabels(labels...)] += value
+}
+
+// set changes a sample of the metric name
+func (m *Metrics) set(name string, value float64, labels ...string) {
+	m.families[name].samples[formatLabels(labels...)] = value
+}
+
+// UploadSucceeded records a build of size bytes published on channel.
+func (m *Metrics) UploadSucceeded(channel string, size int64, duration time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.add("image_manager_uploads_total", "", 1, "channel", channel)
+	m.add("image_manager_upload_bytes_total", "", float64(size), "channel", channel)
+	m.add("image_manager_upload_duration_seconds", "_sum", duration.Seconds(), "channel", channel)
+	m.add("image_manager_upload_duration_seconds", "_count", 1, "channel", channel)
+}
+
+// UploadFailed records an upload to channel that failed for reason,
+// channel is empty when it's unknown.
+func (m *Metrics) UploadFailed(channel, reason string) {
+	if m == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.add("image_manager_upload_failures_total", "", 1, "channel", channel, "reason", reason)
+}
+
+// CleanupRemoved records builds removed from channel by a cleanup.
+func (m *Metrics) CleanupRemoved(channel string, builds int, freedBytes int64) {
+	if m == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.add("image_manager_cleanup_deleted_builds_total", "", float64(builds), "channel", channel)
+	m.add("image_manager_cleanup_freed_bytes_total", "", float64(freedBytes), "channel", channel)
+}
+
+// SetStorageUsage records what is stored in channel.
+func (m *Metrics) SetStorageUsage(channel string, size int64, builds int) {
+	if m == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.set("image_manager_storage_bytes", float64(size), "channel", channel)
+	m.set("image_manager_storage_builds", float64(builds), "channel", channel)
+}
+
+// AuthFailed records a request rejected for reason.
+func (m *Metrics) AuthFailed(reason string) {
+	if m == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.add("image_manager_auth_failures_total", "", 1, "reason", reason)
+}
+
+// format returns the metrics in the Prometheus text format
+func (m *Metrics) format() []byte {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var names []string
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		family := m.families[name]
+		fmt.Fprintf(&buf, "# HELP %s %s\n", family.name, family.help)
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", family.name, family.kind)
+
+		var samples []string
+		for key, value := range family.samples {
+			samples = append(samples, family.name+key+" "+strconv.FormatFloat(value, 'g', -1, 64))
+		}
+		sort.Strings(samples)
+		for _, sample := range samples {
+			buf.WriteString(sample + "\n")
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// MetricsHandler exposes the metrics to Prometheus, to tokens with
+// the read permission unless they are configured to be public.
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	appState := appStateFromRequest(w, r)
+	if appState == nil {
+		return
+	}
+
+	// Metrics tell about all the channels
+	if appState.Config.Metrics == nil || !appState.Config.Metrics.Public {
+		if IdentityFromContext(r.Context()) == nil {
+			appState.Metrics.AuthFailed(AuthMissingToken)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		if !authorize(w, r, PermissionRead, "") {
+			return
+		}
+	}
+
+	if appState.Metrics == nil {
+		http.Error(w, "metrics are not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(appState.Metrics.format())
+}
+
+// uploadTracker records the outcome of an upload request in the
+// metrics, from the status of the reply.
+type uploadTracker struct {
+	metrics *Metrics
+	writer  middleware.WrapResponseWriter
+	start   time.Time
+	// Set when the channel is found
+	channel string
+	// Set when the build is published
+	size int64
+	// Set when the reason cannot be told from the status
+	reason string
+}
+
+func newUploadTracker(w http.ResponseWriter, r *http.Request, metrics *Metrics) *uploadTracker {
+	return &uploadTracker{
+		metrics: metrics,
+		writer:  middleware.NewWrapResponseWriter(w, r.ProtoMajor),
+		start:   time.Now(),
+	}
+}
+
+// done records the upload, it has to be called when the reply was sent
+func (t *uploadTracker) done() {
+	status := t.writer.Status()
+	if status == 0 {
+		return
+	}
+
+	if status < 400 {
+		t.metrics.UploadSucceeded(t.channel, t.size, time.Since(t.start))
+		return
+	}
+
+	reason := t.reason
+	if reason == "" {
+		switch status {
+		case http.StatusForbidden:
+			reason = FailureUnauthorized
+		case http.StatusNotFound:
+			reason = FailureUnknownChannel
+		case http.StatusConflict:
+			reason = FailureFileExists
+		case http.StatusBadRequest, http.StatusUnprocessableEntity:
+			reason = FailureInvalidRequest
+		default:
+			reason = FailureInternal
+		}
+	}
+	t.metrics.UploadFailed(t.channel, reason)
+}
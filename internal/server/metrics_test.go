@@ -0,0 +1,160 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	m := NewMetrics()
+	m.UploadSucceeded("nightly", 1024, 1500*time.Millisecond)
+	m.UploadFailed("", FailureUnauthorized)
+	m.UploadFailed("nightly", FailureChecksumMismatch)
+	m.CleanupRemoved("nightly", 2, 2048)
+	m.SetStorageUsage("nightly", 4096, 3)
+	m.SetStorageUsage("nightly", 5000, 4)
+	m.AuthFailed(AuthForbidden)
+	m.AuthFailed(AuthForbidden)
+
+	expected := `# HELP image_manager_auth_failures_total Requests rejected because of the token, by reason.
+# TYPE image_manager_auth_failures_total counter
+image_manager_auth_failures_total{reason="forbidden"} 2
+# HELP image_manager_cleanup_deleted_builds_total Builds removed by the retention policy.
+# TYPE image_manager_cleanup_deleted_builds_total counter
+image_manager_cleanup_deleted_builds_total{channel="nightly"} 2
+# HELP image_manager_cleanup_freed_bytes_total Bytes freed by the retention policy.
+# TYPE image_manager_cleanup_freed_bytes_total counter
+image_manager_cleanup_freed_bytes_total{channel="nightly"} 2048
+# HELP image_manager_storage_builds Builds stored in the channel.
+# TYPE image_manager_storage_builds gauge
+image_manager_storage_builds{channel="nightly"} 4
+# HELP image_manager_storage_bytes Size of the files stored in the channel.
+# TYPE image_manager_storage_bytes gauge
+image_manager_storage_bytes{channel="nightly"} 5000
+# HELP image_manager_upload_bytes_total Bytes of the builds uploaded.
+# TYPE image_manager_upload_bytes_total counter
+image_manager_upload_bytes_total{channel="nightly"} 1024
+# HELP image_manager_upload_duration_seconds Time taken by uploads, from the first byte to publishing.
+# TYPE image_manager_upload_duration_seconds summary
+image_manager_upload_duration_seconds_count{channel="nightly"} 1
+image_manager_upload_duration_seconds_sum{channel="nightly"} 1.5
+# HELP image_manager_upload_failures_total Uploads that failed, by reason.
+# TYPE image_manager_upload_failures_total counter
+image_manager_upload_failures_total{channel="",reason="unauthorized"} 1
+image_manager_upload_failures_total{channel="nightly",reason="checksum_mismatch"} 1
+# HELP image_manager_uploads_total Builds uploaded.
+# TYPE image_manager_uploads_total counter
+image_manager_uploads_total{channel="nightly"} 1
+`
+	if text := string(m.format()); text != expected {
+		t.Fatalf("format() =\n%s\nwant\n%s", text, expected)
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	tests := []struct {
+		pairs  []string
+		labels string
+	}{
+		{nil, ""},
+		{[]string{"channel", "nightly"}, `{channel="nightly"}`},
+		{[]string{"channel", "a", "reason", "b"}, `{channel="a",reason="b"}`},
+		{[]string{"channel", "say \"hi\"\\\n"}, `{channel="say \"hi\"\\\n"}`},
+	}
+	for _, test := range tests {
+		if labels := formatLabels(test.pairs...); labels != test.labels {
+			t.Errorf("formatLabels(%q) = %s, want %s", test.pairs, labels, test.labels)
+		}
+	}
+}
+
+func TestMetricsNil(t *testing.T) {
+	var m *Metrics
+	m.UploadSucceeded("nightly", 1, time.Second)
+	m.UploadFailed("nightly", FailureInternal)
+	m.CleanupRemoved("nightly", 1, 1)
+	m.SetStorageUsage("nightly", 1, 1)
+	m.AuthFailed(AuthMissingToken)
+}
+
+func TestMetricsHandler(t *testing.T) {
+	reader := &Identity{Name: "prometheus", Permissions: []Permission{PermissionRead}}
+	uploader := &Identity{Name: "ci", Permissions: []Permission{PermissionUpload}}
+
+	tests := []struct {
+		name     string
+		public   bool
+		identity *Identity
+		status   int
+	}{
+		{"anonymous", false, nil, http.StatusUnauthorized},
+		{"read permission", false, reader, http.StatusOK},
+		{"no read permission", false, uploader, http.StatusForbidden},
+		{"public", true, nil, http.StatusOK},
+		{"public with a token", true, uploader, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			appState := &AppState{Config: &Config{}, Metrics: NewMetrics()}
+			if test.public {
+				appState.Config.Metrics = &MetricsConfig{Public: true}
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			ctx := context.WithValue(r.Context(), KeyAppState, appState)
+			if test.identity != nil {
+				ctx = context.WithValue(ctx, KeyIdentity, test.identity)
+			}
+			w := httptest.NewRecorder()
+			MetricsHandler(w, r.WithContext(ctx))
+
+			if w.Code != test.status {
+				t.Fatalf("status %d, want %d", w.Code, test.status)
+			}
+			if test.status == http.StatusOK && !strings.Contains(w.Body.String(), "# TYPE image_manager_uploads_total counter") {
+				t.Fatalf("unexpected body %q", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestMetricsRoute(t *testing.T) {
+	token, secret, err := GenerateToken(nil, []Permission{PermissionRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appState := &AppState{Config: &Config{Tokens: []*Token{token}}, Metrics: NewMetrics()}
+	handler := router(NewSharedState(appState))
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"without a token", "", http.StatusUnauthorized},
+		{"invalid token", "invalid", http.StatusUnauthorized},
+		{"valid token", secret, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if test.token != "" {
+				r.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.status {
+				t.Fatalf("status %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+}
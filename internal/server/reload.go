@@ -0,0 +1,77 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+
+	"github.com/liri-infra/image-manager/internal/logger"
+)
+
+// Serializes configuration changes
+var reloadMutex sync.Mutex
+
+// CreateChannelDirs creates the directories of the channels in the
+// storage location.
+func CreateChannelDirs(config *Config) error {
+	for _, channel := range config.Channels {
+		path := filepath.Join(config.StorageDir, channel.Path)
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplyConfig replaces the configuration of state with config, which
+// must be already validated.  Requests in progress keep using the
+// previous configuration.  Storage settings cannot be changed without
+// a restart, and are kept as they are.
+func ApplyConfig(state *SharedState, config *Config) error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	return applyConfig(state, config)
+}
+
+// applyConfig is ApplyConfig with reloadMutex already locked
+func applyConfig(state *SharedState, config *Config) error {
+	current := state.Load()
+
+	// Files would end up somewhere else
+	if config.StorageDir != current.Config.StorageDir || !reflect.DeepEqual(config.Backend, current.Config.Backend) {
+		logger.Warn("Storage settings were changed, restart the server to apply them")
+		config.StorageDir = current.Config.StorageDir
+		config.Backend = current.Config.Backend
+	}
+	if !reflect.DeepEqual(config.TLS, current.Config.TLS) {
+		logger.Warn("TLS settings were changed, restart the server to apply them")
+	}
+
+	if err := CreateChannelDirs(config); err != nil {
+		return err
+	}
+
+	next := *current
+	next.Config = config
+	state.Store(&next)
+
+	if next.Webhooks != nil {
+		next.Webhooks.SetWebhooks(config.Webhooks)
+	}
+
+	// New channels need an index
+	for _, channel := range config.Channels {
+		if current.Config.FindChannel(channel.Name) == nil {
+			updateIndex(&next, channel)
+		}
+	}
+
+	logger.Infof("Configuration reloaded, %d channels and %d tokens", len(config.Channels), len(config.Tokens))
+	return nil
+}
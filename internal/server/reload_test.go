@@ -0,0 +1,81 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApplyConfig(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	appState := newTestAppState(t, dir)
+	state := NewSharedState(appState)
+
+	config := &Config{
+		StorageDir: filepath.Join(dir, "elsewhere"),
+		Channels: []*ImageChannel{
+			{Name: "nightly", Path: "nightly"},
+			{Name: "testing", Path: "releases/testing"},
+		},
+		Tokens: []*Token{{ID: "ci", Token: "secret"}},
+	}
+	if err := ApplyConfig(state, config); err != nil {
+		t.Fatalf("ApplyConfig() = %v", err)
+	}
+
+	// Requests in progress keep the previous configuration
+	if appState.Config.FindChannel("testing") != nil || appState.Config.FindChannel("stable") == nil {
+		t.Fatalf("previous configuration was changed: %+v", appState.Config.Channels)
+	}
+
+	current := state.Load()
+	if current.Config != config || current.Storage != appState.Storage || current.Sessions != appState.Sessions {
+		t.Fatalf("state %+v", current)
+	}
+	if current.Config.FindChannel("stable") != nil || len(current.Config.Tokens) != 1 {
+		t.Fatalf("configuration was not replaced: %+v", current.Config)
+	}
+
+	// Storage settings need a restart
+	if config.StorageDir != dir {
+		t.Fatalf("storage %q, want %q", config.StorageDir, dir)
+	}
+
+	// New channels get a directory and an index
+	if _, err := os.Stat(filepath.Join(dir, "releases", "testing", "index.json")); err != nil {
+		t.Fatalf("index of the new channel: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "elsewhere")); !os.IsNotExist(err) {
+		t.Fatalf("the new storage location was created: %v", err)
+	}
+}
+
+func TestApplyConfigFails(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	appState := newTestAppState(t, dir)
+	state := NewSharedState(appState)
+
+	// The directory of the new channel cannot be created
+	if err := ioutil.WriteFile(filepath.Join(dir, "testing"), []byte("file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{
+		StorageDir: dir,
+		Channels:   []*ImageChannel{{Name: "testing", Path: "testing"}},
+	}
+	if err := ApplyConfig(state, config); err == nil {
+		t.Fatal("ApplyConfig() succeeded")
+	}
+	if state.Load() != appState {
+		t.Fatal("configuration was replaced")
+	}
+}
@@ -0,0 +1,522 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Objects bigger than this are uploaded in parts, a single
+// request cannot be bigger than 5 GiB
+const s3PartSize = 512 * 1024 * 1024
+
+// Objects bigger than this cannot be copied with a single request
+const s3MaxCopySize = 5 * 1024 * 1024 * 1024
+
+// S3Storage keeps the files in a bucket of an S3-compatible server,
+// requests are signed with AWS Signature Version 4.
+type S3Storage struct {
+	endpoint   *url.URL
+	region     string
+	bucket     string
+	prefix     string
+	accessKey  string
+	secretKey  string
+	pathStyle  bool
+	httpClient *http.Client
+
+	// Size limits, smaller in tests
+	partSize    int64
+	maxCopySize int64
+}
+
+// s3Error is the error document returned by the server
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// NewS3Storage creates a storage for the bucket in config.
+func NewS3Storage(config *BackendConfig) (*S3Storage, error) {
+	if config.Bucket == "" {
+		return nil, errors.New("S3 bucket is not configured")
+	}
+	if config.AccessKey == "" || config.SecretKey == "" {
+		return nil, errors.New("S3 credentials are not configured")
+	}
+
+	region := config.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	endpoint := config.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid S3 endpoint \"%s\"", endpoint)
+	}
+
+	prefix := strings.Trim(config.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	return &S3Storage{
+		endpoint:   u,
+		region:     region,
+		bucket:     config.Bucket,
+		prefix:     prefix,
+		accessKey:  config.AccessKey,
+		secretKey:  config.SecretKey,
+		pathStyle:  config.PathStyle,
+		httpClient: &http.Client{},
+
+		partSize:    s3PartSize,
+		maxCopySize: s3MaxCopySize,
+	}, nil
+}
+
+// s3Escape encodes s as required by the signature, leaving
+// slashes alone unless encodeSlash is set.
+func s3Escape(s string, encodeSlash bool) string {
+	var buf strings.Builder
+	for _, c := range []byte(s) {
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+// url returns the URL of key, or of the bucket when key is empty
+func (s *S3Storage) url(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	escaped := strings.TrimSuffix(u.Path, "/")
+	if s.pathStyle {
+		escaped += "/" + s3Escape(s.bucket, true)
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	escaped += "/"
+	if key != "" {
+		escaped += s3Escape(s.prefix+key, false)
+	}
+
+	u.Path, _ = url.PathUnescape(escaped)
+	u.RawPath = escaped
+
+	// Sort the parameters, as the signature requires
+	keys := make([]string, 0, len(query))
+	for name := range query {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, name := range keys {
+		params = append(params, s3Escape(name, true)+"="+s3Escape(query.Get(name), true))
+	}
+	u.RawQuery = strings.Join(params, "&")
+
+	return &u
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sign adds the authorization headers to req, signed at now
+func (s *S3Storage) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// The host and all the x-amz-* headers are signed
+	headers := map[string]string{"host": req.URL.Host}
+	names := []string{"host"}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var canonicalHeaders string
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, s.region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+// do sends a signed request and returns the response if the status code
+// is successful, a 404 is turned into an error satisfying os.IsNotExist()
+func (s *S3Storage) do(method, key string, query url.Values, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.url(key, query).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	// Bodies are streamed, their checksum is not part of the signature
+	s.sign(req, "UNSIGNED-PAYLOAD", time.Now())
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &os.PathError{Op: strings.ToLower(method), Path: key, Err: os.ErrNotExist}
+	}
+
+	var result s3Error
+	buf, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if xml.Unmarshal(buf, &result) == nil && result.Code != "" {
+		return nil, fmt.Errorf("S3 %s %s: %s: %s", method, key, result.Code, result.Message)
+	}
+	return nil, fmt.Errorf("S3 %s %s: %s", method, key, resp.Status)
+}
+
+// Put stores the content of r as key.
+func (s *S3Storage) Put(key string, r io.Reader, size int64) error {
+	if size > s.partSize {
+		return s.putMultipart(key, r, size)
+	}
+
+	resp, err := s.do(http.MethodPut, key, nil, r, size, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// putMultipart stores big objects with a multipart upload
+func (s *S3Storage) putMultipart(key string, r io.Reader, size int64) error {
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, bytes.NewReader(nil), 0, nil)
+	if err != nil {
+		return err
+	}
+	var initiate struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiate)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	type completedPart struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	var complete struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}
+
+	// Do not leave parts behind, they are billed
+	abort := func() {
+		if resp, err := s.do(http.MethodDelete, key, url.Values{"uploadId": {initiate.UploadID}}, nil, 0, nil); err == nil {
+			resp.Body.Close()
+		}
+	}
+
+	for number, offset := 1, int64(0); offset < size; number++ {
+		partSize := size - offset
+		if partSize > s.partSize {
+			partSize = s.partSize
+		}
+
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {initiate.UploadID}}
+		resp, err := s.do(http.MethodPut, key, query, io.LimitReader(r, partSize), partSize, nil)
+		if err != nil {
+			abort()
+			return err
+		}
+		resp.Body.Close()
+
+		complete.Parts = append(complete.Parts, completedPart{number, resp.Header.Get("ETag")})
+		offset += partSize
+	}
+
+	body, err := xml.Marshal(&complete)
+	if err != nil {
+		abort()
+		return err
+	}
+	resp, err = s.do(http.MethodPost, key, url.Values{"uploadId": {initiate.UploadID}},
+		bytes.NewReader(body), int64(len(body)), http.Header{"Content-Type": {"application/xml"}})
+	if err != nil {
+		abort()
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Errors might be reported after the upload was accepted
+	var result s3Error
+	buf, _ := ioutil.ReadAll(resp.Body)
+	if xml.Unmarshal(buf, &result) == nil && result.Code != "" {
+		abort()
+		return fmt.Errorf("S3 upload of %s: %s: %s", key, result.Code, result.Message)
+	}
+
+	return nil
+}
+
+// PutFile uploads the local file at path as key.
+func (s *S3Storage) PutFile(key, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	return s.Put(key, file, info.Size())
+}
+
+// Copy stores a copy of the object src as key, on the server
+// unless it's too big.
+func (s *S3Storage) Copy(key, src string) error {
+	info, err := s.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if info.Size > s.maxCopySize {
+		object, err := s.Open(src)
+		if err != nil {
+			return err
+		}
+		defer object.Close()
+
+		return s.Put(key, object, info.Size)
+	}
+
+	header := http.Header{"X-Amz-Copy-Source": {"/" + s3Escape(s.bucket, true) + "/" + s3Escape(s.prefix+src, false)}}
+	resp, err := s.do(http.MethodPut, key, nil, bytes.NewReader(nil), 0, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Errors might be reported after the copy was accepted
+	var result s3Error
+	buf, _ := ioutil.ReadAll(resp.Body)
+	if xml.Unmarshal(buf, &result) == nil && result.Code != "" {
+		return fmt.Errorf("S3 copy of %s: %s: %s", src, result.Code, result.Message)
+	}
+
+	return nil
+}
+
+// Stat returns information about key.
+func (s *S3Storage) Stat(key string) (*ObjectInfo, error) {
+	resp, err := s.do(http.MethodHead, key, nil, nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &ObjectInfo{Key: key, Size: resp.ContentLength, Modified: modified}, nil
+}
+
+// List returns all the objects whose key starts with prefix.
+func (s *S3Storage) List(prefix string) ([]*ObjectInfo, error) {
+	var objects []*ObjectInfo
+
+	query := url.Values{"list-type": {"2"}, "prefix": {s.prefix + prefix}}
+	for {
+		resp, err := s.do(http.MethodGet, "", query, nil, 0, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+			Contents              []struct {
+				Key          string    `xml:"Key"`
+				LastModified time.Time `xml:"LastModified"`
+				Size         int64     `xml:"Size"`
+			} `xml:"Contents"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, content := range result.Contents {
+			objects = append(objects, &ObjectInfo{
+				Key:      strings.TrimPrefix(content.Key, s.prefix),
+				Size:     content.Size,
+				Modified: content.LastModified,
+			})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+
+	return objects, nil
+}
+
+// Delete removes key.
+func (s *S3Storage) Delete(key string) error {
+	// Deleting a missing object is not an error for S3
+	if _, err := s.Stat(key); err != nil {
+		return err
+	}
+
+	resp, err := s.do(http.MethodDelete, key, nil, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Open opens key for reading, data is requested when read
+// so that seeking does not download the whole object.
+func (s *S3Storage) Open(key string) (Object, error) {
+	info, err := s.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Object{storage: s, key: key, size: info.Size}, nil
+}
+
+// s3Object reads an object with range requests
+type s3Object struct {
+	storage *S3Storage
+	key     string
+	size    int64
+	offset  int64
+	body    io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+
+	if o.body == nil {
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", o.offset)}}
+		resp, err := o.storage.do(http.MethodGet, o.key, nil, nil, 0, header)
+		if err != nil {
+			return 0, err
+		}
+		o.body = resp.Body
+	}
+
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	if offset != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body != nil {
+		return o.body.Close()
+	}
+	return nil
+}
@@ -15,26 +15,87 @@ import (
 	"github.com/liri-infra/image-manager/internal/logger"
 )
 
-func receiverContext(appState *AppState) func(next http.Handler) http.Handler {
+// receiverContext stores the current app state in the request context,
+// the request keeps using it even if the configuration is reloaded
+func receiverContext(state *SharedState) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
-			ctx := context.WithValue(r.Context(), KeyAppState, appState)
+			ctx := context.WithValue(r.Context(), KeyAppState, state.Load())
+			ctx = context.WithValue(ctx, KeySharedState, state)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		}
 		return http.HandlerFunc(fn)
 	}
 }
 
-func v1Router(appState *AppState) http.Handler {
+func v1Router() http.Handler {
 	r := chi.NewRouter()
 
-	r.Use(receiverContext(appState))
-	r.Put("/upload/{channel}", UploadHandler)
+	// Downloads take as long as they need, and are not compressed
+	// so that ranges refer to the actual file.  Public channels
+	// are available without a token.
+	r.Group(func(r chi.Router) {
+		r.Use(OptionalTokenVerifier)
+		r.Get("/channels/{channel}/images/{name}", DownloadImageHandler)
+		r.Head("/channels/{channel}/images/{name}", DownloadImageHandler)
+		r.Get("/channels/{channel}/latest/{type}", LatestImageHandler)
+		r.Head("/channels/{channel}/latest/{type}", LatestImageHandler)
+	})
+
+	// Protected routes
+	r.Group(func(r chi.Router) {
+		// Seek, verify and validate tokens
+		r.Use(TokenVerifier)
+
+		// Streams stay open until the client goes away
+		r.Get("/events", EventsHandler)
+
+		// Archiving a channel copies all of its files with some
+		// storage backends, and must not be interrupted
+		r.Delete("/channels/{channel}", RemoveChannelHandler)
+
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.Compress(5, "gzip"))
+
+			// Set a timeout value on the request context (ctx), that will signal
+			// through ctx.Done() that the request has timed out and further
+			// processing should be stopped.
+			r.Use(middleware.Timeout(120 * time.Second))
+
+			r.Put("/upload/{channel}", UploadHandler)
+
+			// Listing
+			r.Get("/channels", ListChannelsHandler)
+
+			// Channel administration
+			r.Post("/channels", AddChannelHandler)
+			r.Patch("/channels/{channel}", EditChannelHandler)
+
+			r.Get("/channels/{channel}/images", ListImagesHandler)
+			r.Delete("/channels/{channel}/images/{name}", DeleteImageHandler)
+			r.Get("/channels/{channel}/builds", ListBuildsHandler)
+			r.Delete("/channels/{channel}/builds/{id}", DeleteBuildHandler)
+			r.Post("/channels/{channel}/builds/{id}/promote", PromoteBuildHandler)
+			r.Get("/channels/{channel}/latest", ListAliasesHandler)
+			r.Get("/channels/{channel}/index", ChannelIndexHandler)
+
+			// Notifications
+			r.Get("/webhooks/deliveries", WebhookDeliveriesHandler)
+
+			// Resumable uploads
+			r.Post("/upload/{channel}/sessions", CreateSessionHandler)
+			r.Post("/upload/{channel}/builds/{id}/publish", PublishBuildHandler)
+			r.Get("/sessions/{id}", GetSessionHandler)
+			r.Put("/sessions/{id}", WriteSessionHandler)
+			r.Post("/sessions/{id}/finalize", FinalizeSessionHandler)
+			r.Delete("/sessions/{id}", AbortSessionHandler)
+		})
+	})
 
 	return r
 }
 
-func router(appState *AppState) http.Handler {
+func router(state *SharedState) http.Handler {
 	r := chi.NewRouter()
 
 	// A good base middleware stack
@@ -42,20 +103,24 @@ func router(appState *AppState) http.Handler {
 	r.Use(middleware.RealIP)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
-	r.Use(middleware.Compress(5, "gzip"))
+	r.Use(receiverContext(state))
 
-	// Set a timeout value on the request context (ctx), that will signal
-	// through ctx.Done() that the request has timed out and further
-	// processing should be stopped.
-	r.Use(middleware.Timeout(120 * time.Second))
+	// API
+	r.Mount("/api/v1", v1Router())
 
-	// Protected routes
+	// Static file server
 	r.Group(func(r chi.Router) {
-		// Seek, verify and validate tokens
-		r.Use(TokenVerifier(appState))
+		r.Use(OptionalTokenVerifier)
+		r.Get("/files/{channel}/*", FilesHandler)
+		r.Head("/files/{channel}/*", FilesHandler)
+		r.Get("/files/{channel}/latest/{type}", LatestFileHandler)
+		r.Head("/files/{channel}/latest/{type}", LatestFileHandler)
+	})
 
-		// API
-		r.Mount("/api/v1", v1Router(appState))
+	// Prometheus, a token is required unless metrics are public
+	r.Group(func(r chi.Router) {
+		r.Use(OptionalTokenVerifier)
+		r.Get("/metrics", MetricsHandler)
 	})
 
 	// Public routes
@@ -67,8 +132,54 @@ func router(appState *AppState) http.Handler {
 	return r
 }
 
-// StartServer starts the server.
-func StartServer(address string, appState *AppState) error {
-	logger.Actionf("Starting server on %v", address)
-	return http.ListenAndServe(address, router(appState))
+// StartServer starts the server, with HTTPS when TLS is configured.
+// When ctx is done the server stops accepting connections and waits up
+// to shutdownTimeout for the requests in progress, then interrupts them.
+// ErrRequestsInProgress is returned if some of them do not stop.
+func StartServer(ctx context.Context, address string, state *SharedState, shutdownTimeout time.Duration) error {
+	appState := state.Load()
+
+	// Checksums calculated in the background end up in the indexes
+	appState.Checksums.SetListener(func(keys []string) {
+		refreshIndexes(state.Load(), keys)
+	})
+
+	tracker := &requestTracker{}
+	server := &http.Server{Addr: address, Handler: tracker.middleware(router(state))}
+
+	// Event streams never end by themselves
+	server.RegisterOnShutdown(appState.Events.Close)
+
+	// Failed webhook deliveries are not retried while stopping
+	if appState.Webhooks != nil {
+		server.RegisterOnShutdown(appState.Webhooks.Close)
+	}
+
+	errs := make(chan error, 1)
+	if appState.Config.TLS == nil {
+		logger.Actionf("Starting server on %v", address)
+		go func() {
+			errs <- server.ListenAndServe()
+		}()
+	} else {
+		tlsConfig, err := newTLSConfig(appState.Config.TLS)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = tlsConfig
+
+		logger.Actionf("Starting server on %v with TLS", address)
+		go func() {
+			errs <- server.ListenAndServeTLS("", "")
+		}()
+	}
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	logger.Actionf("Stopping server, waiting up to %s for requests in progress", shutdownTimeout)
+	return shutdownServer(server, tracker, shutdownTimeout, interruptedRequestsTimeout)
 }
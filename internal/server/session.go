@@ -0,0 +1,438 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/liri-infra/image-manager/internal/common"
+	"github.com/liri-infra/image-manager/internal/logger"
+)
+
+// Errors returned by the session manager
+var (
+	ErrSessionNotFound = errors.New("upload session not found")
+	ErrSessionBusy     = errors.New("upload session is busy")
+	ErrBadOffset       = errors.New("offset does not match the committed offset")
+	ErrIncomplete      = errors.New("upload session is incomplete")
+	ErrBadChecksum     = errors.New("bad checksum")
+	ErrDuplicateFile   = errors.New("file is already part of the build")
+)
+
+// UploadSession represents a resumable upload of a single file.
+type UploadSession struct {
+	ID       string `json:"id"`
+	Channel  string `json:"channel"`
+	Build    string `json:"build"`
+	FileName string `json:"file_name"`
+	Size     int64  `json:"size"`
+	Offset   int64  `json:"offset"`
+	Complete bool   `json:"complete"`
+	Checksum string `json:"checksum,omitempty"`
+	Created  string `json:"created"`
+	// Name of the client that created the session
+	Uploader string `json:"uploader,omitempty"`
+}
+
+// SessionManager keeps track of the upload sessions, which are
+// stored on disk so that they survive a server restart.
+type SessionManager struct {
+	path  string
+	mutex sync.Mutex
+	busy  map[string]bool
+}
+
+// NewSessionManager creates a session manager that stores the
+// upload sessions inside path.
+func NewSessionManager(path string) (*SessionManager, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+
+	return &SessionManager{path: path, busy: map[string]bool{}}, nil
+}
+
+func (m *SessionManager) metadataPath(id string) string {
+	return filepath.Join(m.path, id+".json")
+}
+
+func (m *SessionManager) dataPath(id string) string {
+	return filepath.Join(m.path, id+".part")
+}
+
+func (m *SessionManager) load(id string) (*UploadSession, error) {
+	// Only accept identifiers that we have generated
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return nil, ErrSessionNotFound
+	}
+
+	buf, err := ioutil.ReadFile(m.metadataPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrSessionNotFound
+		}
+		return nil, err
+	}
+
+	var session UploadSession
+	if err := json.Unmarshal(buf, &session); err != nil {
+		return nil, err
+	}
+
+	// The committed offset is what we have on disk
+	info, err := os.Stat(m.dataPath(id))
+	if err != nil {
+		return nil, err
+	}
+	session.Offset = info.Size()
+
+	return &session, nil
+}
+
+func (m *SessionManager) save(session *UploadSession) error {
+	buf, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	tempPath := m.metadataPath(session.ID) + ".tmp"
+	if err := ioutil.WriteFile(tempPath, buf, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tempPath, m.metadataPath(session.ID))
+}
+
+func (m *SessionManager) remove(id string) {
+	os.Remove(m.dataPath(id))
+	os.Remove(m.metadataPath(id))
+}
+
+// Create creates a new upload session for fileName on channel, which
+// will be part of build, or returns the pending session for the same
+// file so that the client can resume it.  Only sessions created by the
+// same uploader are resumed, and only if they are part of build; when
+// build is empty the file starts a new build, unless an interrupted
+// upload of the same file is found.  A finalized session is returned
+// when its checksum is the same, so that a client restarted before
+// publishing the build does not upload the file again.
+func (m *SessionManager) Create(channel, build, fileName string, size int64, checksum, uploader string) (*UploadSession, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// Resume a pending session for the same file
+	sessions, err := m.list()
+	if err != nil {
+		return nil, err
+	}
+	for _, session := range sessions {
+		if session.Channel != channel || session.FileName != fileName || session.Size != size ||
+			(build != "" && session.Build != build) || session.Uploader != uploader {
+			continue
+		}
+		if !session.Complete || (checksum != "" && session.Checksum == checksum) {
+			return session, nil
+		}
+	}
+
+	// Files of a build are published by name
+	for _, session := range sessions {
+		if session.Channel == channel && session.Build == build && session.FileName == fileName {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateFile, fileName)
+		}
+	}
+
+	if build == "" {
+		if build, err = NewBuildID(); err != nil {
+			return nil, err
+		}
+	}
+
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	session := &UploadSession{
+		ID:       hex.EncodeToString(key),
+		Channel:  channel,
+		Build:    build,
+		FileName: fileName,
+		Size:     size,
+		Created:  time.Now().UTC().Format(time.RFC3339),
+		Uploader: uploader,
+	}
+
+	file, err := os.Create(m.dataPath(session.ID))
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	if err := m.save(session); err != nil {
+		m.remove(session.ID)
+		return nil, err
+	}
+
+	return session, nil
+}
+
+func (m *SessionManager) list() ([]*UploadSession, error) {
+	entries, err := ioutil.ReadDir(m.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []*UploadSession
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		id := strings.TrimSuffix(entry.Name(), ".json")
+		session, err := m.load(id)
+		if err != nil {
+			logger.Warnf("Skipping upload session \"%s\": %v", id, err)
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+// Get returns the session with the specified id.
+func (m *SessionManager) Get(id string) (*UploadSession, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.load(id)
+}
+
+// acquire marks the session as busy, so that only one request
+// at a time can operate on it.
+func (m *SessionManager) acquire(id string) (*UploadSession, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	session, err := m.load(id)
+	if err != nil {
+		return nil, err
+	}
+	if m.busy[id] {
+		return nil, ErrSessionBusy
+	}
+	m.busy[id] = true
+
+	return session, nil
+}
+
+func (m *SessionManager) release(id string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.busy, id)
+}
+
+// Write appends data read from r to the session, starting at offset
+// which must be the committed offset.  It returns the session with
+// the new committed offset, even when reading from r fails half way.
+func (m *SessionManager) Write(id string, offset int64, r io.Reader) (*UploadSession, error) {
+	session, err := m.acquire(id)
+	if err != nil {
+		return nil, err
+	}
+	defer m.release(id)
+
+	if offset != session.Offset {
+		return session, ErrBadOffset
+	}
+
+	file, err := os.OpenFile(m.dataPath(id), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return session, err
+	}
+	defer file.Close()
+
+	// Never write past the declared size
+	written, err := io.Copy(file, io.LimitReader(r, session.Size-session.Offset))
+	session.Offset += written
+	if err != nil {
+		return session, err
+	}
+
+	return session, file.Sync()
+}
+
+// Finalize verifies the checksum of a complete upload, which is then
+// ready to be published along with the other files of its build.
+func (m *SessionManager) Finalize(id, checksum string) (*UploadSession, error) {
+	session, err := m.acquire(id)
+	if err != nil {
+		return nil, err
+	}
+	defer m.release(id)
+
+	if session.Offset != session.Size {
+		return session, ErrIncomplete
+	}
+
+	// Nothing changed since it was finalized
+	if session.Complete && (checksum == "" || checksum == session.Checksum) {
+		return session, nil
+	}
+
+	actual, err := common.CalculateChecksum(m.dataPath(id))
+	if err != nil {
+		return session, err
+	}
+	if checksum != "" && actual != checksum {
+		// Start over, the data we have is useless
+		m.remove(id)
+		return session, fmt.Errorf("%w for %s (%s vs %s)", ErrBadChecksum, session.FileName, actual, checksum)
+	}
+
+	session.Complete = true
+	session.Checksum = actual
+	if err := m.save(session); err != nil {
+		return session, err
+	}
+
+	return session, nil
+}
+
+// Publish hands the files of all the sessions of build on channel to
+// publish, as a map from file name to path, and removes the sessions
+// if it succeeds.  All the sessions must be complete.
+func (m *SessionManager) Publish(channel, build string, publish func(sessions []*UploadSession, files map[string]string) error) ([]*UploadSession, error) {
+	m.mutex.Lock()
+	all, err := m.list()
+	if err != nil {
+		m.mutex.Unlock()
+		return nil, err
+	}
+
+	var sessions []*UploadSession
+	for _, session := range all {
+		if session.Channel != channel || session.Build != build {
+			continue
+		}
+		if m.busy[session.ID] {
+			m.mutex.Unlock()
+			return nil, ErrSessionBusy
+		}
+		if !session.Complete {
+			m.mutex.Unlock()
+			return nil, fmt.Errorf("%w: %s", ErrIncomplete, session.FileName)
+		}
+		sessions = append(sessions, session)
+	}
+	if len(sessions) == 0 {
+		m.mutex.Unlock()
+		return nil, ErrSessionNotFound
+	}
+
+	// Nobody else can touch these sessions while publishing
+	for _, session := range sessions {
+		m.busy[session.ID] = true
+	}
+	m.mutex.Unlock()
+
+	defer func() {
+		for _, session := range sessions {
+			m.release(session.ID)
+		}
+	}()
+
+	files := map[string]string{}
+	for _, session := range sessions {
+		if _, ok := files[session.FileName]; ok {
+			return sessions, fmt.Errorf("%w: %s", ErrDuplicateFile, session.FileName)
+		}
+		files[session.FileName] = m.dataPath(session.ID)
+	}
+	if err := publish(sessions, files); err != nil {
+		return sessions, err
+	}
+
+	for _, session := range sessions {
+		m.remove(session.ID)
+	}
+
+	return sessions, nil
+}
+
+// Abort discards the session and the data received so far.
+func (m *SessionManager) Abort(id string) error {
+	if _, err := m.acquire(id); err != nil {
+		return err
+	}
+	defer m.release(id)
+
+	m.remove(id)
+	return nil
+}
+
+// RemoveStale removes the sessions that were created more than maxAge ago.
+func (m *SessionManager) RemoveStale(maxAge time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	sessions, err := m.list()
+	if err != nil {
+		logger.Errorf("Failed to list upload sessions: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, session := range sessions {
+		if m.busy[session.ID] {
+			continue
+		}
+		created, err := time.Parse(time.RFC3339, session.Created)
+		if err != nil || now.Sub(created) > maxAge {
+			logger.Infof("Removing stale upload session for \"%s\"", session.FileName)
+			m.remove(session.ID)
+		}
+	}
+}
+
+// RemoveOrphans removes the data of sessions that do not exist anymore,
+// as well as metadata that was not completely written, the data of
+// the other sessions is kept so that uploads can be resumed.
+func (m *SessionManager) RemoveOrphans() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	entries, err := ioutil.ReadDir(m.path)
+	if err != nil {
+		logger.Errorf("Failed to list upload sessions: %v", err)
+		return
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		switch filepath.Ext(name) {
+		case ".part":
+			id := strings.TrimSuffix(name, ".part")
+			if _, err := os.Stat(m.metadataPath(id)); os.IsNotExist(err) {
+				logger.Infof("Removing data of upload session %s which does not exist", id)
+				os.Remove(filepath.Join(m.path, name))
+			}
+		case ".tmp":
+			os.Remove(filepath.Join(m.path, name))
+		}
+	}
+}
@@ -0,0 +1,202 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// tempDir creates a temporary directory, the caller removes it
+func tempDir(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "image-manager-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func newTestSessionManager(t *testing.T, dir string) *SessionManager {
+	t.Helper()
+
+	manager, err := NewSessionManager(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manager
+}
+
+func TestSessionCreateResume(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	manager := newTestSessionManager(t, dir)
+
+	first, err := manager.Create("nightly", "", "image.iso", 4, "", "ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Build == "" {
+		t.Fatal("no build was assigned")
+	}
+	if _, err := manager.Write(first.ID, 0, strings.NewReader("ab")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		channel  string
+		build    string
+		fileName string
+		size     int64
+		uploader string
+		resumed  bool
+	}{
+		{"interrupted upload", "nightly", "", "image.iso", 4, "ci", true},
+		{"same build", "nightly", first.Build, "image.iso", 4, "ci", true},
+		{"other build", "nightly", "20200101T000000-00000000", "image.iso", 4, "ci", false},
+		{"other uploader", "nightly", "", "image.iso", 4, "someone", false},
+		{"other channel", "stable", "", "image.iso", 4, "ci", false},
+		{"other size", "nightly", "", "image.iso", 5, "ci", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			session, err := manager.Create(test.channel, test.build, test.fileName, test.size, "", test.uploader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resumed := session.ID == first.ID; resumed != test.resumed {
+				t.Fatalf("resumed = %v, want %v", resumed, test.resumed)
+			}
+			if test.resumed && session.Offset != 2 {
+				t.Fatalf("offset = %d, want 2", session.Offset)
+			}
+			if !test.resumed {
+				manager.Abort(session.ID)
+			}
+		})
+	}
+}
+
+func TestSessionCreateComplete(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	manager := newTestSessionManager(t, dir)
+
+	first, err := manager.Create("nightly", "", "image.iso", 5, helloChecksum, "ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.Write(first.ID, 0, strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.Finalize(first.ID, helloChecksum); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the same file is not uploaded again
+	tests := []struct {
+		name     string
+		checksum string
+		resumed  bool
+	}{
+		{"same checksum", helloChecksum, true},
+		{"other checksum", worldChecksum, false},
+		{"no checksum", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			session, err := manager.Create("nightly", "", "image.iso", 5, test.checksum, "ci")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resumed := session.ID == first.ID; resumed != test.resumed {
+				t.Fatalf("resumed = %v, want %v", resumed, test.resumed)
+			}
+			if !test.resumed {
+				if session.Build == first.Build {
+					t.Fatal("the new session was added to the build of the finalized one")
+				}
+				manager.Abort(session.ID)
+			}
+		})
+	}
+
+	// Finalizing it again is harmless
+	session, err := manager.Finalize(first.ID, helloChecksum)
+	if err != nil || !session.Complete || session.Checksum != helloChecksum {
+		t.Fatalf("Finalize() = %+v, %v", session, err)
+	}
+}
+
+func TestSessionCreateDuplicateFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	manager := newTestSessionManager(t, dir)
+
+	first, err := manager.Create("nightly", "", "image.iso", 4, "", "ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another file with the same name cannot join the build
+	tests := []struct {
+		name     string
+		size     int64
+		uploader string
+	}{
+		{"other size", 5, "ci"},
+		{"other uploader", 4, "someone"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := manager.Create("nightly", first.Build, "image.iso", test.size, "", test.uploader)
+			if !errors.Is(err, ErrDuplicateFile) {
+				t.Fatalf("Create() = %v, want %v", err, ErrDuplicateFile)
+			}
+		})
+	}
+
+	// Other builds and other files are fine
+	if _, err := manager.Create("nightly", first.Build, "image.iso.sha256sum", 4, "", "ci"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.Create("stable", first.Build, "image.iso", 5, "", "ci"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionPublishDuplicateFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	manager := newTestSessionManager(t, dir)
+
+	// Sessions written by older versions could clash
+	for _, id := range []string{"0a", "0b"} {
+		session := &UploadSession{ID: id, Channel: "nightly", Build: "b", FileName: "image.iso", Complete: true}
+		if err := ioutil.WriteFile(manager.dataPath(id), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := manager.save(session); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	published := false
+	_, err := manager.Publish("nightly", "b", func(sessions []*UploadSession, files map[string]string) error {
+		published = true
+		return nil
+	})
+	if !errors.Is(err, ErrDuplicateFile) {
+		t.Fatalf("Publish() = %v, want %v", err, ErrDuplicateFile)
+	}
+	if published {
+		t.Fatal("files were published")
+	}
+}
@@ -0,0 +1,141 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/liri-infra/image-manager/internal/logger"
+)
+
+// Requests are interrupted when the shutdown deadline expires,
+// their handlers have this long to notice
+const interruptedRequestsTimeout = 10 * time.Second
+
+// ErrRequestsInProgress is returned when the server stopped while
+// some requests were still being handled
+var ErrRequestsInProgress = errors.New("some requests did not stop in time")
+
+// requestTracker keeps count of the requests being handled, so that
+// the server knows when they are all done.
+type requestTracker struct {
+	wg sync.WaitGroup
+}
+
+// middleware counts the requests that go through it
+func (t *requestTracker) middleware(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		t.wg.Add(1)
+		defer t.wg.Done()
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// wait waits for the requests in progress, up to timeout, and
+// returns whether all of them are done.
+func (t *requestTracker) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// shutdownServer stops server, waiting up to timeout for the requests
+// in progress, then interrupts them and waits up to interruptedTimeout
+// for their handlers to return.
+func shutdownServer(server *http.Server, tracker *requestTracker, timeout, interruptedTimeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Warnf("Interrupting requests still in progress: %v", err)
+		server.Close()
+	}
+
+	if !tracker.wait(interruptedTimeout) {
+		return ErrRequestsInProgress
+	}
+	return nil
+}
+
+// RemovePartialFiles removes what uploads interrupted by a shutdown
+// or a crash left behind: staged files of single request uploads,
+// builds that were being published and files that were being stored.
+// Data of upload sessions is kept, so that clients can resume, unless
+// the session does not exist.
+// It must not be called while requests are handled.
+func RemovePartialFiles(appState *AppState) {
+	storageDir := appState.Config.StorageDir
+
+	if err := os.RemoveAll(filepath.Join(storageDir, stagingDir)); err != nil {
+		logger.Errorf("Failed to remove staged uploads: %v", err)
+	}
+
+	if appState.Storage != nil {
+		for _, imageChannel := range appState.Config.Channels {
+			prefix := channelPrefix(imageChannel)
+			publishing, err := publishingBuilds(appState.Storage, prefix)
+			if err != nil {
+				logger.Errorf("Failed to look for builds being published in channel \"%s\": %v", imageChannel.Name, err)
+				continue
+			}
+
+			for id := range publishing {
+				logger.Infof("Rolling back the publication of build %s in channel \"%s\"", id, imageChannel.Name)
+				if err := abortPublish(appState.Storage, prefix, id, path.Join(prefix, publishingDir, id)); err != nil {
+					logger.Errorf("Failed to remove build %s: %v", id, err)
+				}
+			}
+		}
+	}
+
+	// Files are written with a suffix and renamed when complete
+	err := filepath.Walk(storageDir,
+		func(walkPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				if walkPath == storageDir && os.IsNotExist(err) {
+					return filepath.SkipDir
+				}
+				return err
+			}
+
+			// Sessions are handled below
+			if info.IsDir() && walkPath == filepath.Join(storageDir, ".sessions") {
+				return filepath.SkipDir
+			}
+
+			if !info.IsDir() && strings.HasSuffix(info.Name(), ".part") {
+				logger.Infof("Removing partial file \"%s\"", walkPath)
+				if err := os.Remove(walkPath); err != nil {
+					logger.Errorf("Failed to remove \"%s\": %v", walkPath, err)
+				}
+			}
+
+			return nil
+		})
+	if err != nil {
+		logger.Errorf("Failed to look for partial files: %v", err)
+	}
+
+	if appState.Sessions != nil {
+		appState.Sessions.RemoveOrphans()
+	}
+}
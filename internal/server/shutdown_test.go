@@ -0,0 +1,75 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestShutdownServer(t *testing.T) {
+	tests := []struct {
+		name string
+		// How long the handler keeps running after it is interrupted
+		linger time.Duration
+		err    error
+	}{
+		{"requests stop", 0, nil},
+		{"requests do not stop", time.Second, ErrRequestsInProgress},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			started := make(chan struct{})
+			release := make(chan struct{})
+			done := make(chan struct{})
+
+			tracker := &requestTracker{}
+			server := httptest.NewUnstartedServer(tracker.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer close(done)
+				close(started)
+				select {
+				case <-r.Context().Done():
+					time.Sleep(test.linger)
+				case <-release:
+				}
+			})))
+			server.Start()
+			defer server.Close()
+
+			go http.Get(server.URL)
+			select {
+			case <-started:
+			case <-time.After(5 * time.Second):
+				t.Fatal("request was not handled")
+			}
+
+			err := shutdownServer(server.Config, tracker, 10*time.Millisecond, 100*time.Millisecond)
+			if err != test.err {
+				t.Fatalf("shutdownServer() = %v, want %v", err, test.err)
+			}
+
+			close(release)
+			<-done
+		})
+	}
+}
+
+func TestShutdownServerIdle(t *testing.T) {
+	tracker := &requestTracker{}
+	server := httptest.NewServer(tracker.middleware(http.NotFoundHandler()))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if err := shutdownServer(server.Config, tracker, time.Second, time.Second); err != nil {
+		t.Fatalf("shutdownServer() = %v", err)
+	}
+}
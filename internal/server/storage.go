@@ -0,0 +1,97 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Key      string
+	Size     int64
+	Modified time.Time
+}
+
+// Object is a stored object opened for reading.
+type Object interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// Storage is where the published files are kept.
+//
+// Objects are identified by keys, that are slash separated paths
+// relative to the root of the storage, such as "nightly/image.iso".
+// Methods return an error that satisfies os.IsNotExist() when
+// the object doesn't exist.
+type Storage interface {
+	// Put stores the content of r, which is size bytes long, as key.
+	Put(key string, r io.Reader, size int64) error
+	// PutFile stores a copy of the local file at path as key.
+	PutFile(key, path string) error
+	// Copy stores a copy of the object src as key.
+	Copy(key, src string) error
+	// Stat returns information about key.
+	Stat(key string) (*ObjectInfo, error)
+	// List returns all the objects whose key starts with prefix.
+	List(prefix string) ([]*ObjectInfo, error)
+	// Delete removes key.
+	Delete(key string) error
+	// Open opens key for reading.
+	Open(key string) (Object, error)
+}
+
+// NewStorage creates the storage selected by the configuration.
+func NewStorage(config *Config) (Storage, error) {
+	if config.Backend == nil || config.Backend.Type == "" || config.Backend.Type == "local" {
+		return NewLocalStorage(config.StorageDir), nil
+	}
+
+	if config.Backend.Type == "s3" {
+		return NewS3Storage(config.Backend)
+	}
+
+	return nil, fmt.Errorf("unknown storage backend \"%s\"", config.Backend.Type)
+}
+
+// channelPrefix returns the key prefix of the files of a channel.
+func channelPrefix(imageChannel *ImageChannel) string {
+	return path.Clean(filepath.ToSlash(imageChannel.Path))
+}
+
+// readObject returns the whole content of key.
+func readObject(storage Storage, key string) ([]byte, error) {
+	object, err := storage.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	return ioutil.ReadAll(object)
+}
+
+// writeObject replaces the content of key with data.
+func writeObject(storage Storage, key string, data []byte) error {
+	return storage.Put(key, bytes.NewReader(data), int64(len(data)))
+}
+
+// isHiddenKey returns whether any component of key, relative
+// to prefix, is hidden or an incomplete upload.
+func isHiddenKey(prefix, key string) bool {
+	for _, name := range strings.Split(strings.TrimPrefix(key, prefix), "/") {
+		if name != "" && !isPublished(name) {
+			return true
+		}
+	}
+	return false
+}
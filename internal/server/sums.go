@@ -0,0 +1,164 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/liri-infra/image-manager/internal/common"
+	"github.com/liri-infra/image-manager/internal/logger"
+)
+
+// Checksums of all the images of a channel are stored in this file,
+// inside the channel directory
+const sumsFile = "SHA256SUMS"
+
+// signatureExtensions maps signing types to signature file extensions
+var signatureExtensions = map[string]string{"gpg": ".asc", "ssh": ".sig"}
+
+// formatSums returns the content of the SHA256SUMS file for builds,
+// in the GNU coreutils format.
+func formatSums(builds []*BuildInfo) []byte {
+	var files []*ImageInfo
+	for _, build := range builds {
+		for _, file := range build.Files {
+			// Checksum files and signatures are not images, and
+			// checksums being calculated are added later
+			if common.IsChecksumFile(file.Name) || fileType(file.Name) == "signature" || file.SHA256 == "" {
+				continue
+			}
+			files = append(files, file)
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+
+	var buf bytes.Buffer
+	for _, file := range files {
+		fmt.Fprintf(&buf, "%s  %s\n", file.SHA256, file.Name)
+	}
+	return buf.Bytes()
+}
+
+// signSums returns a detached signature of data made with the
+// configured key.
+func signSums(signing *SigningConfig, data []byte) ([]byte, error) {
+	var cmd *exec.Cmd
+	switch signing.Type {
+	case "gpg":
+		args := []string{"--batch", "--yes", "--armor", "--detach-sign", "--local-user", signing.Key, "--output", "-"}
+		if signing.Homedir != "" {
+			args = append([]string{"--homedir", signing.Homedir}, args...)
+		}
+		cmd = exec.Command("gpg", args...)
+	case "ssh":
+		// Data from standard input is signed to standard output
+		cmd = exec.Command("ssh-keygen", "-q", "-Y", "sign", "-f", signing.Key, "-n", "file")
+	default:
+		return nil, fmt.Errorf("unknown signing type \"%s\"", signing.Type)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %v: %s", cmd.Args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// stagedSumsKey returns the key where name is written before
+// it replaces the current file, hidden from the listings
+func stagedSumsKey(prefix, name string) string {
+	return path.Join(prefix, "."+name+".new")
+}
+
+// writeSums writes the SHA256SUMS file of the channel with the specified
+// key prefix, and its signature if a signing key is configured.  When
+// signing or storing the signature fails the current files are left
+// alone, as they still match.
+func writeSums(storage Storage, prefix string, signing *SigningConfig, builds []*BuildInfo) error {
+	sums := formatSums(builds)
+	names := []string{sumsFile}
+	contents := map[string][]byte{sumsFile: sums}
+
+	// Sign before anything is written
+	if signing != nil {
+		signature, err := signSums(signing, sums)
+		if err != nil {
+			return err
+		}
+		name := sumsFile + signatureExtensions[signing.Type]
+		names = append(names, name)
+		contents[name] = signature
+	}
+
+	// Stage the new files and keep a copy of the current SHA256SUMS
+	backup := stagedSumsKey(prefix, sumsFile+".old")
+	defer func() {
+		keys := []string{backup}
+		for _, name := range names {
+			keys = append(keys, stagedSumsKey(prefix, name))
+		}
+		for _, key := range keys {
+			if err := storage.Delete(key); err != nil && !os.IsNotExist(err) {
+				logger.Errorf("Failed to remove \"%s\": %v", key, err)
+			}
+		}
+	}()
+	for _, name := range names {
+		if err := writeObject(storage, stagedSumsKey(prefix, name), contents[name]); err != nil {
+			return err
+		}
+	}
+	hasBackup := false
+	if len(names) > 1 {
+		if err := storage.Copy(backup, path.Join(prefix, sumsFile)); err == nil {
+			hasBackup = true
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// Replace SHA256SUMS, then its signature.  Should the signature
+	// fail, SHA256SUMS goes back to the version the current signature
+	// was made for, or the signature is removed, so that the files
+	// are not left mismatched
+	if err := storage.Copy(path.Join(prefix, sumsFile), stagedSumsKey(prefix, sumsFile)); err != nil {
+		return err
+	}
+	if len(names) > 1 {
+		signatureKey := path.Join(prefix, names[1])
+		if err := storage.Copy(signatureKey, stagedSumsKey(prefix, names[1])); err != nil {
+			if !hasBackup || storage.Copy(path.Join(prefix, sumsFile), backup) != nil {
+				if err := storage.Delete(signatureKey); err != nil && !os.IsNotExist(err) {
+					logger.Errorf("Failed to remove \"%s\": %v", signatureKey, err)
+				}
+			}
+			return err
+		}
+	}
+
+	// Remove signatures made with keys that are no longer configured
+	for signingType, ext := range signatureExtensions {
+		if signing == nil || signing.Type != signingType {
+			if err := storage.Delete(path.Join(prefix, sumsFile+ext)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,212 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testSumsBuilds() []*BuildInfo {
+	return []*BuildInfo{
+		{ID: "b1", Files: []*ImageInfo{
+			{Name: "b.iso", SHA256: worldChecksum},
+			{Name: "b.iso.sha256sum", SHA256: helloChecksum},
+			{Name: "b.iso.sig", SHA256: helloChecksum},
+		}},
+		{ID: "b0", Files: []*ImageInfo{
+			{Name: "a.iso", SHA256: helloChecksum},
+			{Name: "pending.iso"},
+		}},
+	}
+}
+
+func TestFormatSums(t *testing.T) {
+	expected := helloChecksum + "  a.iso\n" + worldChecksum + "  b.iso\n"
+	if sums := string(formatSums(testSumsBuilds())); sums != expected {
+		t.Fatalf("formatSums() = %q, want %q", sums, expected)
+	}
+}
+
+// readTestObject returns the content of key, or an empty string
+// if it doesn't exist
+func readTestObject(t *testing.T, storage Storage, key string) string {
+	data, err := readObject(storage, key)
+	if os.IsNotExist(err) {
+		return ""
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// checkNoStagedSums fails if staged files were left behind
+func checkNoStagedSums(t *testing.T, storage Storage) {
+	objects, err := storage.List("nightly/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, object := range objects {
+		if strings.HasSuffix(object.Key, ".new") || strings.HasSuffix(object.Key, ".part") {
+			t.Fatalf("%s was left behind", object.Key)
+		}
+	}
+}
+
+func TestWriteSums(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewLocalStorage(dir)
+
+	// A signature made with a key that is no longer configured
+	if err := writeObject(storage, "nightly/SHA256SUMS.asc", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeSums(storage, "nightly", nil, testSumsBuilds()); err != nil {
+		t.Fatal(err)
+	}
+	if sums := readTestObject(t, storage, "nightly/SHA256SUMS"); sums != string(formatSums(testSumsBuilds())) {
+		t.Fatalf("wrote %q", sums)
+	}
+	if signature := readTestObject(t, storage, "nightly/SHA256SUMS.asc"); signature != "" {
+		t.Fatal("the old signature was not removed")
+	}
+	checkNoStagedSums(t, storage)
+}
+
+func TestWriteSumsSigningFails(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewLocalStorage(dir)
+
+	for key, data := range map[string]string{"nightly/SHA256SUMS": "old sums", "nightly/SHA256SUMS.sig": "old signature"} {
+		if err := writeObject(storage, key, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	signing := &SigningConfig{Type: "ssh", Key: filepath.Join(dir, "missing")}
+	if err := writeSums(storage, "nightly", signing, testSumsBuilds()); err == nil {
+		t.Fatal("signing with a missing key succeeded")
+	}
+
+	// The files still match each other
+	if sums := readTestObject(t, storage, "nightly/SHA256SUMS"); sums != "old sums" {
+		t.Fatalf("SHA256SUMS was replaced with %q", sums)
+	}
+	if signature := readTestObject(t, storage, "nightly/SHA256SUMS.sig"); signature != "old signature" {
+		t.Fatalf("the signature was replaced with %q", signature)
+	}
+	checkNoStagedSums(t, storage)
+}
+
+func TestWriteSumsSSH(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen is not available")
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	storage := NewLocalStorage(filepath.Join(dir, "storage"))
+
+	key := filepath.Join(dir, "key")
+	if output, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "test", "-f", key).CombinedOutput(); err != nil {
+		t.Fatalf("ssh-keygen: %v: %s", err, output)
+	}
+
+	signing := &SigningConfig{Type: "ssh", Key: key}
+	if err := writeSums(storage, "nightly", signing, testSumsBuilds()); err != nil {
+		t.Fatal(err)
+	}
+	sums := readTestObject(t, storage, "nightly/SHA256SUMS")
+	signature := readTestObject(t, storage, "nightly/SHA256SUMS.sig")
+	if !strings.Contains(signature, "BEGIN SSH SIGNATURE") {
+		t.Fatalf("wrote signature %q", signature)
+	}
+	checkNoStagedSums(t, storage)
+
+	// Verify the signature against the public key
+	publicKey, err := ioutil.ReadFile(key + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowedSigners := filepath.Join(dir, "allowed_signers")
+	if err := ioutil.WriteFile(allowedSigners, append([]byte("test "), publicKey...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	signaturePath := filepath.Join(dir, "SHA256SUMS.sig")
+	if err := ioutil.WriteFile(signaturePath, []byte(signature), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("ssh-keygen", "-Y", "verify", "-f", allowedSigners, "-I", "test", "-n", "file", "-s", signaturePath)
+	cmd.Stdin = strings.NewReader(sums)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("signature does not verify: %v: %s", err, output)
+	}
+}
+
+// failingCopyStorage fails to copy to the key fail
+type failingCopyStorage struct {
+	Storage
+	fail string
+}
+
+func (s *failingCopyStorage) Copy(key, src string) error {
+	if key == s.fail {
+		return errors.New("copy failed")
+	}
+	return s.Storage.Copy(key, src)
+}
+
+func TestWriteSumsSignatureFails(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen is not available")
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	key := filepath.Join(dir, "key")
+	if output, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "test", "-f", key).CombinedOutput(); err != nil {
+		t.Fatalf("ssh-keygen: %v: %s", err, output)
+	}
+	signing := &SigningConfig{Type: "ssh", Key: key}
+
+	tests := []struct {
+		name      string
+		current   map[string]string
+		sums      string
+		signature string
+	}{
+		{"restores SHA256SUMS", map[string]string{"nightly/SHA256SUMS": "old sums", "nightly/SHA256SUMS.sig": "old signature"}, "old sums", "old signature"},
+		{"removes the signature", map[string]string{"nightly/SHA256SUMS.sig": "old signature"}, string(formatSums(testSumsBuilds())), ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := &failingCopyStorage{NewLocalStorage(filepath.Join(dir, test.name)), "nightly/SHA256SUMS.sig"}
+			for key, data := range test.current {
+				if err := writeObject(storage, key, []byte(data)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := writeSums(storage, "nightly", signing, testSumsBuilds()); err == nil {
+				t.Fatal("storing the signature succeeded")
+			}
+			if sums := readTestObject(t, storage, "nightly/SHA256SUMS"); sums != test.sums {
+				t.Fatalf("SHA256SUMS contains %q, want %q", sums, test.sums)
+			}
+			if signature := readTestObject(t, storage, "nightly/SHA256SUMS.sig"); signature != test.signature {
+				t.Fatalf("the signature is %q, want %q", signature, test.signature)
+			}
+			checkNoStagedSums(t, storage)
+		})
+	}
+}
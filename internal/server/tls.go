@@ -0,0 +1,150 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/liri-infra/image-manager/internal/logger"
+)
+
+// certificateReloader loads the server certificate again when
+// the files change, so that it can be renewed without a restart.
+type certificateReloader struct {
+	certPath    string
+	keyPath     string
+	mutex       sync.Mutex
+	certificate *tls.Certificate
+	modified    time.Time
+}
+
+func newCertificateReloader(certPath, keyPath string) (*certificateReloader, error) {
+	reloader := &certificateReloader{certPath: certPath, keyPath: keyPath}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// lastModified returns when certificate or key were last changed
+func (c *certificateReloader) lastModified() (time.Time, error) {
+	var modified time.Time
+	for _, path := range []string{c.certPath, c.keyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return modified, err
+		}
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	return modified, nil
+}
+
+// reload loads certificate and key if they changed
+func (c *certificateReloader) reload() error {
+	modified, err := c.lastModified()
+	if err != nil {
+		return err
+	}
+	if c.certificate != nil && modified.Equal(c.modified) {
+		return nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return err
+	}
+	if c.certificate != nil {
+		logger.Infof("Loaded new certificate from \"%s\"", c.certPath)
+	}
+	c.certificate = &certificate
+	c.modified = modified
+	return nil
+}
+
+// GetCertificate returns the current certificate, to be used
+// as a callback of tls.Config.
+func (c *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Keep the old certificate until the new one is complete,
+	// certificate and key might not be replaced at the same time
+	if err := c.reload(); err != nil {
+		logger.Errorf("Failed to load certificate \"%s\": %v", c.certPath, err)
+	}
+	return c.certificate, nil
+}
+
+// newTLSConfig returns the TLS configuration of the server.
+func newTLSConfig(config *TLSConfig) (*tls.Config, error) {
+	reloader, err := newCertificateReloader(config.Cert, config.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	// Clients can authenticate with a certificate rather than a token
+	if config.ClientCA != "" {
+		buf, err := ioutil.ReadFile(config.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("no certificates found in \"%s\"", config.ClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsConfig, nil
+}
+
+// identityFromCertificate returns the identity of the client certificate
+// of r, or nil if it did not present a verified certificate or the
+// certificate is not configured.
+func identityFromCertificate(appState *AppState, r *http.Request) *Identity {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	subject := r.TLS.VerifiedChains[0][0].Subject.String()
+	for _, certificate := range appState.Config.Certificates {
+		if certificate.Subject == subject {
+			return certificate.Identity()
+		}
+	}
+
+	logger.Errorf("Client certificate \"%s\" is not configured", subject)
+	return nil
+}
+
+// Identity returns what a client with this certificate can do.
+func (c *ClientCertificate) Identity() *Identity {
+	name := c.Name
+	if name == "" {
+		name = c.Subject
+	}
+
+	permissions := c.Permissions
+	if len(permissions) == 0 {
+		permissions = defaultPermissions
+	}
+
+	return &Identity{Name: name, Channels: c.Channels, Permissions: permissions}
+}
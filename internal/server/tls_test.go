@@ -0,0 +1,221 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/liri-infra/image-manager/internal/client"
+)
+
+// testCertificate is a certificate and its key
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+// newTestCertificate creates a certificate for commonName, signed by
+// parent or self-signed if parent is nil
+func newTestCertificate(t *testing.T, commonName string, parent *testCertificate) *testCertificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"Lab"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer := &testCertificate{template, key}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer = parent
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer.certificate, &key.PublicKey, signer.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCertificate{certificate, key}
+}
+
+// write saves certificate and key in the PEM format to name.crt
+// and name.key inside dir, and returns their paths
+func (c *testCertificate) write(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.certificate.Raw})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(certPath, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCertificate(t, "CA", nil)
+	first := newTestCertificate(t, "first", ca)
+	certPath, keyPath := first.write(t, dir, "server")
+
+	reloader, err := newCertificateReloader(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCertificate := func(expected *testCertificate) {
+		t.Helper()
+
+		certificate, err := reloader.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leaf, err := x509.ParseCertificate(certificate.Certificate[0]); err != nil || !leaf.Equal(expected.certificate) {
+			t.Fatalf("serving %v, want %s", leaf.Subject, expected.certificate.Subject)
+		}
+	}
+	checkCertificate(first)
+
+	// A renewed certificate is served without a restart
+	renewed := newTestCertificate(t, "renewed", ca)
+	renewed.write(t, dir, "server")
+	later := time.Now().Add(time.Minute)
+	for _, path := range []string{certPath, keyPath} {
+		if err := os.Chtimes(path, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkCertificate(renewed)
+
+	// The key does not match the certificate yet
+	newTestCertificate(t, "next", ca).write(t, dir, "next")
+	if err := os.Rename(filepath.Join(dir, "next.crt"), certPath); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	if err := os.Chtimes(certPath, later, later); err != nil {
+		t.Fatal(err)
+	}
+	checkCertificate(renewed)
+}
+
+func TestClientCertificate(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCertificate(t, "CA", nil)
+	caPath, _ := ca.write(t, dir, "ca")
+	certPath, keyPath := newTestCertificate(t, "server", ca).write(t, dir, "server")
+	workerCert, workerKey := newTestCertificate(t, "worker", ca).write(t, dir, "worker")
+	unknownCert, unknownKey := newTestCertificate(t, "unknown", ca).write(t, dir, "unknown")
+
+	appState := newTestAppState(t, dir)
+	appState.Config.TLS = &TLSConfig{Cert: certPath, Key: keyPath, ClientCA: caPath}
+	appState.Config.Certificates = []*ClientCertificate{
+		{Subject: "CN=worker,O=Lab", Channels: []string{"stable"}, Permissions: []Permission{PermissionRead}},
+	}
+
+	tlsConfig, err := newTLSConfig(appState.Config.TLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: router(NewSharedState(appState))}
+	go server.Serve(listener)
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		options  client.TLSOptions
+		channels string
+		status   int
+	}{
+		{"configured certificate", client.TLSOptions{CAFile: caPath, CertFile: workerCert, KeyFile: workerKey}, "stable", http.StatusOK},
+		{"unknown certificate", client.TLSOptions{CAFile: caPath, CertFile: unknownCert, KeyFile: unknownKey}, "", http.StatusUnauthorized},
+		{"without certificate", client.TLSOptions{CAFile: caPath}, "", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := client.NewClient("https://"+listener.Addr().String(), "", &test.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			channels, err := c.ListChannels()
+			if test.status != http.StatusOK {
+				if httpErr, ok := err.(*client.HTTPError); !ok || httpErr.StatusCode != test.status {
+					t.Fatalf("ListChannels() = %v, want status %d", err, test.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(channels) != 1 || channels[0].Name != test.channels {
+				t.Fatalf("channels %+v, want %s", channels, test.channels)
+			}
+		})
+	}
+}
+
+func TestClientCertificateIdentity(t *testing.T) {
+	certificate := &ClientCertificate{Subject: "CN=worker,O=Lab"}
+	identity := certificate.Identity()
+	if identity.Name != "CN=worker,O=Lab" || len(identity.Channels) != 0 || !identity.Can(PermissionUpload, "nightly") {
+		t.Fatalf("identity %+v", identity)
+	}
+
+	certificate = &ClientCertificate{Subject: "CN=worker,O=Lab", Name: "worker", Channels: []string{"stable"}, Permissions: []Permission{PermissionRead}}
+	identity = certificate.Identity()
+	if identity.Name != "worker" || identity.Can(PermissionUpload, "stable") || !identity.Can(PermissionRead, "stable") || identity.Can(PermissionRead, "nightly") {
+		t.Fatalf("identity %+v", identity)
+	}
+}
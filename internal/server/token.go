@@ -5,29 +5,312 @@
 package server
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
+
+	"github.com/liri-infra/image-manager/internal/logger"
+)
+
+// Permission represents an operation that a token is allowed to do
+type Permission string
+
+// Available permissions
+const (
+	PermissionUpload Permission = "upload"
+	PermissionDelete Permission = "delete"
+	PermissionRead   Permission = "read"
+	PermissionAdmin  Permission = "admin"
 )
 
-// Token represents an API token
+// Permissions granted to tokens that do not list any
+var defaultPermissions = []Permission{PermissionUpload, PermissionRead}
+
+// ParsePermission converts name to a permission
+func ParsePermission(name string) (Permission, error) {
+	switch p := Permission(name); p {
+	case PermissionUpload, PermissionDelete, PermissionRead, PermissionAdmin:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown permission \"%s\"", name)
+}
+
+// Identity represents an authenticated client and what it can do
+type Identity struct {
+	Name        string
+	Channels    []string
+	Permissions []Permission
+}
+
+// Can returns whether the identity has permission on channel,
+// an empty channel name checks a permission that is not related
+// to any channel.
+func (i *Identity) Can(permission Permission, channel string) bool {
+	granted := false
+	for _, p := range i.Permissions {
+		if p == permission || p == PermissionAdmin {
+			granted = true
+			break
+		}
+	}
+	if !granted {
+		return false
+	}
+
+	// An empty list gives access to all channels
+	if channel == "" || len(i.Channels) == 0 {
+		return true
+	}
+	for _, c := range i.Channels {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// Token represents an API token, only a salted hash of the
+// secret is stored
 type Token struct {
-	Token   string `yaml:"token"`
-	Created string `yaml:"created"`
+	ID          string       `yaml:"id,omitempty"`
+	Name        string       `yaml:"name,omitempty"`
+	Description string       `yaml:"description,omitempty"`
+	Hash        string       `yaml:"hash,omitempty"`
+	Token       string       `yaml:"token,omitempty"`
+	Created     string       `yaml:"created"`
+	Expires     string       `yaml:"expires,omitempty"`
+	Channels    []string     `yaml:"channels,omitempty"`
+	Permissions []Permission `yaml:"permissions,omitempty"`
+}
+
+// DisplayName returns the name of the token or its identifier
+func (t *Token) DisplayName() string {
+	if t.Name != "" {
+		return t.Name
+	}
+	return t.ID
+}
+
+// Age returns how long ago the token was created
+func (t *Token) Age(now time.Time) (time.Duration, error) {
+	created, err := time.Parse(time.RFC3339, t.Created)
+	if err != nil {
+		return 0, err
+	}
+	return now.Sub(created), nil
+}
+
+// SetExpiration makes the token expire after duration from now,
+// or never when duration is zero
+func (t *Token) SetExpiration(duration time.Duration) {
+	if duration == 0 {
+		t.Expires = ""
+	} else {
+		t.Expires = time.Now().UTC().Add(duration).Format(time.RFC3339)
+	}
 }
 
-// GenerateToken generates a new reandom API token
-func GenerateToken() (*Token, error) {
+// Expired returns whether the token cannot be used anymore
+func (t *Token) Expired(now time.Time) bool {
+	if t.Expires == "" {
+		return false
+	}
+
+	// Be on the safe side with a bad timestamp
+	expires, err := time.Parse(time.RFC3339, t.Expires)
+	if err != nil {
+		return true
+	}
+	return !now.Before(expires)
+}
+
+// FindToken returns the token with the specified identifier or nil
+func (c *Config) FindToken(id string) *Token {
+	for _, token := range c.Tokens {
+		if token.ID == id {
+			return token
+		}
+	}
+	return nil
+}
+
+// RemoveToken removes the token with the specified identifier and
+// returns whether it was found
+func (c *Config) RemoveToken(id string) bool {
+	for i, token := range c.Tokens {
+		if token.ID == id {
+			c.Tokens = append(c.Tokens[:i], c.Tokens[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// hashSecret returns the salted SHA-256 hash of secret in the
+// "sha256:<SALT>:<DIGEST>" format
+func hashSecret(salt []byte, secret string) string {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(secret))
+	return fmt.Sprintf("sha256:%s:%s", hex.EncodeToString(salt), hex.EncodeToString(h.Sum(nil)))
+}
+
+// setSecret stores the hash of secret with a new random salt
+func (t *Token) setSecret(secret string) error {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	t.Hash = hashSecret(salt, secret)
+	t.Token = ""
+	return nil
+}
+
+// Matches returns whether secret is the token secret, in constant time
+func (t *Token) Matches(secret string) bool {
+	// Tokens created by older versions
+	if t.Hash == "" {
+		return t.Token != "" && subtle.ConstantTimeCompare([]byte(t.Token), []byte(secret)) == 1
+	}
+
+	args := strings.Split(t.Hash, ":")
+	if len(args) != 3 || args[0] != "sha256" {
+		return false
+	}
+	salt, err := hex.DecodeString(args[1])
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(hashSecret(salt, secret)), []byte(t.Hash)) == 1
+}
+
+// GenerateToken generates a new reandom API token and returns it
+// along with the secret, which is not stored anywhere and has to be
+// handed over to the user
+func GenerateToken(channels []string, permissions []Permission) (*Token, string, error) {
+	id, err := newTokenID()
+	if err != nil {
+		return nil, "", err
+	}
+
 	key := make([]byte, 64)
 	if _, err := rand.Read(key); err != nil {
-		return nil, err
+		return nil, "", err
+	}
+
+	// The identifier prefix tells which token is in use without
+	// revealing the secret
+	token := &Token{
+		ID:          id,
+		Created:     time.Now().UTC().Format(time.RFC3339),
+		Channels:    channels,
+		Permissions: permissions,
+	}
+	secret := fmt.Sprintf("%s.%s", token.ID, base64.RawURLEncoding.EncodeToString(key))
+	if err := token.setSecret(secret); err != nil {
+		return nil, "", err
+	}
+
+	return token, secret, nil
+}
+
+// newTokenID returns a random token identifier
+func newTokenID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// legacyTokenID returns the identifier of a token created before
+// identifiers were introduced, derived from what is stored so that
+// it's the same every time the configuration file is read
+func legacyTokenID(t *Token) string {
+	sum := sha256.Sum256([]byte(t.Hash + t.Token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// AssignTokenIDs gives an identifier to the tokens created before
+// identifiers were introduced, returning how many tokens were changed.
+func (c *Config) AssignTokenIDs() int {
+	count := 0
+	for _, token := range c.Tokens {
+		if token.ID != "" {
+			continue
+		}
+		token.ID = legacyTokenID(token)
+		count++
 	}
+	return count
+}
+
+// HashPlaintextTokens replaces the secret of tokens created by older
+// versions with its hash, returning how many tokens were changed.
+// Their secret stays the same.
+func (c *Config) HashPlaintextTokens() (int, error) {
+	count := 0
+	for _, token := range c.Tokens {
+		if token.Hash != "" || token.Token == "" {
+			continue
+		}
+		if token.ID == "" {
+			token.ID = legacyTokenID(token)
+		}
+		if err := token.setSecret(token.Token); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
 
-	tokenString := base64.StdEncoding.EncodeToString(key)
+// Identity returns the identity of whoever presents the token
+func (t *Token) Identity() *Identity {
+	permissions := t.Permissions
+	if len(permissions) == 0 {
+		permissions = defaultPermissions
+	}
+
+	return &Identity{Name: t.DisplayName(), Channels: t.Channels, Permissions: permissions}
+}
 
-	return &Token{Token: tokenString, Created: time.Now().UTC().Format(time.RFC3339)}, nil
+// IdentityFromContext returns the identity of the authenticated client.
+func IdentityFromContext(ctx context.Context) *Identity {
+	identity, _ := ctx.Value(KeyIdentity).(*Identity)
+	return identity
+}
+
+// identityName returns the name of the authenticated client.
+func identityName(r *http.Request) string {
+	if identity := IdentityFromContext(r.Context()); identity != nil {
+		return identity.Name
+	}
+	return ""
+}
+
+// authorize returns whether the client is allowed permission on
+// channel, otherwise it replies with an error.
+func authorize(w http.ResponseWriter, r *http.Request, permission Permission, channel string) bool {
+	identity := IdentityFromContext(r.Context())
+	if identity == nil || !identity.Can(permission, channel) {
+		logger.Errorf("Permission \"%s\" denied to \"%s\" on channel \"%s\"", permission, identityName(r), channel)
+		if appState, ok := r.Context().Value(KeyAppState).(*AppState); ok {
+			appState.Metrics.AuthFailed(AuthForbidden)
+		}
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return false
+	}
+	return true
 }
 
 func tokenFromHeader(r *http.Request) string {
@@ -38,32 +321,87 @@ func tokenFromHeader(r *http.Request) string {
 	return ""
 }
 
-// TokenVerifier HTTP middleware handler will verify token in a HTTP request
-// Checks if the HTTP request has 'Authorization: BEARER T' header.
-func TokenVerifier(appState *AppState) func(next http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		fn := func(w http.ResponseWriter, r *http.Request) {
-			tokenString := tokenFromHeader(r)
-			if tokenString == "" {
-				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-				return
+// identityFromToken returns the identity of whoever presents
+// tokenString, or nil if it's not valid.
+func identityFromToken(appState *AppState, tokenString string) *Identity {
+	for _, token := range appState.Config.Tokens {
+		if token.Matches(tokenString) {
+			if token.Expired(time.Now()) {
+				logger.Errorf("Token \"%s\" has expired", token.DisplayName())
+				return nil
 			}
+			return token.Identity()
+		}
+	}
+	return nil
+}
 
-			// Check if the token is valid
-			found := false
-			for _, token := range appState.Config.Tokens {
-				if token.Token == tokenString {
-					found = true
-					break
-				}
-			}
-			if !found {
+// TokenVerifier HTTP middleware handler will verify token in a HTTP request
+// Checks if the HTTP request has 'Authorization: BEARER T' header, or
+// otherwise a configured client certificate.
+func TokenVerifier(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		appState := appStateFromRequest(w, r)
+		if appState == nil {
+			return
+		}
+
+		tokenString := tokenFromHeader(r)
+		if tokenString == "" {
+			identity := identityFromCertificate(appState, r)
+			if identity == nil {
+				appState.Metrics.AuthFailed(AuthMissingToken)
 				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 				return
 			}
 
+			ctx := context.WithValue(r.Context(), KeyIdentity, identity)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		// Check if the token is valid
+		identity := identityFromToken(appState, tokenString)
+		if identity == nil {
+			appState.Metrics.AuthFailed(AuthInvalidToken)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), KeyIdentity, identity)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+	return http.HandlerFunc(fn)
+}
+
+// OptionalTokenVerifier HTTP middleware handler is like TokenVerifier,
+// but lets anonymous requests through without an identity.
+func OptionalTokenVerifier(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		appState := appStateFromRequest(w, r)
+		if appState == nil {
+			return
+		}
+
+		tokenString := tokenFromHeader(r)
+		if tokenString == "" {
+			if identity := identityFromCertificate(appState, r); identity != nil {
+				r = r.WithContext(context.WithValue(r.Context(), KeyIdentity, identity))
+			}
 			next.ServeHTTP(w, r)
+			return
 		}
-		return http.HandlerFunc(fn)
+
+		// Check if the token is valid
+		identity := identityFromToken(appState, tokenString)
+		if identity == nil {
+			appState.Metrics.AuthFailed(AuthInvalidToken)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), KeyIdentity, identity)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	}
+	return http.HandlerFunc(fn)
 }
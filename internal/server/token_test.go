@@ -0,0 +1,353 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashSecret(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	hash := hashSecret(salt, "secret")
+
+	args := strings.Split(hash, ":")
+	if len(args) != 3 || args[0] != "sha256" || args[1] != "30313233343536373839616263646566" {
+		t.Fatalf("unexpected format %q", hash)
+	}
+	if len(args[2]) != 64 {
+		t.Fatalf("digest %q is not a hex-encoded SHA-256", args[2])
+	}
+
+	if hashSecret(salt, "secret") != hash {
+		t.Fatal("same salt and secret give different hashes")
+	}
+	if hashSecret([]byte("fedcba9876543210"), "secret") == hash {
+		t.Fatal("different salts give the same hash")
+	}
+}
+
+func TestGenerateToken(t *testing.T) {
+	token, secret, err := GenerateToken([]string{"nightly"}, []Permission{PermissionUpload})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token.Token != "" {
+		t.Fatal("the secret is stored in the clear")
+	}
+	if strings.Contains(token.Hash, secret) {
+		t.Fatal("the hash contains the secret")
+	}
+	if !strings.HasPrefix(secret, token.ID+".") {
+		t.Fatalf("secret %q does not start with identifier %q", secret, token.ID)
+	}
+
+	other, otherSecret, err := GenerateToken(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.ID == token.ID || otherSecret == secret {
+		t.Fatal("two tokens are the same")
+	}
+}
+
+func TestTokenMatches(t *testing.T) {
+	token, secret, err := GenerateToken(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   *Token
+		secret  string
+		matches bool
+	}{
+		{"right secret", token, secret, true},
+		{"wrong secret", token, secret + "x", false},
+		{"prefix of the secret", token, secret[:len(secret)-1], false},
+		{"empty secret", token, "", false},
+		{"hash as secret", token, token.Hash, false},
+		{"legacy token", &Token{Token: "plain"}, "plain", true},
+		{"legacy token with wrong secret", &Token{Token: "plain"}, "other", false},
+		{"legacy token without secret", &Token{}, "", false},
+		{"unknown algorithm", &Token{Hash: "md5:00:00"}, "", false},
+		{"bad salt", &Token{Hash: "sha256:zz:00"}, "", false},
+		{"truncated hash", &Token{Hash: "sha256:00"}, "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if matches := test.token.Matches(test.secret); matches != test.matches {
+				t.Fatalf("Matches() = %v, want %v", matches, test.matches)
+			}
+		})
+	}
+}
+
+func TestHashPlaintextTokens(t *testing.T) {
+	config := &Config{Tokens: []*Token{
+		{Token: "legacy"},
+		{ID: "abcd", Token: "other"},
+	}}
+
+	count, err := config.HashPlaintextTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("%d tokens were hashed, want 2", count)
+	}
+
+	for i, secret := range []string{"legacy", "other"} {
+		token := config.Tokens[i]
+		if token.Token != "" || token.ID == "" {
+			t.Fatalf("token %d was not converted: %+v", i, token)
+		}
+		if !token.Matches(secret) {
+			t.Fatalf("token %d does not match its secret anymore", i)
+		}
+	}
+	if config.Tokens[1].ID != "abcd" {
+		t.Fatal("the identifier was changed")
+	}
+
+	// The identifier does not depend on the random salt
+	again := &Config{Tokens: []*Token{{Token: "legacy"}}}
+	if _, err := again.HashPlaintextTokens(); err != nil {
+		t.Fatal(err)
+	}
+	if again.Tokens[0].ID != config.Tokens[0].ID {
+		t.Fatalf("identifier %s, then %s", config.Tokens[0].ID, again.Tokens[0].ID)
+	}
+}
+
+func TestTokenExpired(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		expires string
+		expired bool
+	}{
+		{"never", "", false},
+		{"future", "2020-06-02T12:00:00Z", false},
+		{"past", "2020-05-31T12:00:00Z", true},
+		{"now", "2020-06-01T12:00:00Z", true},
+		{"bad timestamp", "tomorrow", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token := &Token{Expires: test.expires}
+			if expired := token.Expired(now); expired != test.expired {
+				t.Fatalf("Expired() = %v, want %v", expired, test.expired)
+			}
+		})
+	}
+}
+
+func TestTokenSetExpiration(t *testing.T) {
+	token := &Token{}
+	token.SetExpiration(time.Hour)
+	if token.Expired(time.Now()) {
+		t.Fatal("token expired right away")
+	}
+	if !token.Expired(time.Now().Add(2 * time.Hour)) {
+		t.Fatal("token did not expire")
+	}
+
+	token.SetExpiration(0)
+	if token.Expires != "" {
+		t.Fatal("token still expires")
+	}
+}
+
+func TestIdentityFromToken(t *testing.T) {
+	valid, validSecret, _ := GenerateToken([]string{"nightly"}, nil)
+	expired, expiredSecret, _ := GenerateToken(nil, nil)
+	expired.Expires = "2000-01-01T00:00:00Z"
+	appState := &AppState{Config: &Config{Tokens: []*Token{valid, expired}}}
+
+	identity := identityFromToken(appState, validSecret)
+	if identity == nil {
+		t.Fatal("valid token was rejected")
+	}
+	if !identity.Can(PermissionUpload, "nightly") || identity.Can(PermissionUpload, "stable") {
+		t.Fatal("wrong channels for the token")
+	}
+	if identity.Can(PermissionDelete, "nightly") {
+		t.Fatal("default permissions include delete")
+	}
+
+	if identityFromToken(appState, expiredSecret) != nil {
+		t.Fatal("expired token was accepted")
+	}
+	if identityFromToken(appState, "unknown") != nil {
+		t.Fatal("unknown token was accepted")
+	}
+}
+
+func TestAssignTokenIDs(t *testing.T) {
+	token, secret, _ := GenerateToken(nil, nil)
+	id := token.ID
+	legacy := &Token{Hash: token.Hash}
+	config := &Config{Tokens: []*Token{token, legacy}}
+
+	count := config.AssignTokenIDs()
+	if count != 1 {
+		t.Fatalf("%d tokens were changed, want 1", count)
+	}
+	if token.ID != id {
+		t.Fatal("an existing identifier was changed")
+	}
+	if legacy.ID == "" || config.FindToken(legacy.ID) != legacy {
+		t.Fatal("the legacy token cannot be found by identifier")
+	}
+	if !legacy.Matches(secret) {
+		t.Fatal("the secret was changed")
+	}
+
+	// The same identifier is given every time the file is read
+	again := &Token{Hash: token.Hash}
+	(&Config{Tokens: []*Token{again}}).AssignTokenIDs()
+	if again.ID != legacy.ID {
+		t.Fatalf("identifier %s, then %s", legacy.ID, again.ID)
+	}
+}
+
+func TestParsePermission(t *testing.T) {
+	for _, name := range []string{"upload", "delete", "read", "admin"} {
+		if permission, err := ParsePermission(name); err != nil || string(permission) != name {
+			t.Errorf("ParsePermission(%q) = %q, %v", name, permission, err)
+		}
+	}
+	if _, err := ParsePermission("write"); err == nil {
+		t.Error("unknown permission was accepted")
+	}
+}
+
+func TestIdentityCan(t *testing.T) {
+	uploader := &Identity{Channels: []string{"nightly"}, Permissions: []Permission{PermissionUpload}}
+	admin := &Identity{Permissions: []Permission{PermissionAdmin}}
+	scopedAdmin := &Identity{Channels: []string{"nightly"}, Permissions: []Permission{PermissionAdmin}}
+
+	tests := []struct {
+		name       string
+		identity   *Identity
+		permission Permission
+		channel    string
+		can        bool
+	}{
+		{"allowed channel", uploader, PermissionUpload, "nightly", true},
+		{"other channel", uploader, PermissionUpload, "stable", false},
+		{"other permission", uploader, PermissionDelete, "nightly", false},
+		{"no channel", uploader, PermissionUpload, "", true},
+		{"admin on any channel", admin, PermissionDelete, "stable", true},
+		{"admin limited to channels", scopedAdmin, PermissionDelete, "stable", false},
+		{"no permissions", &Identity{}, PermissionRead, "nightly", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if can := test.identity.Can(test.permission, test.channel); can != test.can {
+				t.Fatalf("Can(%s, %q) = %v, want %v", test.permission, test.channel, can, test.can)
+			}
+		})
+	}
+}
+
+func TestTokenIdentity(t *testing.T) {
+	identity := (&Token{ID: "abcd"}).Identity()
+	if identity.Name != "abcd" || !identity.Can(PermissionUpload, "nightly") || !identity.Can(PermissionRead, "nightly") {
+		t.Fatalf("identity %+v", identity)
+	}
+	if identity.Can(PermissionDelete, "nightly") || identity.Can(PermissionAdmin, "") {
+		t.Fatal("default permissions are too wide")
+	}
+
+	identity = (&Token{ID: "abcd", Name: "ci", Channels: []string{"nightly"}, Permissions: []Permission{PermissionDelete}}).Identity()
+	if identity.Name != "ci" || !identity.Can(PermissionDelete, "nightly") || identity.Can(PermissionUpload, "nightly") {
+		t.Fatalf("identity %+v", identity)
+	}
+}
+
+func TestTokenVerifier(t *testing.T) {
+	token, secret, err := GenerateToken([]string{"nightly"}, []Permission{PermissionUpload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token.Name = "ci"
+	appState := &AppState{Config: &Config{Tokens: []*Token{token}}}
+
+	var identity *Identity
+	handler := TokenVerifier(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity = IdentityFromContext(r.Context())
+	}))
+
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"missing token", "", http.StatusUnauthorized},
+		{"invalid token", "Bearer invalid", http.StatusUnauthorized},
+		{"valid token", "Bearer " + secret, http.StatusOK},
+		{"lower case", "bearer " + secret, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			identity = nil
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.header != "" {
+				r.Header.Set("Authorization", test.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), KeyAppState, appState)))
+
+			if w.Code != test.status {
+				t.Fatalf("status %d, want %d", w.Code, test.status)
+			}
+			if test.status == http.StatusOK && (identity == nil || identity.Name != "ci") {
+				t.Fatalf("identity %+v", identity)
+			}
+			if test.status != http.StatusOK && identity != nil {
+				t.Fatal("the request was handled")
+			}
+		})
+	}
+}
+
+func TestUploadOtherChannel(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	appState := newTestAppState(t, dir)
+	identity := &Identity{Name: "ci", Channels: []string{"stable"}, Permissions: []Permission{PermissionUpload}}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		target  string
+		params  map[string]string
+	}{
+		{"upload", UploadHandler, "/api/v1/upload/nightly", map[string]string{"channel": "nightly"}},
+		{"session", CreateSessionHandler, "/api/v1/upload/nightly/sessions", map[string]string{"channel": "nightly"}},
+		{"publish", PublishBuildHandler, "/api/v1/upload/nightly/builds/b/publish", map[string]string{"channel": "nightly", "id": "b"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestRequest(appState, http.MethodPost, test.target, strings.NewReader("{}"), test.params)
+			w := httptest.NewRecorder()
+			test.handler(w, withIdentity(r, identity))
+
+			if w.Code != http.StatusForbidden {
+				t.Fatalf("status %d, want %d", w.Code, http.StatusForbidden)
+			}
+		})
+	}
+}
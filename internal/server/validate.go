@@ -0,0 +1,329 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ConfigError lists the problems found in a configuration file.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	if len(e.Problems) == 1 {
+		return e.Problems[0]
+	}
+	return fmt.Sprintf("%d problems found:\n  %s", len(e.Problems), strings.Join(e.Problems, "\n  "))
+}
+
+// configLines tells where things are defined in a configuration file,
+// for error messages.  It only understands the block style written by
+// Save, anything else has no line number.
+type configLines struct {
+	lines []string
+	items map[string][]int
+}
+
+func newConfigLines(buf []byte) *configLines {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return &configLines{lines: lines, items: map[string][]int{}}
+}
+
+// indentation returns the number of leading spaces of line
+func indentation(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// isBlank returns whether line has no content
+func isBlank(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return trimmed == "" || strings.HasPrefix(trimmed, "#")
+}
+
+// key returns the line number of the top-level key, or 0
+func (c *configLines) key(key string) int {
+	for i, line := range c.lines {
+		if strings.HasPrefix(line, key+":") {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// scan returns the line numbers of the items of the top-level
+// sequence key
+func (c *configLines) scan(key string) []int {
+	start := c.key(key)
+	if start == 0 {
+		return nil
+	}
+
+	var items []int
+	indent := -1
+	for i := start; i < len(c.lines); i++ {
+		line := c.lines[i]
+		if isBlank(line) {
+			continue
+		}
+
+		lineIndent := indentation(line)
+		isItem := strings.HasPrefix(strings.TrimSpace(line), "-")
+		if indent < 0 {
+			if !isItem {
+				break
+			}
+			indent = lineIndent
+		}
+
+		if lineIndent < indent || (lineIndent == indent && !isItem) {
+			break
+		}
+		if lineIndent == indent {
+			items = append(items, i+1)
+		}
+	}
+	return items
+}
+
+// locate finds the items of the top-level sequence key, which has
+// count items once parsed.  If the scanner sees a different number
+// of items, the file is written in a way it does not understand and
+// none of them gets a line number rather than a wrong one.
+func (c *configLines) locate(key string, count int) {
+	if items := c.scan(key); len(items) == count {
+		c.items[key] = items
+	}
+}
+
+// at returns a prefix that tells where item index of the top-level
+// sequence key is defined, if known
+func (c *configLines) at(key string, index int) string {
+	items := c.items[key]
+	if index < len(items) {
+		return fmt.Sprintf("line %d: ", items[index])
+	}
+	return ""
+}
+
+// previous returns a suffix that tells where item index of the
+// top-level sequence key is defined, if known
+func (c *configLines) previous(key string, index int) string {
+	items := c.items[key]
+	if index < len(items) {
+		return fmt.Sprintf(" (line %d)", items[index])
+	}
+	return ""
+}
+
+// atKey returns a prefix that tells where the top-level key is
+// defined, if known
+func (c *configLines) atKey(key string) string {
+	if line := c.key(key); line > 0 {
+		return fmt.Sprintf("line %d: ", line)
+	}
+	return ""
+}
+
+// validateChannelPath checks that the directory of a channel is
+// inside the storage location, and does not clash with the
+// directories used by the server
+func validateChannelPath(channelPath string) error {
+	slashed := filepath.ToSlash(channelPath)
+	if path.IsAbs(slashed) || filepath.IsAbs(channelPath) {
+		return fmt.Errorf("path \"%s\" must be relative to the storage location", channelPath)
+	}
+
+	for _, component := range strings.Split(slashed, "/") {
+		if component == ".." {
+			return fmt.Errorf("path \"%s\" must not contain \"..\"", channelPath)
+		}
+		if strings.HasPrefix(component, ".") && component != "." {
+			return fmt.Errorf("path \"%s\" must not contain hidden directories", channelPath)
+		}
+	}
+
+	if path.Clean(slashed) == "." {
+		return fmt.Errorf("path \"%s\" must be a directory inside the storage location", channelPath)
+	}
+
+	return nil
+}
+
+// pathsOverlap returns whether the directory a contains b or the other
+// way round, both are cleaned slash-separated paths
+func pathsOverlap(a, b string) bool {
+	return a == b || strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
+
+// validate checks the configuration read from buf, and sets the
+// defaults of the channels
+func (c *Config) validate(buf []byte) error {
+	lines := newConfigLines(buf)
+	lines.locate("channels", len(c.Channels))
+	lines.locate("tokens", len(c.Tokens))
+	lines.locate("webhooks", len(c.Webhooks))
+	lines.locate("certificates", len(c.Certificates))
+	var problems []string
+	problem := func(where, format string, args ...interface{}) {
+		problems = append(problems, where+fmt.Sprintf(format, args...))
+	}
+
+	// Channels
+	names := map[string]int{}
+	var paths []string
+	for i, channel := range c.Channels {
+		at := lines.at("channels", i)
+		if channel == nil {
+			problem(at, "empty channel")
+			paths = append(paths, "")
+			continue
+		}
+
+		if channel.Name == "" {
+			problem(at, "channel without name")
+		} else if strings.ContainsAny(channel.Name, "/ ") {
+			problem(at, "channel name \"%s\" must not contain slashes or spaces", channel.Name)
+		} else if first, ok := names[channel.Name]; ok {
+			problem(at, "channel \"%s\" is already defined%s", channel.Name, lines.previous("channels", first))
+		} else {
+			names[channel.Name] = i
+		}
+
+		// Default channel relative path is the name
+		if channel.Path == "" {
+			channel.Path = channel.Name
+		}
+
+		if err := validateChannelPath(channel.Path); err != nil {
+			problem(at, "channel \"%s\": %v", channel.Name, err)
+			paths = append(paths, "")
+		} else {
+			cleaned := path.Clean(filepath.ToSlash(channel.Path))
+			for j, other := range paths {
+				if other != "" && pathsOverlap(cleaned, other) {
+					problem(at, "channel \"%s\" shares its directory with channel \"%s\"%s",
+						channel.Name, c.Channels[j].Name, lines.previous("channels", j))
+					break
+				}
+			}
+			paths = append(paths, cleaned)
+		}
+
+		if channel.Retention != nil {
+			if err := channel.Retention.parse(); err != nil {
+				problem(at, "invalid retention policy for channel \"%s\": %v", channel.Name, err)
+			}
+		}
+	}
+
+	// Tokens
+	ids := map[string]int{}
+	for i, token := range c.Tokens {
+		at := lines.at("tokens", i)
+		if token == nil {
+			problem(at, "empty token")
+			continue
+		}
+
+		if token.Hash == "" && token.Token == "" {
+			problem(at, "token \"%s\" has neither hash nor secret", token.DisplayName())
+		} else if token.Hash != "" {
+			args := strings.Split(token.Hash, ":")
+			if len(args) != 3 || args[0] != "sha256" || args[1] == "" || args[2] == "" {
+				problem(at, "token \"%s\" has an invalid hash", token.DisplayName())
+			}
+		}
+
+		if token.ID != "" {
+			if first, ok := ids[token.ID]; ok {
+				problem(at, "token identifier \"%s\" is already used%s", token.ID, lines.previous("tokens", first))
+			} else {
+				ids[token.ID] = i
+			}
+		}
+
+		for _, permission := range token.Permissions {
+			if _, err := ParsePermission(string(permission)); err != nil {
+				problem(at, "token \"%s\": %v", token.DisplayName(), err)
+			}
+		}
+		for _, name := range token.Channels {
+			if c.FindChannel(name) == nil {
+				problem(at, "token \"%s\" refers to unknown channel \"%s\"", token.DisplayName(), name)
+			}
+		}
+	}
+
+	// Signing key
+	if c.Signing != nil {
+		at := lines.atKey("signing")
+		if c.Signing.Type != "gpg" && c.Signing.Type != "ssh" {
+			problem(at, "unknown signing type \"%s\"", c.Signing.Type)
+		}
+		if c.Signing.Key == "" {
+			problem(at, "signing key is not configured")
+		}
+	}
+
+	// Webhooks
+	for i, webhook := range c.Webhooks {
+		at := lines.at("webhooks", i)
+		if webhook == nil {
+			problem(at, "empty webhook")
+			continue
+		}
+
+		if err := webhook.validate(); err != nil {
+			problem(at, "%v", err)
+		}
+		for _, name := range webhook.Channels {
+			if c.FindChannel(name) == nil {
+				problem(at, "webhook \"%s\" refers to unknown channel \"%s\"", webhook.URL, name)
+			}
+		}
+	}
+
+	// TLS
+	if c.TLS != nil && (c.TLS.Cert == "" || c.TLS.Key == "") {
+		problem(lines.atKey("tls"), "TLS requires both certificate and key")
+	}
+	for i, certificate := range c.Certificates {
+		at := lines.at("certificates", i)
+		if certificate == nil {
+			problem(at, "empty client certificate")
+			continue
+		}
+
+		if certificate.Subject == "" {
+			problem(at, "client certificate without subject")
+		}
+		for _, permission := range certificate.Permissions {
+			if _, err := ParsePermission(string(permission)); err != nil {
+				problem(at, "client certificate \"%s\": %v", certificate.Subject, err)
+			}
+		}
+		for _, name := range certificate.Channels {
+			if c.FindChannel(name) == nil {
+				problem(at, "client certificate \"%s\" refers to unknown channel \"%s\"", certificate.Subject, name)
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+// validateTestConfig parses text and returns the problems found
+func validateTestConfig(t *testing.T, text string) (*Config, []string) {
+	buf := []byte(strings.TrimLeft(text, "\n"))
+	var config Config
+	if err := yaml.UnmarshalStrict(buf, &config); err != nil {
+		t.Fatal(err)
+	}
+
+	err := config.validate(buf)
+	if err == nil {
+		return &config, nil
+	}
+	configErr, ok := err.(*ConfigError)
+	if !ok {
+		t.Fatalf("validate() = %T, want *ConfigError", err)
+	}
+	return &config, configErr.Problems
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		problems []string
+	}{
+		{"valid", `
+storage: /srv/images
+channels:
+  - name: nightly
+  - name: stable
+    path: releases/stable
+tokens:
+  - id: ci
+    hash: sha256:salt:digest
+    permissions: [upload]
+`, nil},
+		{"duplicate channel", `
+storage: /srv/images
+channels:
+  - name: nightly
+  - name: stable
+  - name: nightly
+    path: again
+`, []string{
+			`line 5: channel "nightly" is already defined (line 3)`,
+		}},
+		{"channel without name", `
+channels:
+  - path: nightly
+  - name: "night ly"
+`, []string{
+			`line 2: channel without name`,
+			`line 3: channel name "night ly" must not contain slashes or spaces`,
+		}},
+		{"parent directory", `
+channels:
+  - name: nightly
+    path: ../nightly
+`, []string{
+			`line 2: channel "nightly": path "../nightly" must not contain ".."`,
+		}},
+		{"absolute path", `
+channels:
+  - name: nightly
+    path: /srv/nightly
+`, []string{
+			`line 2: channel "nightly": path "/srv/nightly" must be relative to the storage location`,
+		}},
+		{"hidden directory", `
+channels:
+  - name: nightly
+    path: .sessions
+`, []string{
+			`line 2: channel "nightly": path ".sessions" must not contain hidden directories`,
+		}},
+		{"storage location", `
+channels:
+  - name: nightly
+    path: ./
+`, []string{
+			`line 2: channel "nightly": path "./" must be a directory inside the storage location`,
+		}},
+		{"overlapping paths", `
+channels:
+  - name: nightly
+    path: images
+  - name: stable
+    path: images/stable
+  - name: testing
+    path: images
+`, []string{
+			`line 4: channel "stable" shares its directory with channel "nightly" (line 2)`,
+			`line 6: channel "testing" shares its directory with channel "nightly" (line 2)`,
+		}},
+		{"empty token", `
+channels:
+  - name: nightly
+tokens:
+  -
+  - id: ci
+`, []string{
+			`line 4: empty token`,
+			`line 5: token "ci" has neither hash nor secret`,
+		}},
+		{"invalid tokens", `
+tokens:
+  - id: ci
+    hash: md5:digest
+  - id: ci
+    token: secret
+    permissions: [write]
+`, []string{
+			`line 2: token "ci" has an invalid hash`,
+			`line 4: token identifier "ci" is already used (line 2)`,
+			`line 4: token "ci": unknown permission "write"`,
+		}},
+		{"signing", `
+channels:
+  - name: nightly
+signing:
+  type: pgp
+`, []string{
+			`line 3: unknown signing type "pgp"`,
+			`line 3: signing key is not configured`,
+		}},
+		{"webhook channel", `
+channels:
+  - name: nightly
+webhooks:
+  - url: https://example.com/hook
+    channels: [stable]
+`, []string{
+			`line 4: webhook "https://example.com/hook" refers to unknown channel "stable"`,
+		}},
+		{"token channel", `
+channels:
+  - name: nightly
+tokens:
+  - id: ci
+    hash: sha256:salt:digest
+    channels: [nightly, stable]
+`, []string{
+			`line 4: token "ci" refers to unknown channel "stable"`,
+		}},
+		{"certificate channel", `
+channels:
+  - name: nightly
+certificates:
+  - subject: CN=worker
+    channels: [stable]
+`, []string{
+			`line 4: client certificate "CN=worker" refers to unknown channel "stable"`,
+		}},
+		{"tls", `
+tls:
+  cert: server.crt
+certificates:
+  - name: ci
+`, []string{
+			`line 1: TLS requires both certificate and key`,
+			`line 4: client certificate without subject`,
+		}},
+		{"flow style", `
+channels: [{name: nightly}, {name: nightly}]
+`, []string{
+			`channel "nightly" is already defined`,
+			`channel "nightly" shares its directory with channel "nightly"`,
+		}},
+		{"items not understood", `
+channels:
+  - name: "night
+  - ly"
+  - name: nightly
+  - name: nightly
+`, []string{
+			`channel name "night - ly" must not contain slashes or spaces`,
+			`channel "nightly" is already defined`,
+			`channel "nightly" shares its directory with channel "nightly"`,
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, problems := validateTestConfig(t, test.text)
+			if !reflect.DeepEqual(problems, test.problems) {
+				t.Fatalf("problems:\n%s\nwant:\n%s", strings.Join(problems, "\n"), strings.Join(test.problems, "\n"))
+			}
+		})
+	}
+}
+
+func TestConfigValidateDefaultPath(t *testing.T) {
+	config, problems := validateTestConfig(t, `
+channels:
+  - name: nightly
+  - name: stable
+    path: releases/stable
+`)
+	if problems != nil {
+		t.Fatalf("problems %v", problems)
+	}
+	if path := config.Channels[0].Path; path != "nightly" {
+		t.Fatalf("path %q, want the channel name", path)
+	}
+	if path := config.Channels[1].Path; path != "releases/stable" {
+		t.Fatalf("path %q, want releases/stable", path)
+	}
+}
+
+func TestConfigError(t *testing.T) {
+	err := &ConfigError{Problems: []string{"line 1: first"}}
+	if err.Error() != "line 1: first" {
+		t.Fatalf("Error() = %q", err.Error())
+	}
+
+	err = &ConfigError{Problems: []string{"line 1: first", "line 2: second"}}
+	if expected := "2 problems found:\n  line 1: first\n  line 2: second"; err.Error() != expected {
+		t.Fatalf("Error() = %q, want %q", err.Error(), expected)
+	}
+}
+
+func TestOpenConfig(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name string
+		text string
+		err  string
+	}{
+		{"valid", "storage: /srv/images\nchannels:\n  - name: nightly\n", ""},
+		{"unknown key", "channels:\n  - name: nightly\n    pth: images\n", "line 3: field pth not found"},
+		{"invalid", "channels:\n  - name: nightly\n  - name: nightly\n", `line 3: channel "nightly" is already defined (line 2)`},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, fmt.Sprintf("config%d.yaml", i))
+			if err := ioutil.WriteFile(path, []byte(test.text), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			config, err := OpenConfig(path)
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("OpenConfig() = %v", err)
+				}
+				if config.path != path || config.Channels[0].Path != "nightly" {
+					t.Fatalf("config %+v", config)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("OpenConfig() = %v, want %q", err, test.err)
+			}
+		})
+	}
+}
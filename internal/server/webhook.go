@@ -0,0 +1,352 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/liri-infra/image-manager/internal/logger"
+)
+
+// Deliveries are attempted this many times before giving up
+const webhookMaxAttempts = 8
+
+// Number of deliveries kept in memory
+const webhookLogSize = 200
+
+// WebhookConfig represents a configured webhook.
+type WebhookConfig struct {
+	URL string `yaml:"url"`
+	// Events that are sent, empty means all of them
+	Events []EventType `yaml:"events,omitempty"`
+	// Channels whose events are sent, empty means all of them
+	Channels []string `yaml:"channels,omitempty"`
+	// Key of the HMAC-SHA256 signature of the payload
+	Secret string `yaml:"secret,omitempty"`
+}
+
+// validate checks the webhook configuration
+func (c *WebhookConfig) validate() error {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook URL \"%s\"", c.URL)
+	}
+
+	for _, eventType := range c.Events {
+		if !isValidEventType(eventType) {
+			return fmt.Errorf("unknown event \"%s\" for webhook \"%s\"", eventType, c.URL)
+		}
+	}
+
+	return nil
+}
+
+// Wants returns whether event has to be sent to the webhook.
+func (c *WebhookConfig) Wants(event *Event) bool {
+	return (len(c.Events) == 0 || containsEventType(c.Events, event.Type)) &&
+		(len(c.Channels) == 0 || containsString(c.Channels, event.Channel))
+}
+
+func containsEventType(list []EventType, value EventType) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery records an attempt to deliver an event.
+type WebhookDelivery struct {
+	URL        string    `json:"url"`
+	Event      uint64    `json:"event"`
+	Type       EventType `json:"type"`
+	Channel    string    `json:"channel"`
+	Attempt    int       `json:"attempt"`
+	Time       string    `json:"time"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// webhookTarget is a configured webhook, whose failed deliveries are
+// retried until its context is cancelled
+type webhookTarget struct {
+	config *WebhookConfig
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newWebhookTarget(config *WebhookConfig) *webhookTarget {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &webhookTarget{config: config, ctx: ctx, cancel: cancel}
+}
+
+// WebhookDispatcher sends events to the configured webhooks, in the
+// background, and keeps a log of the deliveries.
+type WebhookDispatcher struct {
+	mutex      sync.Mutex
+	webhooks   []*webhookTarget
+	httpClient *http.Client
+	logPath    string
+	log        []*WebhookDelivery
+	closed     bool
+
+	// Deliveries in progress, waited for when closing
+	deliveries sync.WaitGroup
+	// Delay before the second attempt, doubled with each attempt
+	retryDelay time.Duration
+	// How long closing waits for the deliveries in progress
+	closeTimeout time.Duration
+}
+
+// NewWebhookDispatcher creates a dispatcher for webhooks, which
+// appends the delivery log to the file at logPath if not empty.
+func NewWebhookDispatcher(webhooks []*WebhookConfig, logPath string) *WebhookDispatcher {
+	d := &WebhookDispatcher{
+		httpClient:   &http.Client{Timeout: 30 * time.Second},
+		logPath:      logPath,
+		retryDelay:   time.Second,
+		closeTimeout: 10 * time.Second,
+	}
+	for _, webhook := range webhooks {
+		d.webhooks = append(d.webhooks, newWebhookTarget(webhook))
+	}
+	return d
+}
+
+// SetWebhooks replaces the webhooks, failed deliveries to those
+// that were removed or changed are not retried.
+func (d *WebhookDispatcher) SetWebhooks(webhooks []*WebhookConfig) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	previous := d.webhooks
+	d.webhooks = nil
+	for _, webhook := range webhooks {
+		// Unchanged webhooks keep retrying
+		var target *webhookTarget
+		for i, old := range previous {
+			if old != nil && reflect.DeepEqual(old.config, webhook) {
+				target = old
+				previous[i] = nil
+				break
+			}
+		}
+		if target == nil {
+			target = newWebhookTarget(webhook)
+			if d.closed {
+				target.cancel()
+			}
+		}
+		d.webhooks = append(d.webhooks, target)
+	}
+
+	for _, target := range previous {
+		if target != nil {
+			target.cancel()
+		}
+	}
+}
+
+// Close stops retrying failed deliveries, no more events are sent.
+// It waits for a while for the deliveries in progress.
+func (d *WebhookDispatcher) Close() {
+	d.mutex.Lock()
+	d.closed = true
+	for _, target := range d.webhooks {
+		target.cancel()
+	}
+	d.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.deliveries.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(d.closeTimeout):
+		logger.Warnf("Some webhook deliveries are still in progress")
+	}
+}
+
+// Handle sends event to the webhooks that want it.
+func (d *WebhookDispatcher) Handle(event *Event) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		logger.Errorf("Failed to encode event %d: %v", event.ID, err)
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.closed {
+		return
+	}
+
+	for _, target := range d.webhooks {
+		if target.config.Wants(event) {
+			d.deliveries.Add(1)
+			go d.deliver(target.ctx, target.config, event, payload)
+		}
+	}
+}
+
+// Deliveries returns the most recent deliveries, from the oldest.
+func (d *WebhookDispatcher) Deliveries() []*WebhookDelivery {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return append([]*WebhookDelivery{}, d.log...)
+}
+
+// record adds delivery to the log
+func (d *WebhookDispatcher) record(delivery *WebhookDelivery) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.log = append(d.log, delivery)
+	if len(d.log) > webhookLogSize {
+		d.log = d.log[len(d.log)-webhookLogSize:]
+	}
+
+	if d.logPath == "" {
+		return
+	}
+	file, err := os.OpenFile(d.logPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		logger.Errorf("Failed to write webhook delivery log: %v", err)
+		return
+	}
+	defer file.Close()
+	if err := json.NewEncoder(file).Encode(delivery); err != nil {
+		logger.Errorf("Failed to write webhook delivery log: %v", err)
+	}
+}
+
+// deliver posts payload to the webhook, retrying with an exponential
+// backoff until the receiver accepts it or ctx is cancelled
+func (d *WebhookDispatcher) deliver(ctx context.Context, webhook *WebhookConfig, event *Event, payload []byte) {
+	defer d.deliveries.Done()
+
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		delivery := &WebhookDelivery{
+			URL:     webhook.URL,
+			Event:   event.ID,
+			Type:    event.Type,
+			Channel: event.Channel,
+			Attempt: attempt,
+			Time:    time.Now().UTC().Format(time.RFC3339),
+		}
+
+		statusCode, err := d.post(webhook, event, payload)
+		delivery.StatusCode = statusCode
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+		d.record(delivery)
+
+		if err == nil {
+			logger.Debugf("Delivered event %d to %s", event.ID, webhook.URL)
+			return
+		}
+
+		// Client errors won't go away
+		if statusCode >= 400 && statusCode < 500 && statusCode != http.StatusTooManyRequests {
+			break
+		}
+
+		if attempt < webhookMaxAttempts {
+			delay := time.Duration(1<<uint(attempt-1)) * d.retryDelay
+			if delay > 5*time.Minute {
+				delay = 5 * time.Minute
+			}
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				logger.Warnf("Stopped delivering event %d to %s, the webhook was changed or the server is stopping", event.ID, webhook.URL)
+				return
+			}
+		}
+	}
+
+	logger.Errorf("Failed to deliver event %d to %s", event.ID, webhook.URL)
+}
+
+// post sends payload once, returns the status code if any
+func (d *WebhookDispatcher) post(webhook *WebhookConfig, event *Event, payload []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "image-manager")
+	req.Header.Set("X-Image-Manager-Event", string(event.Type))
+	req.Header.Set("X-Image-Manager-Delivery", strconv.FormatUint(event.ID, 10))
+	if webhook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(webhook.Secret))
+		mac.Write(payload)
+		req.Header.Set("X-Image-Manager-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// WebhookDeliveriesHandler lists the most recent webhook deliveries.
+func WebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	appState := appStateFromRequest(w, r)
+	if appState == nil {
+		return
+	}
+
+	if !authorize(w, r, PermissionAdmin, "") {
+		return
+	}
+
+	deliveries := []*WebhookDelivery{}
+	if appState.Webhooks != nil {
+		deliveries = appState.Webhooks.Deliveries()
+	}
+	EncodeJSONReply(w, r, deliveries)
+}
@@ -0,0 +1,210 @@
+// SPDX-FileCopyrightText: 2020 Pier Luigi Fiorini <pierluigi.fiorini@gmail.com>
+//
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitDeliveries fails unless the deliveries in progress end in time
+func waitDeliveries(t *testing.T, d *WebhookDispatcher) {
+	done := make(chan struct{})
+	go func() {
+		d.deliveries.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("deliveries did not end")
+	}
+}
+
+// waitAttempts waits until the webhook was called count times
+func waitAttempts(t *testing.T, attempts *int32, count int32) {
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(attempts) < count {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d attempts, want %d", atomic.LoadInt32(attempts), count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// newTestReceiver returns a webhook receiver that replies with status
+func newTestReceiver(status int, attempts *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(attempts, 1)
+		w.WriteHeader(status)
+	}))
+}
+
+func TestWebhookDeliver(t *testing.T) {
+	var payload []byte
+	var signature string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, _ = ioutil.ReadAll(r.Body)
+		signature = r.Header.Get("X-Image-Manager-Signature")
+	}))
+	defer receiver.Close()
+
+	webhook := &WebhookConfig{URL: receiver.URL, Secret: "secret"}
+	d := NewWebhookDispatcher([]*WebhookConfig{webhook}, "")
+	d.Handle(&Event{ID: 1, Type: EventPublish, Channel: "nightly"})
+	waitDeliveries(t, d)
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(payload)
+	if expected := "sha256=" + hex.EncodeToString(mac.Sum(nil)); signature != expected {
+		t.Fatalf("signature %q, want %q", signature, expected)
+	}
+
+	deliveries := d.Deliveries()
+	if len(deliveries) != 1 || deliveries[0].StatusCode != http.StatusOK || deliveries[0].Error != "" {
+		t.Fatalf("deliveries %+v", deliveries)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		attempts int32
+	}{
+		{"server error", http.StatusInternalServerError, webhookMaxAttempts},
+		{"too many requests", http.StatusTooManyRequests, webhookMaxAttempts},
+		{"client error", http.StatusNotFound, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var attempts int32
+			receiver := newTestReceiver(test.status, &attempts)
+			defer receiver.Close()
+
+			d := NewWebhookDispatcher([]*WebhookConfig{{URL: receiver.URL}}, "")
+			d.retryDelay = time.Millisecond
+			d.Handle(&Event{ID: 1, Type: EventPublish, Channel: "nightly"})
+			waitDeliveries(t, d)
+
+			if atomic.LoadInt32(&attempts) != test.attempts {
+				t.Fatalf("%d attempts, want %d", attempts, test.attempts)
+			}
+		})
+	}
+}
+
+func TestWebhookStopRetrying(t *testing.T) {
+	tests := []struct {
+		name string
+		stop func(d *WebhookDispatcher)
+	}{
+		{"reload", func(d *WebhookDispatcher) { d.SetWebhooks(nil) }},
+		{"close", func(d *WebhookDispatcher) { d.Close() }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var attempts int32
+			receiver := newTestReceiver(http.StatusInternalServerError, &attempts)
+			defer receiver.Close()
+
+			// Without a reload or a shutdown the next attempt is far away
+			d := NewWebhookDispatcher([]*WebhookConfig{{URL: receiver.URL}}, "")
+			d.retryDelay = time.Hour
+			d.Handle(&Event{ID: 1, Type: EventPublish, Channel: "nightly"})
+			waitAttempts(t, &attempts, 1)
+
+			test.stop(d)
+			waitDeliveries(t, d)
+			if atomic.LoadInt32(&attempts) != 1 {
+				t.Fatalf("%d attempts, want 1", atomic.LoadInt32(&attempts))
+			}
+		})
+	}
+}
+
+func TestWebhookAfterReload(t *testing.T) {
+	var attempts int32
+	receiver := newTestReceiver(http.StatusOK, &attempts)
+	defer receiver.Close()
+
+	d := NewWebhookDispatcher(nil, "")
+	d.SetWebhooks([]*WebhookConfig{{URL: receiver.URL}})
+	d.Handle(&Event{ID: 1, Type: EventPublish, Channel: "nightly"})
+	waitDeliveries(t, d)
+	if atomic.LoadInt32(&attempts) != 1 {
+		t.Fatalf("%d attempts after a reload, want 1", atomic.LoadInt32(&attempts))
+	}
+
+	// Nothing is sent once closed
+	d.Close()
+	d.SetWebhooks([]*WebhookConfig{{URL: receiver.URL}})
+	d.Handle(&Event{ID: 2, Type: EventPublish, Channel: "nightly"})
+	waitDeliveries(t, d)
+	if atomic.LoadInt32(&attempts) != 1 {
+		t.Fatalf("%d attempts after closing, want 1", atomic.LoadInt32(&attempts))
+	}
+}
+
+func TestWebhookReloadChanged(t *testing.T) {
+	// The unchanged webhook accepts the second attempt
+	var unchangedAttempts, changedAttempts int32
+	unchanged := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&unchangedAttempts, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer unchanged.Close()
+	changed := newTestReceiver(http.StatusInternalServerError, &changedAttempts)
+	defer changed.Close()
+
+	d := NewWebhookDispatcher([]*WebhookConfig{{URL: unchanged.URL}, {URL: changed.URL}}, "")
+	d.retryDelay = 200 * time.Millisecond
+	d.Handle(&Event{ID: 1, Type: EventPublish, Channel: "nightly"})
+	waitAttempts(t, &unchangedAttempts, 1)
+	waitAttempts(t, &changedAttempts, 1)
+
+	// A reload reads the configuration again
+	d.SetWebhooks([]*WebhookConfig{{URL: unchanged.URL}, {URL: changed.URL, Secret: "secret"}})
+	waitDeliveries(t, d)
+	if atomic.LoadInt32(&unchangedAttempts) != 2 {
+		t.Fatalf("%d attempts to the unchanged webhook, want 2", atomic.LoadInt32(&unchangedAttempts))
+	}
+	if atomic.LoadInt32(&changedAttempts) != 1 {
+		t.Fatalf("%d attempts to the changed webhook, want 1", atomic.LoadInt32(&changedAttempts))
+	}
+}
+
+func TestWebhookCloseWaits(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer receiver.Close()
+
+	d := NewWebhookDispatcher([]*WebhookConfig{{URL: receiver.URL}}, "")
+	d.Handle(&Event{ID: 1, Type: EventPublish, Channel: "nightly"})
+	d.Close()
+	if deliveries := d.Deliveries(); len(deliveries) != 1 || deliveries[0].StatusCode != http.StatusOK {
+		t.Fatalf("deliveries %+v", deliveries)
+	}
+
+	// Deliveries that take too long are not waited for
+	d = NewWebhookDispatcher([]*WebhookConfig{{URL: receiver.URL}}, "")
+	d.closeTimeout = time.Millisecond
+	d.Handle(&Event{ID: 1, Type: EventPublish, Channel: "nightly"})
+	d.Close()
+	if deliveries := d.Deliveries(); len(deliveries) != 0 {
+		t.Fatalf("deliveries %+v", deliveries)
+	}
+	waitDeliveries(t, d)
+}